@@ -3,7 +3,7 @@ package main
 import (
 	"bytes"
 	"fmt"
-	"math"
+	"time"
 )
 
 // ArrayItem holds anything that has to be stored in array
@@ -27,9 +27,19 @@ type ByteArrayItem struct {
 }
 
 func (b ByteArrayItem) Index() uint32   { return b.index }
-func (b ByteArrayItem) Encoded() []byte { return []byte{} } // TODO implement this
+func (b ByteArrayItem) Encoded() []byte { return []byte{b.value} }
 func (b ByteArrayItem) Size() uint32    { return 4 + 1 }
 
+// BytesArrayItem is an array item that holds an encoded value
+type BytesArrayItem struct {
+	index uint32
+	value []byte
+}
+
+func (b BytesArrayItem) Index() uint32   { return b.index }
+func (b BytesArrayItem) Encoded() []byte { return b.value }
+func (b BytesArrayItem) Size() uint32    { return 4 + uint32(len(b.value)) }
+
 type ArraySegment struct {
 	id        SegmentID
 	totalSize uint32
@@ -80,6 +90,11 @@ func (a *ArraySegment) AddItem(s ArrayItem) {
 	if s.Size() > maxItemSize {
 		return
 	}
+	if len(a.elements) == 0 {
+		a.elements = append(a.elements, s)
+		a.totalSize += s.Size()
+		return
+	}
 	if s.Index() < a.StartIndex() {
 		// prepend
 		newElms := make([]ArrayItem, 1)
@@ -138,19 +153,23 @@ func (a *ArraySegment) RemoveItem(index uint32) {
 }
 
 func (a *ArraySegment) Split() (seg2 *ArraySegment) {
-	// TODO change this logic to act based on the size of values (if hetro)
-	// this compute the ceil of split keep the first part with more members (optimized for append operations)
-	d := float64(len(a.elements)) / float64(2)
-	breakPoint := int(math.Ceil(d))
+	return a.SplitWithConfig(DefaultSplitConfig())
+}
+
+// SplitWithConfig moves the upper part of the elements into a new segment, the split point is chosen
+// by the size of the elements so that the left part keeps about c.Bias share of the bytes
+func (a *ArraySegment) SplitWithConfig(c SplitConfig) (seg2 *ArraySegment) {
+	breakPoint := balancedSplitPoint(a.itemSizes(), c.Bias)
 
 	newSeg := NewArraySegment(generateUUID())
-	newSeg.elements = a.elements[breakPoint:len(a.elements)]
+	// copy so appends to either segment don't write into the other one
+	newSeg.elements = append(newSeg.elements, a.elements[breakPoint:]...)
 	newSegSize := uint32(0)
 	for _, e := range newSeg.elements {
 		newSegSize += e.Size()
 	}
 	newSeg.totalSize = newSegSize
-	a.elements = a.elements[:breakPoint]
+	a.elements = a.elements[:breakPoint:breakPoint]
 	a.totalSize = a.totalSize - newSegSize
 	return newSeg
 }
@@ -160,22 +179,94 @@ func (a *ArraySegment) Merge(seg2 *ArraySegment) {
 	a.totalSize = a.totalSize + seg2.totalSize
 }
 
+// canRebalance reports whether a and its right neighbor can be merged into one segment or have their
+// elements redistributed so both end up within the thresholds
+func (a *ArraySegment) canRebalance(right *ArraySegment) bool {
+	if a.totalSize+right.totalSize <= maxThreshold {
+		return true
+	}
+	sizes := append(a.itemSizes(), right.itemSizes()...)
+	bp := balancedSplitPoint(sizes, 0.5)
+	return splitTier(prefixSize(sizes, bp), a.totalSize+right.totalSize-prefixSize(sizes, bp)) == 0
+}
+
+func (a *ArraySegment) itemSizes() []uint32 {
+	sizes := make([]uint32, len(a.elements))
+	for i, e := range a.elements {
+		sizes[i] = e.Size()
+	}
+	return sizes
+}
+
+// Redistribute moves elements between two neighboring segments (a is the left one) so both hold about
+// the same number of bytes
+func (a *ArraySegment) Redistribute(right *ArraySegment) {
+	all := make([]ArrayItem, 0, len(a.elements)+len(right.elements))
+	all = append(all, a.elements...)
+	all = append(all, right.elements...)
+	sizes := append(a.itemSizes(), right.itemSizes()...)
+	breakPoint := balancedSplitPoint(sizes, 0.5)
+	a.elements = all[:breakPoint:breakPoint]
+	right.elements = append(make([]ArrayItem, 0, len(all)-breakPoint), all[breakPoint:]...)
+	a.totalSize = prefixSize(sizes, breakPoint)
+	right.totalSize = prefixSize(sizes, len(sizes)) - a.totalSize
+}
+
 func (a ArraySegment) ID() SegmentID {
 	return a.id
 }
 
+// Encoded writes the kind, the number of elements and then index, flag and value of each element
 func (a ArraySegment) Encoded() []byte {
-	// TODO update me and properly implement me
-	// right now we just append bytes
-	res := make([]byte, 0)
+	res := []byte{segKindArray}
+	res = appendUint32(res, uint32(len(a.elements)))
+	for _, e := range a.elements {
+		res = appendUint32(res, e.Index())
+		res = append(res, itemFlag(e))
+		res = appendBytes(res, e.Encoded())
+	}
+	return sealSegment(res)
+}
+
+// References returns the meta segment ids of the child collections stored in this segment
+func (a ArraySegment) References() []SegmentID {
+	res := make([]SegmentID, 0)
 	for _, e := range a.elements {
-		res = append(res, e.Encoded()...)
+		if ref, ok := e.(collectionRef); ok {
+			res = append(res, ref.ChildMetaSegmentID())
+		}
 	}
 	return res
 }
 
-func (a ArraySegment) Load([]byte) error {
-	// TODO implement me
+func (a *ArraySegment) Load(data []byte) error {
+	d, err := openSegment(a.id, data, segKindArray)
+	if err != nil {
+		return err
+	}
+	n := d.uint32()
+	elements := make([]ArrayItem, 0)
+	totalSize := uint32(0)
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		index := d.uint32()
+		flag := d.byte()
+		value := d.bytes()
+		var item ArrayItem = BytesArrayItem{index, value}
+		if flag == itemFlagCollection {
+			kind, metaID, err := decodeCollectionRef(value)
+			if err != nil {
+				return &CorruptSegmentError{ID: a.id, Reason: err.Error()}
+			}
+			item = CollectionArrayItem{index, kind, metaID}
+		}
+		elements = append(elements, item)
+		totalSize += item.Size()
+	}
+	if err := d.finish(); err != nil {
+		return err
+	}
+	a.elements = elements
+	a.totalSize = totalSize
 	return nil
 }
 
@@ -187,6 +278,7 @@ func (a *ArraySegment) Header() ArraySegmentHeader {
 	return ArraySegmentHeader{
 		startIndex: a.StartIndex(),
 		size:       a.totalSize,
+		count:      uint32(len(a.elements)),
 		segID:      a.id,
 	}
 }
@@ -194,6 +286,7 @@ func (a *ArraySegment) Header() ArraySegmentHeader {
 type ArraySegmentHeader struct {
 	startIndex uint32
 	size       uint32
+	count      uint32 // number of elements, so stats don't have to load the segment
 	segID      SegmentID
 }
 
@@ -207,19 +300,73 @@ func (a ArrayMetaSegment) ID() SegmentID {
 	return a.id
 }
 
+// Encoded writes the kind, the format version, the size and then the segment headers
 func (a ArrayMetaSegment) Encoded() []byte {
-	// TODO implement me
-	return []byte{}
+	res := []byte{segKindArrayMetaVersioned, metaFormatVersion}
+	res = appendUint32(res, a.size)
+	res = appendUint32(res, uint32(len(a.sortedSegHeaders)))
+	for _, h := range a.sortedSegHeaders {
+		res = appendUint32(res, h.startIndex)
+		res = appendUint32(res, h.size)
+		res = appendUint32(res, h.count)
+		res = appendUint64(res, uint64(h.segID))
+	}
+	return sealSegment(res)
 }
 
-func (a ArrayMetaSegment) Load([]byte) error {
-	// TODO implement me
+// References returns the ids of the segments holding the array elements
+func (a ArrayMetaSegment) References() []SegmentID {
+	res := make([]SegmentID, len(a.sortedSegHeaders))
+	for i, h := range a.sortedSegHeaders {
+		res[i] = h.segID
+	}
+	return res
+}
+
+func (a *ArrayMetaSegment) Load(data []byte) error {
+	d, _, err := openMetaSegment(a.id, data, segKindArrayMetaVersioned)
+	if err != nil {
+		return err
+	}
+	size := d.uint32()
+	n := d.uint32()
+	// an array always has a segment, the lookups index the last header
+	if d.err == nil && n == 0 {
+		return &CorruptSegmentError{ID: a.id, Reason: "no segment headers"}
+	}
+	headers := make([]ArraySegmentHeader, 0)
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		headers = append(headers, ArraySegmentHeader{startIndex: d.uint32(), size: d.uint32(), count: d.uint32(), segID: d.segmentID()})
+	}
+	if err := d.finish(); err != nil {
+		return err
+	}
+	a.size = size
+	a.sortedSegHeaders = headers
 	return nil
 }
 
 type Array struct {
 	metaSegmentID SegmentID
 	sp            SegmentProvider
+	feed          *ChangeFeed
+	counts        structuralCounts
+	pending       []structuralChange // structural changes of the running operation
+	observer      Observer
+	split         *SplitConfig
+	err           error // first segment read that failed
+}
+
+// SetSplitConfig sets how full segments of this array are split, the config is not persisted
+func (a *Array) SetSplitConfig(c SplitConfig) {
+	a.split = &c
+}
+
+func (a *Array) splitConfig() SplitConfig {
+	if a.split == nil {
+		return DefaultSplitConfig()
+	}
+	return *a.split
 }
 
 // Print is intended for debugging purpose only
@@ -250,16 +397,66 @@ func NewArray(sp SegmentProvider) *Array {
 		size:             0,
 	}
 	sp.AddSegment(metaSeg)
-	return &Array{metaSegID, sp}
+	return &Array{metaSegmentID: metaSegID, sp: sp}
 }
 
+// ArrayMetaSegment returns the meta segment of the array, an empty one if it can't be read (see Err)
 func (a *Array) ArrayMetaSegment() *ArrayMetaSegment {
-	return a.sp.GetSegment(a.metaSegmentID).(*ArrayMetaSegment)
+	mseg, err := a.metaSegment()
+	if err != nil {
+		a.setErr(err)
+		return &ArrayMetaSegment{id: a.metaSegmentID}
+	}
+	return mseg
+}
+
+// metaSegment returns the meta segment of the array or the reason it can't be read
+func (a *Array) metaSegment() (*ArrayMetaSegment, error) {
+	seg, err := loadSegment(a.sp, a.metaSegmentID)
+	if err != nil {
+		return nil, err
+	}
+	mseg, ok := seg.(*ArrayMetaSegment)
+	if !ok {
+		return nil, fmt.Errorf("segment %d is not an array meta segment", a.metaSegmentID)
+	}
+	return mseg, nil
+}
+
+// segment returns the array segment with the given id or the reason it can't be read
+func (a *Array) segment(id SegmentID) (*ArraySegment, error) {
+	seg, err := loadSegment(a.sp, id)
+	if err != nil {
+		return nil, err
+	}
+	aseg, ok := seg.(*ArraySegment)
+	if !ok {
+		return nil, fmt.Errorf("segment %d is not an array segment", id)
+	}
+	return aseg, nil
+}
+
+// Err returns the first segment read that failed since the last call and clears it, reads that
+// can't return an error (Get, LastIndex, ...) report a missing or corrupt segment here
+func (a *Array) Err() error {
+	err := a.err
+	a.err = nil
+	return err
+}
+
+func (a *Array) setErr(err error) {
+	if a.err == nil {
+		a.err = err
+	}
 }
 
+// FindSegmentIndex returns the position of the header of the segment holding inpIndex,
+// -1 if the meta segment can't be read
 func (a *Array) FindSegmentIndex(inpIndex uint32) int {
-	// TODO optimize this read and pass it as param
-	mseg := a.ArrayMetaSegment()
+	return a.ArrayMetaSegment().segmentIndex(inpIndex)
+}
+
+func (mseg *ArrayMetaSegment) segmentIndex(inpIndex uint32) int {
 	for i, segH := range mseg.sortedSegHeaders {
 		if inpIndex == segH.startIndex {
 			return i
@@ -275,126 +472,253 @@ func (a *Array) FindSegmentIndex(inpIndex uint32) int {
 	return len(mseg.sortedSegHeaders) - 1
 }
 
-func (a *Array) Insert(inp ArrayItem) {
+// Insert puts the item at its index, an item larger than maxItemSize is rejected with ErrItemTooLarge.
+// Nothing is changed if the provider rejects the write.
+func (a *Array) Insert(inp ArrayItem) error {
+	start := time.Now()
 	// TODO handle insert if size of storable is bigger than threshold
-	mseg := a.ArrayMetaSegment()
-	segIndex := a.FindSegmentIndex(inp.Index())
-	segH := mseg.sortedSegHeaders[segIndex]
-	seg := a.sp.GetSegment(segH.segID)
-	aseg := seg.(*ArraySegment)
-	oldSize := aseg.totalSize
-	aseg.AddItem(inp)
-
-	if aseg.totalSize > maxThreshold {
-		s2 := aseg.Split()
+	if inp.Size() > maxItemSize {
+		// the segment would drop it, so it must not replace (and drop) a child collection
+		return fmt.Errorf("index %d: %w", inp.Index(), ErrItemTooLarge)
+	}
+	var oldItem ArrayItem
+	var replaced bool
+	var segID SegmentID
+	structural := make([]ChangeEvent, 0)
+	err := a.apply(func() error {
+		mseg, err := a.metaSegment()
+		if err != nil {
+			return err
+		}
+		segIndex := mseg.segmentIndex(inp.Index())
+		aseg, err := a.segment(mseg.sortedSegHeaders[segIndex].segID)
+		if err != nil {
+			return err
+		}
+		segID = aseg.id
+		oldItem, replaced = aseg.GetItem(inp.Index())
+		oldSize := aseg.totalSize
+		aseg.AddItem(inp)
+		mseg.size = mseg.size - oldSize + aseg.totalSize
+
 		mseg.sortedSegHeaders[segIndex] = aseg.Header()
-		// last one
-		if segIndex == len(mseg.sortedSegHeaders)-1 {
-			mseg.sortedSegHeaders = append(mseg.sortedSegHeaders, s2.Header())
-		} else {
-			newSortedHeaders := mseg.sortedSegHeaders[:segIndex]
+		last := segIndex + 1
+		if aseg.totalSize > maxThreshold {
+			start := time.Now()
+			s2 := aseg.SplitWithConfig(a.splitConfig())
+			mseg.sortedSegHeaders[segIndex] = aseg.Header()
+			newSortedHeaders := make([]ArraySegmentHeader, 0, len(mseg.sortedSegHeaders)+1)
+			newSortedHeaders = append(newSortedHeaders, mseg.sortedSegHeaders[:segIndex+1]...)
 			newSortedHeaders = append(newSortedHeaders, s2.Header())
-			mseg.sortedSegHeaders = append(newSortedHeaders, mseg.sortedSegHeaders[segIndex:len(mseg.sortedSegHeaders)]...)
+			mseg.sortedSegHeaders = append(newSortedHeaders, mseg.sortedSegHeaders[segIndex+1:]...)
+			a.sp.AddSegment(s2)
+			structural = append(structural, ChangeEvent{Op: OpSplit, Segments: []SegmentID{aseg.id, s2.id}})
+			a.structural(OpSplit, aseg.totalSize+s2.totalSize, start)
+			last++
+		}
+		a.sp.AddSegment(aseg)
+		settled, err := a.settle(mseg, segIndex-1, last)
+		if err != nil {
+			return err
 		}
-		a.sp.AddSegment(s2)
+		structural = append(structural, settled...)
+		a.sp.AddSegment(mseg)
+		if replaced {
+			dropReplacedChild(a.sp, oldItem, inp)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-	mseg.size = mseg.size - oldSize + aseg.totalSize
-	a.sp.AddSegment(mseg)
-	a.sp.AddSegment(aseg)
+	a.emitWrite(structural, ChangeEvent{Op: writeOp(replaced), Index: inp.Index(), Old: oldValue(oldItem, replaced), New: inp.Encoded(), Segments: []SegmentID{segID}})
+	a.observe("insert", inp.Size(), start)
+	return nil
 }
 
-func (a *Array) Remove(index uint32) {
-	mseg := a.ArrayMetaSegment()
-	segIndex := a.FindSegmentIndex(index)
-	segH := mseg.sortedSegHeaders[segIndex]
-	seg := a.sp.GetSegment(segH.segID)
-	aseg := seg.(*ArraySegment)
-	oldSize := aseg.totalSize
-	aseg.RemoveItem(index)
-	mseg.size = mseg.size - oldSize + aseg.totalSize
-	if aseg.totalSize < minThreshold {
-		if len(mseg.sortedSegHeaders) > 1 { // if only one segment don't merge
-			if segIndex == 0 { // first segment
-				nextSeg := a.sp.GetSegment(mseg.sortedSegHeaders[1].segID).(*ArraySegment)
-				if nextSeg.totalSize+aseg.totalSize <= maxThreshold {
-					aseg.Merge(nextSeg)
-					newSortedHeaders := mseg.sortedSegHeaders[:1]
-					newSortedHeaders[0] = aseg.Header()
-					if len(mseg.sortedSegHeaders) > 2 {
-						newSortedHeaders = append(newSortedHeaders, mseg.sortedSegHeaders[2:]...)
-					}
-					mseg.sortedSegHeaders = newSortedHeaders
-					a.sp.RemoveSegment(nextSeg)
-					a.sp.AddSegment(aseg)
-					a.sp.AddSegment(mseg)
-				}
-			} else if segIndex == len(mseg.sortedSegHeaders)-1 { // last segment
-				prevSeg := a.sp.GetSegment(mseg.sortedSegHeaders[segIndex-1].segID).(*ArraySegment)
-				if prevSeg.totalSize+aseg.totalSize <= maxThreshold {
-					prevSeg.Merge(aseg)
-					newSortedHeaders := mseg.sortedSegHeaders[:segIndex]
-					newSortedHeaders[segIndex-1] = prevSeg.Header()
-					mseg.sortedSegHeaders = newSortedHeaders
-					a.sp.RemoveSegment(aseg)
-					a.sp.AddSegment(prevSeg)
-					a.sp.AddSegment(mseg)
-				}
-			} else if mseg.sortedSegHeaders[segIndex-1].size > mseg.sortedSegHeaders[segIndex+1].size {
-				nextSeg := a.sp.GetSegment(mseg.sortedSegHeaders[1].segID).(*ArraySegment)
-				if nextSeg.totalSize+aseg.totalSize <= maxThreshold {
-					aseg.Merge(nextSeg)
-					newSortedHeaders := mseg.sortedSegHeaders[:segIndex+1]
-					newSortedHeaders[segIndex] = aseg.Header()
-					if len(mseg.sortedSegHeaders) > segIndex+2 {
-						newSortedHeaders = append(newSortedHeaders, mseg.sortedSegHeaders[segIndex+2:]...)
-					}
-					mseg.sortedSegHeaders = newSortedHeaders
-					a.sp.RemoveSegment(nextSeg)
-					a.sp.AddSegment(aseg)
-					a.sp.AddSegment(mseg)
-				}
-			} else {
-				prevSeg := a.sp.GetSegment(mseg.sortedSegHeaders[1].segID).(*ArraySegment)
-				if prevSeg.totalSize+aseg.totalSize <= maxThreshold {
-					prevSeg.Merge(aseg)
-					newSortedHeaders := mseg.sortedSegHeaders[:segIndex]
-					newSortedHeaders[segIndex-1] = prevSeg.Header()
-					if len(mseg.sortedSegHeaders) > segIndex+1 {
-						newSortedHeaders = append(newSortedHeaders, mseg.sortedSegHeaders[segIndex+1:]...)
-					}
-					mseg.sortedSegHeaders = newSortedHeaders
-					a.sp.RemoveSegment(aseg)
-					a.sp.AddSegment(prevSeg)
-					a.sp.AddSegment(mseg)
-				}
-			}
-			return
+// LastIndex returns the index of the last element, zero if the array is empty or can't be read (see Err)
+func (a *Array) LastIndex() uint32 {
+	last, err := a.lastIndex()
+	if err != nil {
+		a.setErr(err)
+	}
+	return last
+}
+
+func (a *Array) lastIndex() (uint32, error) {
+	mseg, err := a.metaSegment()
+	if err != nil {
+		return 0, err
+	}
+	seg, err := a.segment(mseg.sortedSegHeaders[len(mseg.sortedSegHeaders)-1].segID)
+	if err != nil {
+		return 0, err
+	}
+	return seg.LastIndex(), nil
+}
+
+func (a *Array) Get(index uint32) (ArrayItem, bool) {
+	res, found, err := a.get(index)
+	if err != nil {
+		a.setErr(err)
+	}
+	return res, found
+}
+
+// get is Get that returns a failed read instead of recording it in the array
+func (a *Array) get(index uint32) (res ArrayItem, found bool, err error) {
+	defer func(start time.Time) {
+		size := uint32(0)
+		if found {
+			size = res.Size()
 		}
+		a.observe("get", size, start)
+	}(time.Now())
+	mseg, err := a.metaSegment()
+	if err != nil {
+		return nil, false, err
 	}
-	a.sp.AddSegment(mseg)
-	a.sp.AddSegment(aseg)
+	seg, err := a.segment(mseg.sortedSegHeaders[mseg.segmentIndex(index)].segID)
+	if err != nil {
+		return nil, false, err
+	}
+	res, found = seg.GetItem(index)
+	return res, found, nil
 }
 
-func (a *Array) AppendByteArrayItem(v uint8) {
-	mseg := a.ArrayMetaSegment()
-	segIndex := len(mseg.sortedSegHeaders) - 1 // get last header
-	segH := mseg.sortedSegHeaders[segIndex]
-	seg := a.sp.GetSegment(segH.segID)
-	aseg := seg.(*ArraySegment)
-	inp := ByteArrayItem{aseg.LastIndex() + 1, byte(v)}
-	oldSize := aseg.totalSize
-	aseg.AddItem(inp)
-	mseg.size = mseg.size - oldSize + aseg.totalSize
-
-	if aseg.totalSize > maxThreshold {
-		s2 := aseg.Split()
+// Remove deletes the element at index, removing a missing index is not an error. Nothing is changed
+// if the provider rejects the write.
+func (a *Array) Remove(index uint32) error {
+	start := time.Now()
+	var oldItem ArrayItem
+	var found bool
+	var segID SegmentID
+	var structural []ChangeEvent
+	err := a.apply(func() error {
+		mseg, err := a.metaSegment()
+		if err != nil {
+			return err
+		}
+		segIndex := mseg.segmentIndex(index)
+		aseg, err := a.segment(mseg.sortedSegHeaders[segIndex].segID)
+		if err != nil {
+			return err
+		}
+		segID = aseg.id
+		oldItem, found = aseg.GetItem(index)
+		oldSize := aseg.totalSize
+		aseg.RemoveItem(index)
+		mseg.size = mseg.size - oldSize + aseg.totalSize
 		mseg.sortedSegHeaders[segIndex] = aseg.Header()
-		mseg.sortedSegHeaders = append(mseg.sortedSegHeaders, s2.Header())
-		a.sp.AddSegment(s2)
+		a.sp.AddSegment(aseg)
+		structural, err = a.settle(mseg, segIndex-1, segIndex+1)
+		if err != nil {
+			return err
+		}
+		a.sp.AddSegment(mseg)
+		if found {
+			// removing a child collection removes all of its segments
+			dropReplacedChild(a.sp, oldItem, nil)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range structural {
+		a.feed.emit(e)
+	}
+	if found {
+		a.feed.emit(ChangeEvent{Op: OpRemove, Index: index, Old: oldItem.Encoded(), Segments: []SegmentID{segID}})
+		a.observe("remove", oldItem.Size(), start)
+		return nil
+	}
+	a.observe("remove", 0, start)
+	return nil
+}
+
+// settle rebalances the segments between first and last (header indexes) that are below minThreshold,
+// a segment is merged with or redistributed with a neighbor as long as that brings it within the
+// thresholds. Changed segments have to be stored already, it returns the structural changes.
+func (a *Array) settle(mseg *ArrayMetaSegment, first, last int) ([]ChangeEvent, error) {
+	events := make([]ChangeEvent, 0)
+	if first < 0 {
+		first = 0
+	}
+	for i := first; i <= last && i < len(mseg.sortedSegHeaders); i++ {
+		if len(mseg.sortedSegHeaders) < 2 || mseg.sortedSegHeaders[i].size >= minThreshold {
+			continue
+		}
+		leftIndex, e, err := a.rebalance(mseg, i)
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			continue
+		}
+		events = append(events, *e)
+		// the rebalanced segments changed, so did the options of their neighbors
+		i = leftIndex - 2
+		if i < -1 {
+			i = -1
+		}
+		if last < leftIndex+2 {
+			last = leftIndex + 2
+		}
+	}
+	return events, nil
+}
+
+// rebalance fixes the segment at segIndex that went below minThreshold using its smaller neighbor
+// or else the other one, the two segments are merged if they fit into one, otherwise the elements
+// are redistributed between them. It returns the index of the left segment and the structural change
+// for the change feed, the change is nil if neither neighbor can bring the segment within the thresholds.
+func (a *Array) rebalance(mseg *ArrayMetaSegment, segIndex int) (leftIndex int, e *ChangeEvent, err error) {
+	start := time.Now()
+	headers := mseg.sortedSegHeaders
+	for _, n := range rebalanceNeighbors(len(headers), segIndex, func(i int) uint32 { return headers[i].size }) {
+		leftIndex = segIndex
+		if n < segIndex {
+			leftIndex = n
+		}
+		left, err := a.segment(headers[leftIndex].segID)
+		if err != nil {
+			return 0, nil, err
+		}
+		right, err := a.segment(headers[leftIndex+1].segID)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !left.canRebalance(right) {
+			continue
+		}
+		if left.totalSize+right.totalSize <= maxThreshold {
+			left.Merge(right)
+			headers[leftIndex] = left.Header()
+			mseg.sortedSegHeaders = append(headers[:leftIndex+1], headers[leftIndex+2:]...)
+			a.sp.RemoveSegment(right)
+			a.sp.AddSegment(left)
+			a.structural(OpMerge, left.totalSize, start)
+			return leftIndex, &ChangeEvent{Op: OpMerge, Segments: []SegmentID{left.id, right.id}}, nil
+		}
+		left.Redistribute(right)
+		headers[leftIndex] = left.Header()
+		headers[leftIndex+1] = right.Header()
+		a.sp.AddSegment(left)
+		a.sp.AddSegment(right)
+		a.structural(OpRedistribute, left.totalSize+right.totalSize, start)
+		return leftIndex, &ChangeEvent{Op: OpRedistribute, Segments: []SegmentID{left.id, right.id}}, nil
 	}
+	return segIndex, nil, nil
+}
 
-	a.sp.AddSegment(mseg)
-	a.sp.AddSegment(aseg)
+// AppendByteArrayItem inserts v after the last element
+func (a *Array) AppendByteArrayItem(v uint8) error {
+	last, err := a.lastIndex()
+	if err != nil {
+		return err
+	}
+	return a.Insert(ByteArrayItem{last + 1, byte(v)})
 }
 
 func (a *Array) ValidateCorrectness(expectedValues []byte) bool {
@@ -0,0 +1,120 @@
+package main
+
+import "sort"
+
+// BatchSegmentProvider is implemented by providers that can reject writes (e.g. because of a quota),
+// the segments written and removed by a single collection operation are handed over as one batch so
+// the provider can apply all or none of them
+type BatchSegmentProvider interface {
+	SegmentProvider
+	WriteBatch(adds []Segment, removes []Segment) error
+}
+
+// segmentBatch stages the writes of a collection operation on top of a provider. Segments are read as
+// private copies, so an operation that is rejected leaves the segments held by the provider untouched
+// even if the provider hands out shared pointers.
+type segmentBatch struct {
+	sp       BatchSegmentProvider
+	segments map[SegmentID]Segment // copies read so far and staged writes
+	written  []SegmentID           // staged writes in order
+	removed  map[SegmentID]Segment
+}
+
+func newSegmentBatch(sp BatchSegmentProvider) *segmentBatch {
+	return &segmentBatch{
+		sp:       sp,
+		segments: make(map[SegmentID]Segment),
+		removed:  make(map[SegmentID]Segment),
+	}
+}
+
+func (b *segmentBatch) GetSegment(id SegmentID) Segment {
+	if _, ok := b.removed[id]; ok {
+		return nil
+	}
+	if seg, ok := b.segments[id]; ok {
+		return seg
+	}
+	seg := b.sp.GetSegment(id)
+	if seg == nil {
+		return nil
+	}
+	cp, err := DecodeSegment(id, seg.Encoded())
+	if err != nil {
+		return nil
+	}
+	b.segments[id] = cp
+	return cp
+}
+
+func (b *segmentBatch) AddSegment(seg Segment) {
+	delete(b.removed, seg.ID())
+	b.segments[seg.ID()] = seg
+	for _, id := range b.written {
+		if id == seg.ID() {
+			return
+		}
+	}
+	b.written = append(b.written, seg.ID())
+}
+
+func (b *segmentBatch) RemoveSegment(seg Segment) {
+	delete(b.segments, seg.ID())
+	b.removed[seg.ID()] = seg
+}
+
+// Err returns the failed reads of the provider
+func (b *segmentBatch) Err() error {
+	if r, ok := b.sp.(errorReporter); ok {
+		return r.Err()
+	}
+	return nil
+}
+
+// commit hands the staged writes over to the provider, nothing is written if it returns an error
+func (b *segmentBatch) commit() error {
+	adds := make([]Segment, 0, len(b.written))
+	for _, id := range b.written {
+		if seg, ok := b.segments[id]; ok {
+			adds = append(adds, seg)
+		}
+	}
+	removes := make([]Segment, 0, len(b.removed))
+	for _, seg := range b.removed {
+		removes = append(removes, seg)
+	}
+	// removals are handed over in id order so providers see the same batch on every run
+	sort.Slice(removes, func(i, j int) bool { return removes[i].ID() < removes[j].ID() })
+	return b.sp.WriteBatch(adds, removes)
+}
+
+// writeBatch hands adds and removes over to sp as one batch if it can take one, otherwise they are
+// written one by one and nothing can be rejected. Wrapping providers use it to pass batches through.
+func writeBatch(sp SegmentProvider, adds []Segment, removes []Segment) error {
+	if bsp, ok := sp.(BatchSegmentProvider); ok {
+		return bsp.WriteBatch(adds, removes)
+	}
+	for _, seg := range adds {
+		sp.AddSegment(seg)
+	}
+	for _, seg := range removes {
+		sp.RemoveSegment(seg)
+	}
+	return nil
+}
+
+// runBatch runs fn with *sp replaced by a batch if the provider can reject writes, the batch is
+// committed once fn returns without an error. The provider is restored even if fn panics.
+func runBatch(sp *SegmentProvider, fn func() error) error {
+	bsp, ok := (*sp).(BatchSegmentProvider)
+	if !ok {
+		return fn()
+	}
+	b := newSegmentBatch(bsp)
+	*sp = b
+	defer func() { *sp = bsp }()
+	if err := fn(); err != nil {
+		return err
+	}
+	return b.commit()
+}
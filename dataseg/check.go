@@ -0,0 +1,200 @@
+package main
+
+import "fmt"
+
+// Violation describes a broken structural invariant found by Check
+type Violation struct {
+	SegmentID SegmentID // segment where the problem was found
+	Message   string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("segment %d: %s", v.SegmentID, v.Message)
+}
+
+type violations []Violation
+
+func (v *violations) add(id SegmentID, format string, args ...interface{}) {
+	*v = append(*v, Violation{SegmentID: id, Message: fmt.Sprintf(format, args...)})
+}
+
+// checkThresholds reports segments that are larger than maxThreshold, or smaller than
+// minThreshold while they could have been merged or redistributed with a sibling
+func checkThresholds(res *violations, id SegmentID, size uint32, index int, canRebalance func(left, right int) bool, segCount int) {
+	if size > maxThreshold {
+		res.add(id, "size %d is above max threshold %d", size, maxThreshold)
+	}
+	if segCount < 2 || size >= minThreshold {
+		return
+	}
+	for _, n := range []int{index - 1, index + 1} {
+		if n < 0 || n >= segCount {
+			continue
+		}
+		left := index
+		if n < index {
+			left = n
+		}
+		if canRebalance(left, left+1) {
+			res.add(id, "size %d is below min threshold %d and can be rebalanced with its sibling at %d", size, minThreshold, n)
+			return
+		}
+	}
+}
+
+// Check verifies the structural invariants of the array and returns every violation found,
+// an empty result means the array is consistent
+func (a *Array) Check() []Violation {
+	res := make(violations, 0)
+	mseg, err := a.metaSegment()
+	if err != nil {
+		res.add(a.metaSegmentID, "array meta segment can't be read: %v", err)
+		return res
+	}
+	if len(mseg.sortedSegHeaders) == 0 {
+		res.add(mseg.id, "meta segment has no segment headers")
+	}
+
+	sizeSum := uint32(0)
+	var prevLast uint32
+	hasPrev := false
+	for i, segH := range mseg.sortedSegHeaders {
+		sizeSum += segH.size
+		seg, err := a.segment(segH.segID)
+		if err != nil {
+			res.add(segH.segID, "header %d points to an array segment that can't be read: %v", i, err)
+			continue
+		}
+		if seg.id != segH.segID {
+			res.add(segH.segID, "segment reports id %d", seg.id)
+		}
+		if segH.startIndex != seg.StartIndex() {
+			res.add(seg.id, "header start index %d doesn't match segment start index %d", segH.startIndex, seg.StartIndex())
+		}
+		if segH.size != seg.totalSize {
+			res.add(seg.id, "header size %d doesn't match segment size %d", segH.size, seg.totalSize)
+		}
+		if int(segH.count) != len(seg.elements) {
+			res.add(seg.id, "header count %d doesn't match %d elements", segH.count, len(seg.elements))
+		}
+		if len(seg.elements) == 0 && len(mseg.sortedSegHeaders) > 1 {
+			res.add(seg.id, "empty segment")
+		}
+		checkThresholds(&res, seg.id, seg.totalSize, i, func(left, right int) bool {
+			l, lerr := a.segment(mseg.sortedSegHeaders[left].segID)
+			r, rerr := a.segment(mseg.sortedSegHeaders[right].segID)
+			return lerr == nil && rerr == nil && l.canRebalance(r)
+		}, len(mseg.sortedSegHeaders))
+
+		itemSizes := uint32(0)
+		for j, e := range seg.elements {
+			itemSizes += e.Size()
+			if e.Size() > maxItemSize {
+				res.add(seg.id, "item at index %d has size %d above max item size %d", e.Index(), e.Size(), maxItemSize)
+			}
+			if hasPrev && e.Index() <= prevLast {
+				if j == 0 {
+					res.add(seg.id, "index %d overlaps with the previous segment ending at %d", e.Index(), prevLast)
+				} else {
+					res.add(seg.id, "index %d is not after index %d", e.Index(), prevLast)
+				}
+			}
+			prevLast = e.Index()
+			hasPrev = true
+		}
+		if itemSizes != seg.totalSize {
+			res.add(seg.id, "segment size %d doesn't match the sum of item sizes %d", seg.totalSize, itemSizes)
+		}
+	}
+	if sizeSum != mseg.size {
+		res.add(mseg.id, "meta size %d doesn't match the sum of header sizes %d", mseg.size, sizeSum)
+	}
+	return res
+}
+
+// Check verifies the structural invariants of the map and returns every violation found,
+// an empty result means the map is consistent
+func (a *Map) Check() []Violation {
+	res := make(violations, 0)
+	mseg, err := a.metaSegment()
+	if err != nil {
+		res.add(a.metaSegmentID, "map meta segment can't be read: %v", err)
+		return res
+	}
+	if len(mseg.sortedSegHeaders) == 0 {
+		res.add(mseg.id, "meta segment has no segment headers")
+	}
+
+	sizeSum := uint32(0)
+	var prevLast string
+	hasPrev := false
+	for i, segH := range mseg.sortedSegHeaders {
+		sizeSum += segH.size
+		seg, err := a.segment(segH.segID)
+		if err != nil {
+			res.add(segH.segID, "header %d points to a map segment that can't be read: %v", i, err)
+			continue
+		}
+		if seg.id != segH.segID {
+			res.add(segH.segID, "segment reports id %d", seg.id)
+		}
+		if segH.firstKey != seg.HeaderKey() {
+			res.add(seg.id, "header first key %q doesn't match segment header key %q", segH.firstKey, seg.HeaderKey())
+		}
+		if seg.lowerBound != "" && len(seg.keys) > 0 && seg.lowerBound > seg.FirstKey() {
+			res.add(seg.id, "lower bound %q is above first key %q", seg.lowerBound, seg.FirstKey())
+		}
+		if seg.lowerBound != "" && hasPrev && seg.lowerBound <= prevLast {
+			res.add(seg.id, "lower bound %q is not after the previous segment ending at %q", seg.lowerBound, prevLast)
+		}
+		if segH.size != seg.totalSize {
+			res.add(seg.id, "header size %d doesn't match segment size %d", segH.size, seg.totalSize)
+		}
+		if int(segH.count) != len(seg.keys) {
+			res.add(seg.id, "header count %d doesn't match %d keys", segH.count, len(seg.keys))
+		}
+		if len(seg.keys) == 0 && len(mseg.sortedSegHeaders) > 1 {
+			res.add(seg.id, "empty segment")
+		}
+		checkThresholds(&res, seg.id, seg.totalSize, i, func(left, right int) bool {
+			l, lerr := a.segment(mseg.sortedSegHeaders[left].segID)
+			r, rerr := a.segment(mseg.sortedSegHeaders[right].segID)
+			return lerr == nil && rerr == nil && l.canRebalance(r)
+		}, len(mseg.sortedSegHeaders))
+
+		if len(seg.keys) != len(seg.lookup) {
+			res.add(seg.id, "%d keys but %d lookup entries", len(seg.keys), len(seg.lookup))
+		}
+		fullSizes := make([]uint32, len(seg.keys))
+		for j, k := range seg.keys {
+			item, found := seg.lookup[k]
+			if !found {
+				res.add(seg.id, "key %q is missing from lookup", k)
+			} else {
+				fullSizes[j] = item.Size()
+				if item.Key() != k {
+					res.add(seg.id, "lookup entry for key %q holds item with key %q", k, item.Key())
+				}
+				if item.Size() > maxItemSize {
+					res.add(seg.id, "item %q has size %d above max item size %d", k, item.Size(), maxItemSize)
+				}
+			}
+			if hasPrev && k <= prevLast {
+				if j == 0 {
+					res.add(seg.id, "key %q overlaps with the previous segment ending at %q", k, prevLast)
+				} else {
+					res.add(seg.id, "key %q is not after key %q", k, prevLast)
+				}
+			}
+			prevLast = k
+			hasPrev = true
+		}
+		if itemSizes := prefixSize(frontCodedSizes(seg.keys, fullSizes), len(seg.keys)); itemSizes != seg.totalSize {
+			res.add(seg.id, "segment size %d doesn't match the sum of front coded item sizes %d", seg.totalSize, itemSizes)
+		}
+	}
+	if sizeSum != mseg.size {
+		res.add(mseg.id, "meta size %d doesn't match the sum of header sizes %d", mseg.size, sizeSum)
+	}
+	return res
+}
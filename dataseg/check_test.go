@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// splitArray returns an array of ByteArrayItems that was split into two segments
+func splitArray(t *testing.T) *Array {
+	t.Helper()
+	aa := NewArray(NewBasicSegmentProvider())
+	for i := 0; i < 5; i++ {
+		aa.Insert(ByteArrayItem{uint32(i), byte(i)})
+	}
+	if n := len(aa.ArrayMetaSegment().sortedSegHeaders); n != 2 {
+		t.Fatalf("expected 2 segments got %d", n)
+	}
+	return aa
+}
+
+func TestCheckReportsMergeableSegmentBelowMin(t *testing.T) {
+	aa := splitArray(t)
+	mseg := aa.ArrayMetaSegment()
+	// shrink the right segment without rebalancing
+	seg := aa.sp.GetSegment(mseg.sortedSegHeaders[1].segID).(*ArraySegment)
+	seg.RemoveItem(seg.LastIndex())
+	mseg.sortedSegHeaders[1] = seg.Header()
+	mseg.size -= 5
+
+	v := aa.Check()
+	if len(v) != 1 || !strings.Contains(v[0].Message, "below min threshold") {
+		t.Fatalf("expected a min threshold violation got %v", v)
+	}
+}
+
+func TestRemoveRebalances(t *testing.T) {
+	aa := splitArray(t)
+	aa.Remove(4)
+	if v := aa.Check(); len(v) > 0 {
+		t.Fatalf("array is not consistent: %v", v)
+	}
+	if n := len(aa.ArrayMetaSegment().sortedSegHeaders); n != 1 {
+		t.Fatalf("expected the segments to be merged got %d segments", n)
+	}
+}
+
+func TestCheckAcceptsUnfixableSegmentBelowMin(t *testing.T) {
+	aa := NewArray(NewBasicSegmentProvider())
+	// 6, 6, 4 and 5 bytes can only be split 12/9 or 6/15
+	for i, v := range []string{"AB", "AB", "", "A"} {
+		aa.Insert(BytesArrayItem{uint32(i), []byte(v)})
+	}
+	if v := aa.Check(); len(v) > 0 {
+		t.Fatalf("array is not consistent: %v", v)
+	}
+	sizes := make([]uint32, 0)
+	for _, h := range aa.ArrayMetaSegment().sortedSegHeaders {
+		sizes = append(sizes, h.size)
+	}
+	if len(sizes) != 2 || sizes[0] != 12 || sizes[1] != 9 {
+		t.Fatalf("expected segments of 12 and 9 bytes got %v", sizes)
+	}
+}
+
+// splitMap returns a map of StringMapItems spread over several segments
+func splitMap(t *testing.T) *Map {
+	t.Helper()
+	mm := NewMap(NewBasicSegmentProvider())
+	for i := 0; i < 30; i++ {
+		if err := mm.Insert(StringMapItem{string([]byte{'0' + byte(i/10), '0' + byte(i%10)}), "v"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(mm.MapMetaSegment().sortedSegHeaders); n < 3 {
+		t.Fatalf("expected at least 3 segments got %d", n)
+	}
+	return mm
+}
+
+func expectViolation(t *testing.T, v []Violation, id SegmentID, message string) {
+	t.Helper()
+	for _, violation := range v {
+		if violation.SegmentID == id && strings.Contains(violation.Message, message) {
+			return
+		}
+	}
+	t.Fatalf("expected %q on segment %d got %v", message, id, v)
+}
+
+func TestCheckAcceptsConsistentMap(t *testing.T) {
+	if v := splitMap(t).Check(); len(v) > 0 {
+		t.Fatalf("map is not consistent: %v", v)
+	}
+}
+
+func TestCheckReportsMapHeaderMismatch(t *testing.T) {
+	mm := splitMap(t)
+	mseg := mm.MapMetaSegment()
+	mseg.sortedSegHeaders[1].size++
+	mseg.sortedSegHeaders[2].firstKey = "zz"
+	v := mm.Check()
+	expectViolation(t, v, mseg.sortedSegHeaders[1].segID, "header size")
+	expectViolation(t, v, mseg.sortedSegHeaders[2].segID, "header first key")
+	expectViolation(t, v, mseg.id, "meta size")
+}
+
+func TestCheckReportsMissingSegment(t *testing.T) {
+	aa := splitArray(t)
+	lost := aa.ArrayMetaSegment().sortedSegHeaders[0].segID
+	aa.sp.RemoveSegment(aa.sp.GetSegment(lost))
+	expectViolation(t, aa.Check(), lost, "points to a")
+
+	mm := splitMap(t)
+	lost = mm.MapMetaSegment().sortedSegHeaders[1].segID
+	mm.sp.RemoveSegment(mm.sp.GetSegment(lost))
+	expectViolation(t, mm.Check(), lost, "points to a")
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+const cliUsage = `usage: data-seg <command> [arguments]
+
+A store is a directory holding one file per segment, collections are addressed by the id of
+their meta segment. Array items are addressed by index.
+
+commands:
+  create  <store> map|array              create an empty collection and print its meta segment id
+  inspect <store> <metaID> [--format f]  print the segments of a collection with their sizes and fill,
+                                         f is text (default), json or dot
+  get     <store> <metaID> <key>         print the value stored under a key
+  put     <store> <metaID> <key> <value> store a value under a key
+  del     <store> <metaID> <key>         remove a key
+  scan    <store> <metaID> [--prefix p]  print the items of a map in key order
+  dump    <store> <metaID>               write a collection as JSON Lines to stdout
+  load    <store> [file]                 import a JSON Lines dump (stdin without file), print the new meta segment id
+  check   <store> <metaID>               verify the structure of a collection
+  stats   <store> <metaID>               print element and segment statistics as JSON
+  gc      <store> [--dry-run] <metaID>.. remove the segments not reachable from the given collections
+  example <name>                         run one of the examples: %s
+`
+
+// cli runs a single command, output goes to out and dumps are read from in
+type cli struct {
+	in  io.Reader
+	out io.Writer
+	sp  *FileSegmentProvider
+}
+
+type cliCommand struct {
+	minArgs int // including the store
+	run     func(c *cli, args []string) error
+}
+
+var cliCommands = map[string]cliCommand{
+	"create":  {2, (*cli).create},
+	"inspect": {2, (*cli).inspect},
+	"get":     {3, (*cli).get},
+	"put":     {4, (*cli).put},
+	"del":     {3, (*cli).del},
+	"scan":    {2, (*cli).scan},
+	"dump":    {2, (*cli).dump},
+	"load":    {1, (*cli).load},
+	"check":   {2, (*cli).check},
+	"stats":   {2, (*cli).stats},
+	"gc":      {2, (*cli).gc},
+}
+
+func usageError() error {
+	names := make([]string, 0, len(examples))
+	for name := range examples {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf(cliUsage, strings.Join(names, ", "))
+}
+
+// runCLI executes the command in args (without the program name)
+func runCLI(args []string, in io.Reader, out io.Writer) error {
+	if len(args) == 0 {
+		return usageError()
+	}
+	if args[0] == "example" {
+		if len(args) != 2 || examples[args[1]] == nil {
+			return usageError()
+		}
+		examples[args[1]]()
+		return nil
+	}
+	cmd, ok := cliCommands[args[0]]
+	if !ok || len(args)-1 < cmd.minArgs {
+		return usageError()
+	}
+	sp, err := OpenFileSegmentProvider(args[1])
+	if err != nil {
+		return err
+	}
+	c := &cli{in: in, out: out, sp: sp}
+	err = cmd.run(c, args[1:])
+	// failed reads and writes of the store are reported even if the command failed for another reason
+	if storeErr := sp.Err(); storeErr != nil {
+		if err == nil {
+			return storeErr
+		}
+		return fmt.Errorf("%w (store: %v)", err, storeErr)
+	}
+	return err
+}
+
+func parseSegmentID(s string) (SegmentID, error) {
+	id, err := strconv.ParseUint(s, 10, 63)
+	if err != nil {
+		return 0, fmt.Errorf("invalid segment id %q", s)
+	}
+	return SegmentID(id), nil
+}
+
+func parseIndex(s string) (uint32, error) {
+	index, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid array index %q", s)
+	}
+	return uint32(index), nil
+}
+
+// open returns the map or the array with the given meta segment id, exactly one of them is set
+func (c *cli) open(arg string) (*Map, *Array, error) {
+	id, err := parseSegmentID(arg)
+	if err != nil {
+		return nil, nil, err
+	}
+	seg, err := loadSegment(c.sp, id)
+	if errors.Is(err, ErrSegmentNotFound) {
+		return nil, nil, fmt.Errorf("collection %d not found", id)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	switch seg.(type) {
+	case *MapMetaSegment:
+		return FetchMap(id, c.sp), nil, nil
+	case *ArrayMetaSegment:
+		return nil, FetchArray(id, c.sp), nil
+	}
+	return nil, nil, fmt.Errorf("segment %d is not the meta segment of a collection", id)
+}
+
+// printValue writes a value followed by a newline, child collections are printed as their kind and meta segment id
+func (c *cli) printValue(item interface{ Encoded() []byte }) {
+	if ref, ok := item.(collectionRef); ok {
+		fmt.Fprintf(c.out, "<%s %d>\n", collectionName(ref.CollectionKind()), ref.ChildMetaSegmentID())
+		return
+	}
+	c.out.Write(item.Encoded())
+	fmt.Fprintln(c.out)
+}
+
+func (c *cli) create(args []string) error {
+	switch args[1] {
+	case "map":
+		fmt.Fprintln(c.out, NewMap(c.sp).metaSegmentID)
+	case "array":
+		fmt.Fprintln(c.out, NewArray(c.sp).metaSegmentID)
+	default:
+		return fmt.Errorf("unknown collection type %q, expected map or array", args[1])
+	}
+	return nil
+}
+
+func (c *cli) inspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	format := fs.String("format", "text", "text, json or dot")
+	if err := fs.Parse(args[2:]); err != nil {
+		return err
+	}
+	m, a, err := c.open(args[1])
+	if err != nil {
+		return err
+	}
+	var layout CollectionLayout
+	if m != nil {
+		layout, err = m.Layout(), m.Err()
+	} else {
+		layout, err = a.Layout(), a.Err()
+	}
+	if err != nil {
+		return err
+	}
+	switch *format {
+	case "json":
+		return layout.WriteJSON(c.out)
+	case "dot":
+		return layout.WriteDOT(c.out)
+	case "text":
+	default:
+		return fmt.Errorf("unknown format %q, expected text, json or dot", *format)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "%s %d: %d segments, %d bytes, thresholds %d..%d\n", layout.Type, layout.MetaSegmentID, len(layout.Segments), layout.Size, minThreshold, maxThreshold)
+	fmt.Fprintln(w, "segment\tboundary\titems\tsize\tfill")
+	for _, sl := range layout.Segments {
+		items := strconv.Itoa(sl.Items)
+		if sl.Missing {
+			items = "missing"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%.0f%%\n", sl.ID, sl.boundary(), items, sl.Size, sl.Fill*100)
+	}
+	return w.Flush()
+}
+
+func (c *cli) get(args []string) error {
+	m, a, err := c.open(args[1])
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		item, found := m.Get(args[2])
+		if err := m.Err(); err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("key %q not found", args[2])
+		}
+		c.printValue(item)
+		return nil
+	}
+	index, err := parseIndex(args[2])
+	if err != nil {
+		return err
+	}
+	item, found := a.Get(index)
+	if err := a.Err(); err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("index %d not found", index)
+	}
+	c.printValue(item)
+	return nil
+}
+
+func (c *cli) put(args []string) error {
+	m, a, err := c.open(args[1])
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		if err := m.Insert(BytesMapItem{args[2], []byte(args[3])}); err != nil {
+			return err
+		}
+		return m.Err()
+	}
+	index, err := parseIndex(args[2])
+	if err != nil {
+		return err
+	}
+	if err := a.Insert(BytesArrayItem{index, []byte(args[3])}); err != nil {
+		return err
+	}
+	return a.Err()
+}
+
+func (c *cli) del(args []string) error {
+	m, a, err := c.open(args[1])
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		_, found := m.Get(args[2])
+		if err := m.Err(); err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("key %q not found", args[2])
+		}
+		if err := m.Remove(args[2]); err != nil {
+			return err
+		}
+		return m.Err()
+	}
+	index, err := parseIndex(args[2])
+	if err != nil {
+		return err
+	}
+	_, found := a.Get(index)
+	if err := a.Err(); err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("index %d not found", index)
+	}
+	if err := a.Remove(index); err != nil {
+		return err
+	}
+	return a.Err()
+}
+
+func (c *cli) scan(args []string) error {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	prefix := fs.String("prefix", "", "only print keys starting with prefix")
+	if err := fs.Parse(args[2:]); err != nil {
+		return err
+	}
+	m, _, err := c.open(args[1])
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return fmt.Errorf("scan needs a map")
+	}
+	m.ScanPrefix(*prefix, func(item MapItem) bool {
+		fmt.Fprintf(c.out, "%s\t", item.Key())
+		c.printValue(item)
+		return true
+	})
+	return m.Err()
+}
+
+func (c *cli) dump(args []string) error {
+	m, a, err := c.open(args[1])
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		return m.ExportJSONL(c.out)
+	}
+	return a.ExportJSONL(c.out)
+}
+
+func (c *cli) load(args []string) error {
+	in := c.in
+	if len(args) > 1 {
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	// the header tells which collection to create
+	var header jsonlHeader
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&header); err != nil {
+		return fmt.Errorf("header: %w", err)
+	}
+	switch header.Type {
+	case "map":
+		m, err := ImportMapJSONL(c.sp, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.out, m.metaSegmentID)
+	case "array":
+		a, err := ImportArrayJSONL(c.sp, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.out, a.metaSegmentID)
+	default:
+		return fmt.Errorf("unknown collection type %q", header.Type)
+	}
+	return nil
+}
+
+func (c *cli) check(args []string) error {
+	m, a, err := c.open(args[1])
+	if err != nil {
+		return err
+	}
+	var res []Violation
+	if m != nil {
+		res = m.Check()
+	} else {
+		res = a.Check()
+	}
+	for _, v := range res {
+		fmt.Fprintln(c.out, v)
+	}
+	if len(res) > 0 {
+		return fmt.Errorf("%d violations found", len(res))
+	}
+	fmt.Fprintln(c.out, "ok")
+	return nil
+}
+
+func (c *cli) stats(args []string) error {
+	m, a, err := c.open(args[1])
+	if err != nil {
+		return err
+	}
+	var stats CollectionStats
+	if m != nil {
+		stats, err = m.Stats(), m.Err()
+	} else {
+		stats, err = a.Stats(), a.Err()
+	}
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(c.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(stats)
+}
+
+func (c *cli) gc(args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	dryRun := fs.Bool("dry-run", false, "only report what would be removed")
+	// flag stops at the first id, the flags after it are parsed by the next round
+	roots := make([]SegmentID, 0)
+	for rest := args[1:]; ; rest = fs.Args()[1:] {
+		if err := fs.Parse(rest); err != nil {
+			return err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		id, err := parseSegmentID(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		roots = append(roots, id)
+	}
+	if len(roots) == 0 {
+		return usageError()
+	}
+	report, err := CollectGarbage(c.sp, roots, *dryRun)
+	if err != nil {
+		return err
+	}
+	verb := "removed"
+	if report.DryRun {
+		verb = "would remove"
+	}
+	fmt.Fprintf(c.out, "%d reachable, %s %d: %v\n", report.Reachable, verb, len(report.Removed), report.Removed)
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// runCLITest runs a command against the store and returns its output
+func runCLITest(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	var out bytes.Buffer
+	err := runCLI(args, strings.NewReader(""), &out)
+	return out.String(), err
+}
+
+// corruptMapStore returns a store holding a map with a few keys whose only data segment has a flipped byte
+func corruptMapStore(t *testing.T) (dir string, metaID string) {
+	t.Helper()
+	dir = t.TempDir()
+	out, err := runCLITest(t, "create", dir, "map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metaID = strings.TrimSpace(out)
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := runCLITest(t, "put", dir, metaID, key, "v"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sp, err := OpenFileSegmentProvider(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mseg := sp.GetSegment(SegmentID(mustParseUint(t, metaID))).(*MapMetaSegment)
+	path := sp.path(mseg.sortedSegHeaders[0].segID)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, metaID
+}
+
+func mustParseUint(t *testing.T, s string) uint64 {
+	t.Helper()
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestCLIReportsCorruptSegment(t *testing.T) {
+	dir, metaID := corruptMapStore(t)
+	for _, args := range [][]string{
+		{"get", dir, metaID, "b"},
+		{"del", dir, metaID, "b"},
+		{"scan", dir, metaID},
+		{"inspect", dir, metaID},
+		{"gc", dir, metaID},
+	} {
+		if _, err := runCLITest(t, args...); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+			t.Errorf("%s: expected a checksum mismatch got %v", args[0], err)
+		}
+	}
+
+	out, err := runCLITest(t, "check", dir, metaID)
+	if err == nil {
+		t.Fatal("expected check to fail")
+	}
+	if !strings.Contains(out, "checksum mismatch") {
+		t.Fatalf("expected check to report the checksum mismatch got %q", out)
+	}
+}
+
+func TestCLIGCFlagsAfterIDs(t *testing.T) {
+	dir := t.TempDir()
+	create := func() string {
+		out, err := runCLITest(t, "create", dir, "map")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(out)
+	}
+	kept, dropped := create(), create()
+	for _, args := range [][]string{
+		{"gc", dir, kept, "--dry-run"},
+		{"gc", dir, "--dry-run", kept},
+	} {
+		out, err := runCLITest(t, args...)
+		if err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		if !strings.Contains(out, "would remove 2") {
+			t.Fatalf("%v: expected a dry run removing the segments of the other map got %q", args, out)
+		}
+	}
+	if _, err := runCLITest(t, "get", dir, dropped, "a"); err == nil || !strings.Contains(err.Error(), `key "a" not found`) {
+		t.Fatalf("expected the dry runs to keep the other map got %v", err)
+	}
+	if _, err := runCLITest(t, "gc", dir, kept, "--no-such-flag"); err == nil {
+		t.Fatal("expected an error for an unknown flag after the ids")
+	}
+}
+
+func TestCLIMissingCollection(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := runCLITest(t, "get", dir, "12345", "a"); err == nil || !strings.Contains(err.Error(), "collection 12345 not found") {
+		t.Fatalf("expected collection not found got %v", err)
+	}
+}
+
+func TestMissingSegmentDoesNotPanic(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	m := NewMap(sp)
+	aa := NewArray(sp)
+	d := NewDeque(sp)
+	for i := 0; i < 3; i++ {
+		m.Insert(BytesMapItem{strconv.Itoa(i), []byte{byte(i)}})
+		aa.Insert(ByteArrayItem{uint32(i), byte(i)})
+		d.PushBack([]byte{byte(i)})
+	}
+	sp.RemoveSegment(sp.GetSegment(m.MapMetaSegment().sortedSegHeaders[0].segID))
+	sp.RemoveSegment(sp.GetSegment(aa.ArrayMetaSegment().sortedSegHeaders[0].segID))
+	sp.RemoveSegment(sp.GetSegment(d.array.ArrayMetaSegment().sortedSegHeaders[0].segID))
+
+	if _, found := m.Get("1"); found {
+		t.Fatal("expected no item from a missing segment")
+	}
+	if err := m.Err(); err == nil {
+		t.Fatal("expected Map.Get to record the missing segment")
+	}
+	if err := m.Insert(BytesMapItem{"4", []byte{4}}); err == nil {
+		t.Fatal("expected Map.Insert to fail on a missing segment")
+	}
+	it := m.Iterator()
+	for it.Next() {
+	}
+	if it.Err() == nil {
+		t.Fatal("expected the iterator to report the missing segment")
+	}
+
+	if _, found := aa.Get(1); found {
+		t.Fatal("expected no item from a missing segment")
+	}
+	if err := aa.Err(); err == nil {
+		t.Fatal("expected Array.Get to record the missing segment")
+	}
+	if err := aa.Remove(1); err == nil {
+		t.Fatal("expected Array.Remove to fail on a missing segment")
+	}
+
+	if _, _, err := d.PopFront(); err == nil {
+		t.Fatal("expected Deque.PopFront to fail on a missing segment")
+	}
+}
+
+func TestTypedMapReportsMissingSegment(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	m := NewTypedMap[string, string](sp, StringKeyCodec{}, StringCodec{})
+	if err := m.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	sp.RemoveSegment(sp.GetSegment(m.Map().MapMetaSegment().sortedSegHeaders[0].segID))
+	if _, found, err := m.Get("a"); found || err == nil {
+		t.Fatalf("expected Get to fail got found %v err %v", found, err)
+	}
+	if err := m.Range("", "z", func(string, string) bool { return true }); err == nil {
+		t.Fatal("expected Range to fail")
+	}
+}
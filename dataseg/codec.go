@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Codec converts values of type T to bytes and back
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(b []byte) (T, error)
+}
+
+// KeyCodec converts map keys of type K to string keys and back, the encoding
+// has to preserve the order of K since map segments are sorted by the encoded key
+type KeyCodec[K any] interface {
+	EncodeKey(k K) string
+	DecodeKey(s string) (K, error)
+}
+
+// BytesCodec stores byte slices as they are
+type BytesCodec struct{}
+
+func (BytesCodec) Encode(v []byte) ([]byte, error) { return v, nil }
+func (BytesCodec) Decode(b []byte) ([]byte, error) { return append([]byte{}, b...), nil }
+
+// StringCodec stores strings as their bytes
+type StringCodec struct{}
+
+func (StringCodec) Encode(v string) ([]byte, error) { return []byte(v), nil }
+func (StringCodec) Decode(b []byte) (string, error) { return string(b), nil }
+
+// StringKeyCodec uses strings as map keys as they are
+type StringKeyCodec struct{}
+
+func (StringKeyCodec) EncodeKey(k string) string          { return k }
+func (StringKeyCodec) DecodeKey(s string) (string, error) { return s, nil }
+
+// VarintCodec stores signed integers as zig-zag varints so small values stay small
+type VarintCodec struct{}
+
+func (VarintCodec) Encode(v int64) ([]byte, error) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(buf, v)
+	return buf[:n], nil
+}
+
+func (VarintCodec) Decode(b []byte) (int64, error) {
+	v, n := binary.Varint(b)
+	if n <= 0 || n != len(b) {
+		return 0, fmt.Errorf("invalid varint %x", b)
+	}
+	return v, nil
+}
+
+// JSONCodec stores any json serializable value (e.g. structs) as json
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Decode(b []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(b, &v)
+	return v, err
+}
+
+// ErrItemTooLarge is returned when an encoded item doesn't fit into maxItemSize
+var ErrItemTooLarge = errors.New("item is larger than max item size")
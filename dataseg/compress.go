@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// CompressionAlgorithm is recorded in front of every compressed segment, so each segment can use a different one.
+// Neither algorithm is snappy or zstd: the fast one is a small LZ77 written here and the dense one is DEFLATE
+// from the standard library, neither format can be read by snappy or zstd tools.
+type CompressionAlgorithm byte
+
+const (
+	CompressionNone CompressionAlgorithm = 0
+	// CompressionLZ is a hand written byte oriented LZ77 (see lzCompress), fast and without entropy coding
+	CompressionLZ CompressionAlgorithm = 1
+	// CompressionFlate is DEFLATE from compress/flate, LZ77 followed by huffman coding, slower but smaller
+	CompressionFlate CompressionAlgorithm = 2
+)
+
+func (c CompressionAlgorithm) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionLZ:
+		return "lz"
+	case CompressionFlate:
+		return "flate"
+	}
+	return fmt.Sprintf("compression(%d)", byte(c))
+}
+
+// CompressingSegmentProvider compresses the encoding of every segment before storing it as an
+// EnvelopeSegment in the wrapped provider. Segments smaller than minSize, and the ones that don't
+// shrink, are stored with CompressionNone. Segments stored without envelope are returned as they are.
+type CompressingSegmentProvider struct {
+	sp        SegmentProvider
+	algorithm CompressionAlgorithm
+	minSize   int
+	err       error
+}
+
+func NewCompressingSegmentProvider(sp SegmentProvider, algorithm CompressionAlgorithm, minSize int) *CompressingSegmentProvider {
+	return &CompressingSegmentProvider{sp: sp, algorithm: algorithm, minSize: minSize}
+}
+
+// GetSegment returns nil if the segment doesn't exist or can't be decompressed
+func (p *CompressingSegmentProvider) GetSegment(id SegmentID) Segment {
+	seg := p.sp.GetSegment(id)
+	env, ok := seg.(*EnvelopeSegment)
+	if !ok {
+		return seg
+	}
+	raw, err := decompressPayload(env.payload)
+	if err == nil {
+		seg, err = DecodeSegment(id, raw)
+	}
+	if err != nil {
+		if p.err == nil {
+			p.err = fmt.Errorf("segment %d: %w", id, err)
+		}
+		return nil
+	}
+	return seg
+}
+
+func (p *CompressingSegmentProvider) AddSegment(seg Segment) {
+	p.sp.AddSegment(p.envelope(seg))
+}
+
+// WriteBatch compresses the added segments and hands the batch over to the wrapped provider,
+// so a provider that can reject writes (e.g. because of a quota) still sees the whole operation
+func (p *CompressingSegmentProvider) WriteBatch(adds []Segment, removes []Segment) error {
+	envelopes := make([]Segment, len(adds))
+	for i, seg := range adds {
+		envelopes[i] = p.envelope(seg)
+	}
+	return writeBatch(p.sp, envelopes, removes)
+}
+
+// envelope returns the segment as it is stored in the wrapped provider
+func (p *CompressingSegmentProvider) envelope(seg Segment) Segment {
+	raw := seg.Encoded()
+	algorithm := p.algorithm
+	data := raw
+	if len(raw) < p.minSize {
+		algorithm = CompressionNone
+	}
+	if algorithm != CompressionNone {
+		data = compress(algorithm, raw)
+		if len(data) >= len(raw) {
+			algorithm, data = CompressionNone, raw
+		}
+	}
+	payload := []byte{byte(algorithm)}
+	payload = appendUvarint(payload, uint64(len(raw)))
+	payload = append(payload, data...)
+	return &EnvelopeSegment{id: seg.ID(), payload: payload}
+}
+
+func (p *CompressingSegmentProvider) RemoveSegment(seg Segment) {
+	p.sp.RemoveSegment(seg)
+}
+
+// SegmentIDs lists the segments of the wrapped provider, it returns nil if the provider can't list
+func (p *CompressingSegmentProvider) SegmentIDs() []SegmentID {
+	if lister, ok := p.sp.(SegmentLister); ok {
+		return lister.SegmentIDs()
+	}
+	return nil
+}
+
+// Err returns the first failed decompression since the last call, or else the error of the wrapped
+// provider, and clears both
+func (p *CompressingSegmentProvider) Err() error {
+	err := p.err
+	p.err = nil
+	if r, ok := p.sp.(errorReporter); ok {
+		if inner := r.Err(); err == nil {
+			err = inner
+		}
+	}
+	return err
+}
+
+// Algorithm returns the algorithm used to store a segment
+func (p *CompressingSegmentProvider) Algorithm(id SegmentID) (CompressionAlgorithm, bool) {
+	env, ok := p.sp.GetSegment(id).(*EnvelopeSegment)
+	if !ok || len(env.payload) == 0 {
+		return CompressionNone, false
+	}
+	return CompressionAlgorithm(env.payload[0]), true
+}
+
+func compress(algorithm CompressionAlgorithm, raw []byte) []byte {
+	switch algorithm {
+	case CompressionLZ:
+		return lzCompress(raw)
+	case CompressionFlate:
+		var buf bytes.Buffer
+		w, _ := flate.NewWriter(&buf, flate.BestCompression)
+		w.Write(raw)
+		w.Close()
+		return buf.Bytes()
+	}
+	return raw
+}
+
+// decompressPayload reads the algorithm and original length written by AddSegment and decompresses the rest
+func decompressPayload(payload []byte) ([]byte, error) {
+	if len(payload) < 2 {
+		return nil, fmt.Errorf("compressed payload too short")
+	}
+	algorithm := CompressionAlgorithm(payload[0])
+	rawLen, n := binary.Uvarint(payload[1:])
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid original length")
+	}
+	data := payload[1+n:]
+	var raw []byte
+	var err error
+	switch algorithm {
+	case CompressionNone:
+		raw = data
+	case CompressionLZ:
+		raw, err = lzDecompress(data, int(rawLen))
+	case CompressionFlate:
+		// read one byte more than expected so a longer stream is detected
+		raw, err = io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(data)), int64(rawLen)+1))
+	default:
+		return nil, fmt.Errorf("unknown compression %d", algorithm)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", algorithm, err)
+	}
+	if uint64(len(raw)) != rawLen {
+		return nil, fmt.Errorf("%v: expected %d bytes got %d", algorithm, rawLen, len(raw))
+	}
+	return raw, nil
+}
+
+const (
+	lzMinMatch  = 4
+	lzHashBits  = 14
+	lzMaxOffset = 1 << 16
+)
+
+// lzCompress writes a sequence of literal runs and copies, each starts with a uvarint holding
+// the length shifted left by one with the low bit set for copies. Literal runs are followed by
+// the bytes and copies by the uvarint offset back from the current output position.
+func lzCompress(src []byte) []byte {
+	dst := make([]byte, 0, len(src)/2)
+	var table [1 << lzHashBits]int32
+	for i := range table {
+		table[i] = -1
+	}
+	hash := func(i int) uint32 {
+		return (binary.LittleEndian.Uint32(src[i:]) * 0x1e35a7bd) >> (32 - lzHashBits)
+	}
+	literalStart := 0
+	flushLiterals := func(end int) {
+		if end > literalStart {
+			dst = appendUvarint(dst, uint64(end-literalStart)<<1)
+			dst = append(dst, src[literalStart:end]...)
+		}
+	}
+	i := 0
+	for i+lzMinMatch <= len(src) {
+		h := hash(i)
+		candidate := int(table[h])
+		table[h] = int32(i)
+		if candidate < 0 || i-candidate > lzMaxOffset || !bytes.Equal(src[candidate:candidate+lzMinMatch], src[i:i+lzMinMatch]) {
+			i++
+			continue
+		}
+		length := lzMinMatch
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		flushLiterals(i)
+		dst = appendUvarint(dst, uint64(length)<<1|1)
+		dst = appendUvarint(dst, uint64(i-candidate))
+		i += length
+		literalStart = i
+	}
+	flushLiterals(len(src))
+	return dst
+}
+
+// lzDecompress reverses lzCompress, rawLen bounds the output so corrupt input can't blow it up
+func lzDecompress(src []byte, rawLen int) ([]byte, error) {
+	dst := make([]byte, 0, rawLen)
+	for len(src) > 0 {
+		v, n := binary.Uvarint(src)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid tag")
+		}
+		src = src[n:]
+		length := int(v >> 1)
+		if length <= 0 || length > rawLen-len(dst) {
+			return nil, fmt.Errorf("invalid length %d", length)
+		}
+		if v&1 == 0 {
+			if length > len(src) {
+				return nil, fmt.Errorf("literal run past the end")
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		}
+		offset, n := binary.Uvarint(src)
+		if n <= 0 || offset == 0 || offset > uint64(len(dst)) {
+			return nil, fmt.Errorf("invalid offset")
+		}
+		src = src[n:]
+		// copies may overlap with the bytes they produce, so copy byte by byte
+		start := len(dst) - int(offset)
+		for k := 0; k < length; k++ {
+			dst = append(dst, dst[start+k])
+		}
+	}
+	return dst, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 3000)
+	rnd.Read(random)
+	inputs := map[string][]byte{
+		"empty":    {},
+		"short":    []byte("abc"),
+		"repeated": bytes.Repeat([]byte("key-0001"), 400),
+		"random":   random,
+		"mixed":    append(bytes.Repeat([]byte{0}, 100), random[:300]...),
+	}
+	for _, algorithm := range []CompressionAlgorithm{CompressionNone, CompressionLZ, CompressionFlate} {
+		for name, raw := range inputs {
+			payload := append(appendUvarint([]byte{byte(algorithm)}, uint64(len(raw))), compress(algorithm, raw)...)
+			got, err := decompressPayload(payload)
+			if err != nil {
+				t.Fatalf("%v %s: %v", algorithm, name, err)
+			}
+			if !bytes.Equal(got, raw) {
+				t.Fatalf("%v %s: round trip changed the data", algorithm, name)
+			}
+		}
+	}
+	if n := len(lzCompress(inputs["repeated"])); n > 100 {
+		t.Fatalf("repeated input compressed to %d bytes", n)
+	}
+}
+
+func TestDecompressRejectsCorruptPayload(t *testing.T) {
+	raw := bytes.Repeat([]byte("abcdefgh"), 50)
+	for _, algorithm := range []CompressionAlgorithm{CompressionLZ, CompressionFlate} {
+		data := compress(algorithm, raw)
+		if _, err := decompressPayload(append(appendUvarint([]byte{byte(algorithm)}, uint64(len(raw)+1)), data...)); err == nil {
+			t.Fatalf("%v: wrong original length was accepted", algorithm)
+		}
+		if _, err := decompressPayload(append(appendUvarint([]byte{byte(algorithm)}, uint64(len(raw))), data[:len(data)/2]...)); err == nil {
+			t.Fatalf("%v: truncated data was accepted", algorithm)
+		}
+	}
+	if _, err := decompressPayload([]byte{9, 1, 0}); err == nil {
+		t.Fatal("unknown algorithm was accepted")
+	}
+}
+
+func TestCompressingProvider(t *testing.T) {
+	for _, algorithm := range []CompressionAlgorithm{CompressionLZ, CompressionFlate} {
+		sp := NewCompressingSegmentProvider(NewBasicSegmentProvider(), algorithm, 32)
+		if err := randomMapCheck(sp, 3, randomOps); err != nil {
+			t.Fatalf("%v: %v", algorithm, err)
+		}
+		if err := sp.Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		mm := NewMap(sp)
+		mm.Insert(StringMapItem{"A", "A"})
+		if got, _ := sp.Algorithm(mm.MapMetaSegment().sortedSegHeaders[0].segID); got != CompressionNone {
+			t.Fatalf("%v: segment below the threshold stored with %v", algorithm, got)
+		}
+		for i := 0; i < 200; i++ {
+			mm.Insert(StringMapItem{string(rune('B'+i%20)) + "0000", "V"})
+		}
+		if got, _ := sp.Algorithm(mm.metaSegmentID); got != algorithm {
+			t.Fatalf("meta segment stored with %v expected %v", got, algorithm)
+		}
+	}
+}
+
+func TestCompressingProviderPassesBatchesThrough(t *testing.T) {
+	ledger := NewStorageLedger(NewBasicSegmentProvider())
+	ledger.SetQuota("bob", 150)
+	mm := NewMap(NewCompressingSegmentProvider(ledger.Owner("bob"), CompressionLZ, 32))
+	inserted, rejected := fillUntilRejected(t, mm)
+	if v := mm.Check(); len(v) > 0 {
+		t.Fatalf("map is not consistent after a rejected write: %v", v)
+	}
+	if _, found := mm.Get(rejected); found {
+		t.Fatalf("rejected key %s is readable", rejected)
+	}
+	for _, k := range inserted {
+		if _, found := mm.Get(k); !found {
+			t.Fatalf("key %s is missing", k)
+		}
+	}
+}
+
+func TestCompressingProviderReportsInnerErrors(t *testing.T) {
+	inner := NewByteSegmentProvider(false)
+	sp := NewCompressingSegmentProvider(inner, CompressionLZ, 32)
+	mm := NewMap(sp)
+	inner.segments[mm.metaSegmentID][1] ^= 1
+	if sp.GetSegment(mm.metaSegmentID) != nil {
+		t.Fatal("expected no segment for a corrupt one")
+	}
+	if err := sp.Err(); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected the checksum mismatch of the wrapped provider got %v", err)
+	}
+	if err := sp.Err(); err != nil {
+		t.Fatalf("expected the error to be cleared got %v", err)
+	}
+}
+
+func ExampleCompressingSegmentProvider() {
+	for _, algorithm := range []CompressionAlgorithm{CompressionNone, CompressionLZ, CompressionFlate} {
+		store := NewByteSegmentProvider(false)
+		sp := NewCompressingSegmentProvider(store, algorithm, 32)
+		mm := NewMap(sp)
+		for i := 0; i < 200; i++ {
+			mm.Insert(StringMapItem{fmt.Sprintf("K%03d", i), "VV"})
+		}
+		raw, stored := 0, 0
+		for _, id := range sp.SegmentIDs() {
+			raw += len(sp.GetSegment(id).Encoded())
+			stored += len(store.segments[id])
+		}
+		fmt.Println(algorithm, "smaller than raw:", stored < raw, sp.Err())
+	}
+	// Output:
+	// none smaller than raw: false <nil>
+	// lz smaller than raw: true <nil>
+	// flate smaller than raw: true <nil>
+}
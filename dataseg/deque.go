@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// dequeStartIndex is the index of the first element pushed into an empty deque,
+// it leaves room for pushing to the front
+const dequeStartIndex = uint32(1) << 31
+
+// ErrDequeFull is returned when the deque runs out of indices on one side
+var ErrDequeFull = errors.New("deque has no free index left")
+
+// Deque is a double ended queue stored as an Array of BytesArrayItem with consecutive indices.
+// Pushes and pops go through Array.Insert and Array.Remove, so they rebalance and are reported to the
+// change feed and the observer of the array like any other write.
+type Deque struct {
+	array *Array
+}
+
+func NewDeque(sp SegmentProvider) *Deque {
+	return &Deque{array: NewArray(sp)}
+}
+
+func FetchDeque(metaSegmentID SegmentID, sp SegmentProvider) *Deque {
+	return &Deque{array: FetchArray(metaSegmentID, sp)}
+}
+
+// MetaSegmentID returns the id of the meta segment, used to fetch the deque again
+func (d *Deque) MetaSegmentID() SegmentID {
+	return d.array.metaSegmentID
+}
+
+// Len returns the number of elements, indices are consecutive so only the two ends are read.
+// It returns 0 if the deque can't be read, the error is reported by Err.
+func (d *Deque) Len() int {
+	first, last, ok, err := d.ends()
+	if err != nil {
+		d.array.setErr(err)
+	}
+	if !ok {
+		return 0
+	}
+	return int(last-first) + 1
+}
+
+// Err returns the first segment read that failed since the last call and clears it
+func (d *Deque) Err() error {
+	return d.array.Err()
+}
+
+// ends returns the indices of the first and the last element, ok is false if the deque is empty
+func (d *Deque) ends() (first, last uint32, ok bool, err error) {
+	mseg, err := d.array.metaSegment()
+	if err != nil || mseg.size == 0 {
+		return 0, 0, false, err
+	}
+	last, err = d.array.lastIndex()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	return mseg.sortedSegHeaders[0].startIndex, last, true, nil
+}
+
+func (d *Deque) PushBack(v []byte) error {
+	_, last, ok, err := d.ends()
+	if err != nil {
+		return err
+	}
+	index := dequeStartIndex
+	if ok {
+		if last == ^uint32(0) {
+			return ErrDequeFull
+		}
+		index = last + 1
+	}
+	return d.push(index, v)
+}
+
+func (d *Deque) PushFront(v []byte) error {
+	first, _, ok, err := d.ends()
+	if err != nil {
+		return err
+	}
+	index := dequeStartIndex
+	if ok {
+		if first == 0 {
+			return ErrDequeFull
+		}
+		index = first - 1
+	}
+	return d.push(index, v)
+}
+
+func (d *Deque) push(index uint32, v []byte) error {
+	item := BytesArrayItem{index, v}
+	if item.Size() > maxItemSize {
+		return fmt.Errorf("deque value: %w", ErrItemTooLarge)
+	}
+	return d.array.Insert(item)
+}
+
+// PopFront removes and returns the first element, ok is false if the deque is empty
+func (d *Deque) PopFront() (v []byte, ok bool, err error) {
+	first, _, ok, err := d.ends()
+	if !ok {
+		return nil, false, err
+	}
+	return d.pop(first)
+}
+
+// PopBack removes and returns the last element, ok is false if the deque is empty
+func (d *Deque) PopBack() (v []byte, ok bool, err error) {
+	_, last, ok, err := d.ends()
+	if !ok {
+		return nil, false, err
+	}
+	return d.pop(last)
+}
+
+func (d *Deque) pop(index uint32) ([]byte, bool, error) {
+	item, found := d.array.Get(index)
+	if !found {
+		if err := d.array.Err(); err != nil {
+			return nil, false, err
+		}
+		return nil, false, fmt.Errorf("deque element %d not found", index)
+	}
+	if err := d.array.Remove(index); err != nil {
+		return nil, false, err
+	}
+	return item.Encoded(), true, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestDeque(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	d := NewDeque(sp)
+	if _, ok, err := d.PopFront(); ok || err != nil {
+		t.Fatalf("expected nothing from an empty deque got ok %v err %v", ok, err)
+	}
+	// 3 2 1 0 | 10 11 12 ..
+	for i := 0; i < 4; i++ {
+		if err := d.PushFront([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 10; i < 30; i++ {
+		if err := d.PushBack([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d.Len() != 24 {
+		t.Fatalf("expected 24 elements got %d", d.Len())
+	}
+	if err := d.PushBack([]byte{1, 2, 3}); !errors.Is(err, ErrItemTooLarge) {
+		t.Fatalf("expected ErrItemTooLarge got %v", err)
+	}
+
+	d = FetchDeque(d.MetaSegmentID(), sp)
+	for want := 3; want >= 0; want-- {
+		v, ok, err := d.PopFront()
+		if err != nil || !ok || v[0] != byte(want) {
+			t.Fatalf("expected %d from the front got %v (ok %v, %v)", want, v, ok, err)
+		}
+	}
+	for want := 29; want >= 10; want-- {
+		v, ok, err := d.PopBack()
+		if err != nil || !ok || v[0] != byte(want) {
+			t.Fatalf("expected %d from the back got %v (ok %v, %v)", want, v, ok, err)
+		}
+	}
+	if d.Len() != 0 {
+		t.Fatalf("expected an empty deque got %d elements", d.Len())
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func ExampleDeque() {
+	sp := NewBasicSegmentProvider()
+	dq := NewDeque(sp)
+	for i := 0; i < 10; i++ {
+		dq.PushBack([]byte{byte(i)})
+		dq.PushFront([]byte{byte(100 + i)})
+	}
+	fmt.Println(dq.Len(), len(sp.SegmentIDs()))
+	for dq.Len() > 2 {
+		if _, _, err := dq.PopFront(); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	fmt.Println(dq.PopBack())
+	fmt.Println(dq.PopBack())
+	fmt.Println(dq.PopBack())
+	fmt.Println(dq.Len(), len(sp.SegmentIDs()))
+	// Output:
+	// 20 9
+	// [9] true <nil>
+	// [8] true <nil>
+	// [] false <nil>
+	// 0 2
+}
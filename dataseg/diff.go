@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// DiffKind tells how an entry differs between two versions
+type DiffKind int
+
+const (
+	DiffAdded   DiffKind = iota + 1 // only in the new version
+	DiffRemoved                     // only in the old version
+	DiffChanged                     // in both versions with different values
+)
+
+func (k DiffKind) String() string {
+	switch k {
+	case DiffAdded:
+		return "added"
+	case DiffRemoved:
+		return "removed"
+	case DiffChanged:
+		return "changed"
+	}
+	return fmt.Sprintf("diff(%d)", int(k))
+}
+
+// MapDiff is a single difference between two map versions, Old is nil for added entries and New for removed ones
+type MapDiff struct {
+	Kind DiffKind
+	Key  string
+	Old  []byte
+	New  []byte
+}
+
+// ArrayDiff is a single difference between two array versions, Old is nil for added entries and New for removed ones
+type ArrayDiff struct {
+	Kind  DiffKind
+	Index uint32
+	Old   []byte
+	New   []byte
+}
+
+// sameSegment reports whether two segments at the same position of two versions hold the same items,
+// segments with the same id are shared and never loaded, otherwise their hashes are compared
+func sameSegment(idA, idB SegmentID, loadA, loadB func() Segment) bool {
+	if idA == idB {
+		return true
+	}
+	return segmentHash(loadA()) == segmentHash(loadB())
+}
+
+// firstError returns the first non nil error
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapDiffCursor walks the items of one map version segment by segment
+type mapDiffCursor struct {
+	sp       SegmentProvider
+	headers  []MapSegmentHeader
+	segIndex int
+	seg      *MapSegment
+	pos      int
+	err      error // first segment that couldn't be read, the cursor holds an empty segment instead
+}
+
+func newMapDiffCursor(sp SegmentProvider, metaSegmentID SegmentID) (*mapDiffCursor, error) {
+	seg, err := loadSegment(sp, metaSegmentID)
+	if err != nil {
+		return nil, err
+	}
+	mseg, ok := seg.(*MapMetaSegment)
+	if !ok {
+		return nil, fmt.Errorf("segment %d is not a map meta segment", metaSegmentID)
+	}
+	return &mapDiffCursor{sp: sp, headers: mseg.sortedSegHeaders}, nil
+}
+
+func (c *mapDiffCursor) done() bool { return c.segIndex >= len(c.headers) }
+
+func (c *mapDiffCursor) load() Segment {
+	if c.seg == nil {
+		id := c.headers[c.segIndex].segID
+		seg, err := loadSegment(c.sp, id)
+		if err == nil {
+			var ok bool
+			if c.seg, ok = seg.(*MapSegment); !ok {
+				err = fmt.Errorf("segment %d is not a map segment", id)
+			}
+		}
+		if err != nil {
+			if c.err == nil {
+				c.err = err
+			}
+			c.seg = NewMapSegment(0)
+		}
+	}
+	return c.seg
+}
+
+func (c *mapDiffCursor) skipSegment() {
+	c.segIndex++
+	c.seg = nil
+	c.pos = 0
+}
+
+// settle moves past empty segments so item returns a valid item unless done
+func (c *mapDiffCursor) settle() {
+	for !c.done() {
+		c.load()
+		if c.pos < len(c.seg.keys) {
+			return
+		}
+		c.skipSegment()
+	}
+}
+
+func (c *mapDiffCursor) item() MapItem {
+	return c.seg.lookup[c.seg.keys[c.pos]]
+}
+
+func (c *mapDiffCursor) advance() {
+	c.pos++
+	if c.pos >= len(c.seg.keys) {
+		c.skipSegment()
+	}
+}
+
+// DiffMaps calls fn for every entry that differs between the map versions with meta segments metaA (old)
+// and metaB (new) in key order, diffing stops when fn returns false. Segment pairs that start together
+// and have the same id or hash are skipped, so the cost follows the size of the change.
+func DiffMaps(sp SegmentProvider, metaA, metaB SegmentID, fn func(MapDiff) bool) error {
+	a, err := newMapDiffCursor(sp, metaA)
+	if err != nil {
+		return err
+	}
+	b, err := newMapDiffCursor(sp, metaB)
+	if err != nil {
+		return err
+	}
+	for {
+		if !a.done() && !b.done() && a.pos == 0 && b.pos == 0 {
+			ha, hb := a.headers[a.segIndex], b.headers[b.segIndex]
+			if ha.firstKey == hb.firstKey && ha.size == hb.size && sameSegment(ha.segID, hb.segID, a.load, b.load) {
+				a.skipSegment()
+				b.skipSegment()
+				continue
+			}
+		}
+		a.settle()
+		b.settle()
+		if err := firstError(a.err, b.err); err != nil {
+			return err
+		}
+		var d MapDiff
+		switch {
+		case a.done() && b.done():
+			return nil
+		case b.done() || (!a.done() && a.item().Key() < b.item().Key()):
+			d = MapDiff{Kind: DiffRemoved, Key: a.item().Key(), Old: a.item().Encoded()}
+			a.advance()
+		case a.done() || b.item().Key() < a.item().Key():
+			d = MapDiff{Kind: DiffAdded, Key: b.item().Key(), New: b.item().Encoded()}
+			b.advance()
+		default:
+			oldValue, newValue := a.item().Encoded(), b.item().Encoded()
+			key := a.item().Key()
+			a.advance()
+			b.advance()
+			if bytes.Equal(oldValue, newValue) {
+				continue
+			}
+			d = MapDiff{Kind: DiffChanged, Key: key, Old: oldValue, New: newValue}
+		}
+		if !fn(d) {
+			return nil
+		}
+	}
+}
+
+// arrayDiffCursor walks the elements of one array version segment by segment
+type arrayDiffCursor struct {
+	sp       SegmentProvider
+	headers  []ArraySegmentHeader
+	segIndex int
+	seg      *ArraySegment
+	pos      int
+	err      error // first segment that couldn't be read, the cursor holds an empty segment instead
+}
+
+func newArrayDiffCursor(sp SegmentProvider, metaSegmentID SegmentID) (*arrayDiffCursor, error) {
+	seg, err := loadSegment(sp, metaSegmentID)
+	if err != nil {
+		return nil, err
+	}
+	mseg, ok := seg.(*ArrayMetaSegment)
+	if !ok {
+		return nil, fmt.Errorf("segment %d is not an array meta segment", metaSegmentID)
+	}
+	return &arrayDiffCursor{sp: sp, headers: mseg.sortedSegHeaders}, nil
+}
+
+func (c *arrayDiffCursor) done() bool { return c.segIndex >= len(c.headers) }
+
+func (c *arrayDiffCursor) load() Segment {
+	if c.seg == nil {
+		id := c.headers[c.segIndex].segID
+		seg, err := loadSegment(c.sp, id)
+		if err == nil {
+			var ok bool
+			if c.seg, ok = seg.(*ArraySegment); !ok {
+				err = fmt.Errorf("segment %d is not an array segment", id)
+			}
+		}
+		if err != nil {
+			if c.err == nil {
+				c.err = err
+			}
+			c.seg = NewArraySegment(0)
+		}
+	}
+	return c.seg
+}
+
+func (c *arrayDiffCursor) skipSegment() {
+	c.segIndex++
+	c.seg = nil
+	c.pos = 0
+}
+
+// settle moves past empty segments so item returns a valid element unless done
+func (c *arrayDiffCursor) settle() {
+	for !c.done() {
+		c.load()
+		if c.pos < len(c.seg.elements) {
+			return
+		}
+		c.skipSegment()
+	}
+}
+
+func (c *arrayDiffCursor) item() ArrayItem {
+	return c.seg.elements[c.pos]
+}
+
+func (c *arrayDiffCursor) advance() {
+	c.pos++
+	if c.pos >= len(c.seg.elements) {
+		c.skipSegment()
+	}
+}
+
+// DiffArrays calls fn for every index that differs between the array versions with meta segments metaA (old)
+// and metaB (new) in index order, diffing stops when fn returns false. Segment pairs that start together
+// and have the same id or hash are skipped, so the cost follows the size of the change.
+func DiffArrays(sp SegmentProvider, metaA, metaB SegmentID, fn func(ArrayDiff) bool) error {
+	a, err := newArrayDiffCursor(sp, metaA)
+	if err != nil {
+		return err
+	}
+	b, err := newArrayDiffCursor(sp, metaB)
+	if err != nil {
+		return err
+	}
+	for {
+		if !a.done() && !b.done() && a.pos == 0 && b.pos == 0 {
+			ha, hb := a.headers[a.segIndex], b.headers[b.segIndex]
+			if ha.startIndex == hb.startIndex && ha.size == hb.size && sameSegment(ha.segID, hb.segID, a.load, b.load) {
+				a.skipSegment()
+				b.skipSegment()
+				continue
+			}
+		}
+		a.settle()
+		b.settle()
+		if err := firstError(a.err, b.err); err != nil {
+			return err
+		}
+		var d ArrayDiff
+		switch {
+		case a.done() && b.done():
+			return nil
+		case b.done() || (!a.done() && a.item().Index() < b.item().Index()):
+			d = ArrayDiff{Kind: DiffRemoved, Index: a.item().Index(), Old: a.item().Encoded()}
+			a.advance()
+		case a.done() || b.item().Index() < a.item().Index():
+			d = ArrayDiff{Kind: DiffAdded, Index: b.item().Index(), New: b.item().Encoded()}
+			b.advance()
+		default:
+			oldValue, newValue := a.item().Encoded(), b.item().Encoded()
+			index := a.item().Index()
+			a.advance()
+			b.advance()
+			if bytes.Equal(oldValue, newValue) {
+				continue
+			}
+			d = ArrayDiff{Kind: DiffChanged, Index: index, Old: oldValue, New: newValue}
+		}
+		if !fn(d) {
+			return nil
+		}
+	}
+}
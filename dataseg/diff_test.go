@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func collectMapDiffs(t *testing.T, sp SegmentProvider, a, b *Map) []string {
+	t.Helper()
+	res := make([]string, 0)
+	err := DiffMaps(sp, a.metaSegmentID, b.metaSegmentID, func(d MapDiff) bool {
+		res = append(res, fmt.Sprintf("%s %s %q %q", d.Kind, d.Key, d.Old, d.New))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestDiffMaps(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	old, changed := NewMap(sp), NewMap(sp)
+	for i := 0; i < 40; i++ {
+		for _, mm := range []*Map{old, changed} {
+			if err := mm.Insert(StringMapItem{fmt.Sprintf("%02d", i), "v"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if got := collectMapDiffs(t, sp, old, changed); len(got) > 0 {
+		t.Fatalf("expected no differences between equal maps got %v", got)
+	}
+
+	changed.Remove("05")
+	changed.Insert(StringMapItem{"17", "w"})
+	changed.Insert(StringMapItem{"400", "x"})
+	want := []string{
+		`removed 05 "v" ""`,
+		`changed 17 "v" "w"`,
+		`added 400 "" "x"`,
+	}
+	if got := collectMapDiffs(t, sp, old, changed); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v got %v", want, got)
+	}
+
+	count := 0
+	DiffMaps(sp, old.metaSegmentID, changed.metaSegmentID, func(MapDiff) bool {
+		count++
+		return false
+	})
+	if count != 1 {
+		t.Fatalf("expected the diff to stop after the first difference, got %d", count)
+	}
+}
+
+func TestDiffArrays(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	old, changed := NewArray(sp), NewArray(sp)
+	fillArray(t, old, 30)
+	fillArray(t, changed, 30)
+	changed.Remove(3)
+	changed.Insert(ByteArrayItem{20, 99})
+	changed.Insert(ByteArrayItem{35, 1})
+
+	got := make([]string, 0)
+	err := DiffArrays(sp, old.metaSegmentID, changed.metaSegmentID, func(d ArrayDiff) bool {
+		got = append(got, fmt.Sprintf("%s %d %v %v", d.Kind, d.Index, d.Old, d.New))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"removed 3 [3] []", "changed 20 [20] [99]", "added 35 [] [1]"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v got %v", want, got)
+	}
+}
+
+func TestDiffReportsMissingSegment(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	a, b := NewArray(sp), NewArray(sp)
+	fillArray(t, a, 10)
+	fillArray(t, b, 12)
+	sp.RemoveSegment(sp.GetSegment(b.ArrayMetaSegment().sortedSegHeaders[0].segID))
+	if err := DiffArrays(sp, a.metaSegmentID, b.metaSegmentID, func(ArrayDiff) bool { return true }); err == nil {
+		t.Fatal("expected an error for a missing segment")
+	}
+	if err := DiffMaps(sp, NewMap(sp).metaSegmentID, SegmentID(1<<40), func(MapDiff) bool { return true }); err == nil {
+		t.Fatal("expected an error for a missing meta segment")
+	}
+}
+
+func ExampleDiffMaps() {
+	sp := NewBasicSegmentProvider()
+	yesterday := NewMap(sp)
+	today := NewMap(sp)
+	for _, k := range []string{"A", "B", "C", "D", "E", "F", "G", "H"} {
+		yesterday.Insert(StringMapItem{k, k + k})
+		today.Insert(StringMapItem{k, k + k})
+	}
+	today.Insert(StringMapItem{"B", "BBB"})
+	today.Remove("G")
+	today.Insert(StringMapItem{"I", "II"})
+	err := DiffMaps(sp, yesterday.metaSegmentID, today.metaSegmentID, func(d MapDiff) bool {
+		fmt.Printf("%v %s %q %q\n", d.Kind, d.Key, d.Old, d.New)
+		return true
+	})
+	fmt.Println(err)
+	// Output:
+	// changed B "BB" "BBB"
+	// removed G "GG" ""
+	// added I "" "II"
+	// <nil>
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// Encoded segments start with a kind byte and end with a CRC32C trailer of everything before it.
+
+// segment kinds are written as the first byte of every encoded segment, kinds 2 and 4 were meta
+// segments without format version and element counts, they are not read anymore and aren't reused
+const (
+	segKindArray    byte = 1
+	segKindMap      byte = 3
+	segKindEnvelope byte = 5
+	// meta segments of these kinds have a format version byte right after the kind
+	segKindArrayMetaVersioned byte = 6
+	segKindMapMetaVersioned   byte = 7
+)
+
+// metaFormatVersion is the format version written to meta segments, version 1 adds the number
+// of elements to every segment header and version 2 the secondary index roots of a map
+const metaFormatVersion byte = 2
+
+// item flags are written before every item value of an encoded segment
+const (
+	itemFlagValue      byte = 0
+	itemFlagCollection byte = 1 // the value references a child collection
+)
+
+func itemFlag(item interface{}) byte {
+	if _, ok := item.(collectionRef); ok {
+		return itemFlagCollection
+	}
+	return itemFlagValue
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// appendBytes writes a length prefixed byte slice
+func appendBytes(b []byte, v []byte) []byte {
+	b = appendUint32(b, uint32(len(v)))
+	return append(b, v...)
+}
+
+// appendUvarint writes v as uvarint
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// appendUvarintBytes writes a byte slice prefixed with its uvarint length
+func appendUvarintBytes(b []byte, v []byte) []byte {
+	b = appendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// segmentHash returns the sha256 of the encoded segment, segments with the same content have the same hash
+func segmentHash(seg Segment) [sha256.Size]byte {
+	return sha256.Sum256(seg.Encoded())
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruptSegment is matched (errors.Is) by every error returned for a segment that fails verification
+var ErrCorruptSegment = errors.New("corrupt segment")
+
+// CorruptSegmentError is returned by Load when the encoded segment fails its checksum or can't be parsed
+type CorruptSegmentError struct {
+	ID     SegmentID
+	Reason string
+}
+
+func (e *CorruptSegmentError) Error() string {
+	return fmt.Sprintf("corrupt segment %d: %s", e.ID, e.Reason)
+}
+
+func (e *CorruptSegmentError) Is(target error) bool {
+	return target == ErrCorruptSegment
+}
+
+// sealSegment appends the CRC32C of the encoded segment as a 4 byte trailer
+func sealSegment(b []byte) []byte {
+	return appendUint32(b, crc32.Checksum(b, crcTable))
+}
+
+// openSegment verifies the trailer and the kind of an encoded segment and returns a decoder for the body
+func openSegment(id SegmentID, data []byte, kind byte) (*decoder, error) {
+	d, got, err := openSegmentKind(id, data)
+	if err != nil {
+		return nil, err
+	}
+	if got != kind {
+		return nil, &CorruptSegmentError{ID: id, Reason: fmt.Sprintf("expected kind %d got %d", kind, got)}
+	}
+	return d, nil
+}
+
+// openSegmentKind verifies the trailer of an encoded segment and returns its kind and a decoder for the body
+func openSegmentKind(id SegmentID, data []byte) (*decoder, byte, error) {
+	if len(data) < 5 {
+		return nil, 0, &CorruptSegmentError{ID: id, Reason: fmt.Sprintf("too short (%d bytes)", len(data))}
+	}
+	body := data[:len(data)-4]
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return nil, 0, &CorruptSegmentError{ID: id, Reason: "checksum mismatch"}
+	}
+	return &decoder{id: id, b: body[1:]}, body[0], nil
+}
+
+// openMetaSegment opens a meta segment of the given kind and returns its format version
+func openMetaSegment(id SegmentID, data []byte, kind byte) (d *decoder, version byte, err error) {
+	d, err = openSegment(id, data, kind)
+	if err != nil {
+		return nil, 0, err
+	}
+	v := d.byte()
+	if d.err == nil && (v == 0 || v > metaFormatVersion) {
+		return nil, 0, &CorruptSegmentError{ID: id, Reason: fmt.Sprintf("unsupported meta format version %d", v)}
+	}
+	return d, v, d.err
+}
+
+// decoder reads the fields written by the append helpers, the first short read is kept in err
+type decoder struct {
+	id  SegmentID
+	b   []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = &CorruptSegmentError{ID: d.id, Reason: "unexpected end of segment"}
+		return nil
+	}
+	res := d.b[:n]
+	d.b = d.b[n:]
+	return res
+}
+
+func (d *decoder) byte() byte {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if b := d.take(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+// bytes reads a length prefixed byte slice, the result is a copy
+func (d *decoder) bytes() []byte {
+	n := d.uint32()
+	if b := d.take(int(n)); b != nil {
+		return append([]byte{}, b...)
+	}
+	return nil
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = &CorruptSegmentError{ID: d.id, Reason: "invalid varint"}
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+// uvarintBytes reads a byte slice written by appendUvarintBytes, the result is a copy
+func (d *decoder) uvarintBytes() []byte {
+	n := d.uvarint()
+	if n > uint64(len(d.b)) {
+		d.take(len(d.b) + 1)
+		return nil
+	}
+	if b := d.take(int(n)); b != nil {
+		return append([]byte{}, b...)
+	}
+	return nil
+}
+
+func (d *decoder) segmentID() SegmentID {
+	id := SegmentID(d.uint64())
+	reserveSegmentID(id)
+	return id
+}
+
+// finish returns the first read error, or an error if there are bytes left
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.b) > 0 {
+		d.err = &CorruptSegmentError{ID: d.id, Reason: fmt.Sprintf("%d trailing bytes", len(d.b))}
+	}
+	return d.err
+}
+
+// DecodeSegment creates a segment of the kind found in the encoded data and loads it
+func DecodeSegment(id SegmentID, data []byte) (Segment, error) {
+	if len(data) == 0 {
+		return nil, &CorruptSegmentError{ID: id, Reason: "empty"}
+	}
+	var seg Segment
+	switch data[0] {
+	case segKindArray:
+		seg = NewArraySegment(id)
+	case segKindArrayMetaVersioned:
+		seg = &ArrayMetaSegment{id: id}
+	case segKindMap:
+		seg = NewMapSegment(id)
+	case segKindMapMetaVersioned:
+		seg = &MapMetaSegment{id: id}
+	case segKindEnvelope:
+		seg = &EnvelopeSegment{id: id}
+	default:
+		return nil, &CorruptSegmentError{ID: id, Reason: fmt.Sprintf("unknown kind %d", data[0])}
+	}
+	if err := seg.Load(data); err != nil {
+		return nil, err
+	}
+	reserveSegmentID(id)
+	return seg, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestAppendUvarint(t *testing.T) {
+	for _, v := range []uint64{0, 1, 127, 128, 300, 1<<32 + 5, 1<<64 - 1} {
+		b := appendUvarint([]byte{0xff}, v)
+		got, n := binary.Uvarint(b[1:])
+		if got != v || n != len(b)-1 {
+			t.Fatalf("%d: decoded %d from %d bytes of %x", v, got, n, b)
+		}
+	}
+}
+
+func testMapSegment() *MapSegment {
+	seg := NewMapSegment(generateUUID())
+	for _, k := range []string{"AB1", "AB2", "AB3", "AC", "AC1", "B", "BA", "BAA", "C"} {
+		seg.AddItem(StringMapItem{k, "v"})
+	}
+	seg.AddItem(CollectionMapItem{"D", collectionKindMap, 5})
+	seg.lowerBound = "A"
+	return seg
+}
+
+func TestMapSegmentRoundTrip(t *testing.T) {
+	seg := testMapSegment()
+	full := uint32(0)
+	for _, item := range seg.lookup {
+		full += item.Size()
+	}
+	if seg.totalSize >= full {
+		t.Fatalf("front coded size %d is not smaller than the full size %d", seg.totalSize, full)
+	}
+	decoded, err := DecodeSegment(seg.id, seg.Encoded())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := decoded.(*MapSegment)
+	if got.lowerBound != "A" || got.totalSize != seg.totalSize || strings.Join(got.keys, ",") != strings.Join(seg.keys, ",") {
+		t.Fatalf("decoded %v from %v", got, seg)
+	}
+	if ref, ok := got.lookup["D"].(collectionRef); !ok || ref.ChildMetaSegmentID() != 5 {
+		t.Fatal("collection item lost its reference")
+	}
+	for _, k := range append(seg.keys, "A", "AB", "AB0", "BB", "E") {
+		item, found, err := SearchMapSegment(seg.id, seg.Encoded(), k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, ok := seg.lookup[k]
+		if found != ok || (found && string(item.Encoded()) != string(want.Encoded())) {
+			t.Fatalf("search %q found %v %v", k, found, item)
+		}
+	}
+}
+
+// sealedMapSegment encodes a map segment body from raw entries
+func sealedMapSegment(n uint32, restarts []uint32, entries []byte) []byte {
+	res := []byte{segKindMap}
+	res = appendBytes(res, nil)
+	res = appendUint32(res, n)
+	res = appendUint32(res, uint32(len(restarts)))
+	for _, r := range restarts {
+		res = appendUint32(res, r)
+	}
+	return sealSegment(append(res, entries...))
+}
+
+func mapEntryBytes(shared int, suffix, value string) []byte {
+	res := appendUvarint(nil, uint64(shared))
+	res = appendUvarintBytes(res, []byte(suffix))
+	res = append(res, itemFlagValue)
+	return appendUvarintBytes(res, []byte(value))
+}
+
+func TestMapSegmentDecodeErrors(t *testing.T) {
+	valid := testMapSegment().Encoded()
+	flipped := append([]byte{}, valid...)
+	flipped[len(flipped)/2] ^= 1
+	twoEntries := func(second []byte) []byte {
+		return append(mapEntryBytes(0, "AB", "v"), second...)
+	}
+	cases := map[string]struct {
+		data   []byte
+		reason string
+	}{
+		"checksum":        {flipped, "checksum mismatch"},
+		"too short":       {valid[:3], "too short"},
+		"truncated":       {sealSegment(valid[:20]), "unexpected end"},
+		"unknown kind":    {sealSegment([]byte{99}), "unknown kind"},
+		"restart count":   {sealedMapSegment(5, []uint32{0}, nil), "restart points"},
+		"restart offset":  {sealedMapSegment(1, []uint32{3}, mapEntryBytes(0, "A", "v")), "restart point 0"},
+		"shared prefix":   {sealedMapSegment(2, []uint32{0}, twoEntries(mapEntryBytes(3, "C", "v"))), "shared prefix"},
+		"key order":       {sealedMapSegment(2, []uint32{0}, twoEntries(mapEntryBytes(1, "A", "v"))), "is not after"},
+		"trailing bytes":  {sealedMapSegment(1, []uint32{0}, append(mapEntryBytes(0, "A", "v"), 0)), ""},
+		"invalid varint":  {sealedMapSegment(1, []uint32{0}, []byte{0xff}), "invalid varint"},
+		"collection item": {sealedMapSegment(1, []uint32{0}, append(append(appendUvarintBytes([]byte{0}, []byte("A")), itemFlagCollection), 1, 9)), "collection reference"},
+	}
+	for name, c := range cases {
+		_, err := DecodeSegment(7, c.data)
+		var corrupt *CorruptSegmentError
+		if !errors.Is(err, ErrCorruptSegment) || !errors.As(err, &corrupt) {
+			t.Fatalf("%s: expected a corrupt segment error got %v", name, err)
+		}
+		if corrupt.ID != 7 || !strings.Contains(corrupt.Reason, c.reason) {
+			t.Fatalf("%s: unexpected error %v", name, err)
+		}
+	}
+}
+
+func ExampleSearchMapSegment() {
+	sp := NewBasicSegmentProvider()
+	mm := NewMap(sp)
+	for _, k := range []string{"user01", "user02", "user03", "user04", "user05", "user06"} {
+		mm.Insert(StringMapItem{k, ""})
+	}
+	// the six keys take 36 bytes in full but fit into a single segment once front coded
+	mseg := mm.MapMetaSegment()
+	fmt.Println(len(mseg.sortedSegHeaders), mseg.size)
+	segID := mseg.sortedSegHeaders[0].segID
+	item, found, err := SearchMapSegment(segID, sp.GetSegment(segID).Encoded(), "user05")
+	fmt.Println(item.Key(), found, err)
+	// Output:
+	// 1 16
+	// user05 true <nil>
+}
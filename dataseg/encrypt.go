@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+// EncryptingSegmentProvider AES-GCM encrypts the encoding of every segment before storing it as an
+// EnvelopeSegment in the wrapped provider. The envelope holds the id of the key, the nonce and the
+// ciphertext, the segment id and the key id are authenticated as associated data so a segment can't
+// be moved to another id. After Rotate new writes use the new key, segments written with older keys
+// are still readable and get re-encrypted the next time they are written.
+//
+// To combine it with compression, wrap the encrypting provider with the compressing one.
+type EncryptingSegmentProvider struct {
+	sp      SegmentProvider
+	keys    map[uint32]cipher.AEAD
+	current uint32
+	err     error
+}
+
+func NewEncryptingSegmentProvider(sp SegmentProvider, keyID uint32, key []byte) (*EncryptingSegmentProvider, error) {
+	p := &EncryptingSegmentProvider{sp: sp, keys: make(map[uint32]cipher.AEAD)}
+	if err := p.Rotate(keyID, key); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// AddKey makes a key available for decryption only, e.g. a key that was rotated out before a restart
+func (p *EncryptingSegmentProvider) AddKey(keyID uint32, key []byte) error {
+	if _, ok := p.keys[keyID]; ok {
+		return fmt.Errorf("key %d already exists", keyID)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("key %d: %w", keyID, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("key %d: %w", keyID, err)
+	}
+	p.keys[keyID] = aead
+	return nil
+}
+
+// Rotate adds a key (16, 24 or 32 bytes) and uses it for every following write
+func (p *EncryptingSegmentProvider) Rotate(keyID uint32, key []byte) error {
+	if err := p.AddKey(keyID, key); err != nil {
+		return err
+	}
+	p.current = keyID
+	return nil
+}
+
+// CurrentKeyID returns the id of the key used for writes
+func (p *EncryptingSegmentProvider) CurrentKeyID() uint32 {
+	return p.current
+}
+
+// additionalData binds the ciphertext to the segment id and the key id
+func additionalData(id SegmentID, keyID uint32) []byte {
+	return appendUint32(appendUint64(nil, uint64(id)), keyID)
+}
+
+// GetSegment returns nil if the segment doesn't exist or can't be decrypted
+func (p *EncryptingSegmentProvider) GetSegment(id SegmentID) Segment {
+	seg := p.sp.GetSegment(id)
+	if seg == nil {
+		return nil
+	}
+	raw, err := p.decrypt(id, seg)
+	if err == nil {
+		seg, err = DecodeSegment(id, raw)
+	}
+	if err != nil {
+		if p.err == nil {
+			p.err = fmt.Errorf("segment %d: %w", id, err)
+		}
+		return nil
+	}
+	return seg
+}
+
+func (p *EncryptingSegmentProvider) decrypt(id SegmentID, seg Segment) ([]byte, error) {
+	env, ok := seg.(*EnvelopeSegment)
+	if !ok {
+		return nil, fmt.Errorf("segment is not encrypted")
+	}
+	if len(env.payload) < 4 {
+		return nil, fmt.Errorf("encrypted payload too short")
+	}
+	keyID := binary.BigEndian.Uint32(env.payload)
+	aead, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %d", keyID)
+	}
+	rest := env.payload[4:]
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted payload too short")
+	}
+	nonce, ciphertext := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+	raw, err := aead.Open(nil, nonce, ciphertext, additionalData(id, keyID))
+	if err != nil {
+		return nil, fmt.Errorf("key %d: %w", keyID, err)
+	}
+	return raw, nil
+}
+
+// AddSegment always encrypts with the current key, this is how segments move off rotated keys
+func (p *EncryptingSegmentProvider) AddSegment(seg Segment) {
+	env, err := p.seal(seg)
+	if err != nil {
+		if p.err == nil {
+			p.err = err
+		}
+		return
+	}
+	p.sp.AddSegment(env)
+}
+
+// WriteBatch encrypts the added segments and hands the batch over to the wrapped provider, nothing
+// is written if one of them can't be encrypted
+func (p *EncryptingSegmentProvider) WriteBatch(adds []Segment, removes []Segment) error {
+	envelopes := make([]Segment, len(adds))
+	for i, seg := range adds {
+		env, err := p.seal(seg)
+		if err != nil {
+			return err
+		}
+		envelopes[i] = env
+	}
+	return writeBatch(p.sp, envelopes, removes)
+}
+
+// seal returns the segment encrypted with the current key as it is stored in the wrapped provider
+func (p *EncryptingSegmentProvider) seal(seg Segment) (Segment, error) {
+	aead := p.keys[p.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("segment %d: %w", seg.ID(), err)
+	}
+	payload := appendUint32(nil, p.current)
+	payload = append(payload, nonce...)
+	payload = aead.Seal(payload, nonce, seg.Encoded(), additionalData(seg.ID(), p.current))
+	return &EnvelopeSegment{id: seg.ID(), payload: payload}, nil
+}
+
+func (p *EncryptingSegmentProvider) RemoveSegment(seg Segment) {
+	p.sp.RemoveSegment(seg)
+}
+
+// SegmentIDs lists the segments of the wrapped provider, it returns nil if the provider can't list
+func (p *EncryptingSegmentProvider) SegmentIDs() []SegmentID {
+	if lister, ok := p.sp.(SegmentLister); ok {
+		return lister.SegmentIDs()
+	}
+	return nil
+}
+
+// Err returns the first failed read or write since the last call, or else the error of the wrapped
+// provider, and clears both
+func (p *EncryptingSegmentProvider) Err() error {
+	err := p.err
+	p.err = nil
+	if r, ok := p.sp.(errorReporter); ok {
+		if inner := r.Err(); err == nil {
+			err = inner
+		}
+	}
+	return err
+}
+
+// KeyID returns the id of the key a stored segment is encrypted with
+func (p *EncryptingSegmentProvider) KeyID(id SegmentID) (uint32, bool) {
+	env, ok := p.sp.GetSegment(id).(*EnvelopeSegment)
+	if !ok || len(env.payload) < 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(env.payload), true
+}
+
+// StaleSegments returns the segments that are still encrypted with an older key, once it
+// is empty the older keys are not needed anymore
+func (p *EncryptingSegmentProvider) StaleSegments() []SegmentID {
+	res := make([]SegmentID, 0)
+	for _, id := range p.SegmentIDs() {
+		if keyID, ok := p.KeyID(id); ok && keyID != p.current {
+			res = append(res, id)
+		}
+	}
+	return res
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var (
+	testKey1 = bytes.Repeat([]byte{1}, 16)
+	testKey2 = bytes.Repeat([]byte{2}, 32)
+)
+
+func TestEncryptingProviderRoundTrip(t *testing.T) {
+	inner := NewBasicSegmentProvider()
+	sp, err := NewEncryptingSegmentProvider(inner, 1, testKey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm := NewMap(sp)
+	for _, k := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		if err := mm.Insert(StringMapItem{k, "zz"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range inner.SegmentIDs() {
+		env, ok := inner.GetSegment(id).(*EnvelopeSegment)
+		if !ok {
+			t.Fatalf("segment %d is stored unencrypted", id)
+		}
+		if bytes.Contains(env.payload, []byte("zz")) {
+			t.Fatalf("segment %d leaks its plaintext", id)
+		}
+	}
+	if item, found := FetchMap(mm.metaSegmentID, sp).Get("e"); !found || string(item.Encoded()) != "zz" {
+		t.Fatal("expected the map to be readable through the provider")
+	}
+	if err := sp.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptingProviderKeyRotation(t *testing.T) {
+	inner := NewBasicSegmentProvider()
+	sp, err := NewEncryptingSegmentProvider(inner, 1, testKey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aa := NewArray(sp)
+	fillArray(t, aa, 8)
+	if err := sp.Rotate(2, testKey2); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.Rotate(2, testKey2); err == nil {
+		t.Fatal("expected an error for an existing key id")
+	}
+	if len(sp.StaleSegments()) != len(inner.SegmentIDs()) {
+		t.Fatal("expected every segment to be stale after rotation")
+	}
+	// old segments stay readable, writing one moves it to the new key
+	if item, found := aa.Get(3); !found || item.Encoded()[0] != 3 {
+		t.Fatal("segments written with the old key can't be read")
+	}
+	for _, id := range inner.SegmentIDs() {
+		sp.AddSegment(sp.GetSegment(id))
+	}
+	if stale := sp.StaleSegments(); len(stale) > 0 {
+		t.Fatalf("expected no stale segments after rewriting got %v", stale)
+	}
+	if keyID, ok := sp.KeyID(aa.metaSegmentID); !ok || keyID != sp.CurrentKeyID() {
+		t.Fatalf("expected key %d got %d", sp.CurrentKeyID(), keyID)
+	}
+
+	// a provider that only knows the old key can't read the rewritten segments
+	old, err := NewEncryptingSegmentProvider(inner, 1, testKey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.GetSegment(aa.metaSegmentID) != nil {
+		t.Fatal("expected the segment to be unreadable without its key")
+	}
+	if err := old.Err(); err == nil || !strings.Contains(err.Error(), "unknown key 2") {
+		t.Fatalf("expected an unknown key error got %v", err)
+	}
+}
+
+func TestEncryptingProviderAuthenticatesID(t *testing.T) {
+	inner := NewBasicSegmentProvider()
+	sp, err := NewEncryptingSegmentProvider(inner, 1, testKey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aa := NewArray(sp)
+	env := inner.GetSegment(aa.metaSegmentID).(*EnvelopeSegment)
+	moved := &EnvelopeSegment{id: aa.metaSegmentID + 1000, payload: env.payload}
+	inner.AddSegment(moved)
+	if sp.GetSegment(moved.id) != nil || sp.Err() == nil {
+		t.Fatal("expected a segment moved to another id to fail authentication")
+	}
+
+	if _, err := NewEncryptingSegmentProvider(inner, 1, []byte("short")); err == nil {
+		t.Fatal("expected an error for an invalid key length")
+	}
+}
+
+func TestEncryptingProviderPassesBatchesThrough(t *testing.T) {
+	ledger := NewStorageLedger(NewBasicSegmentProvider())
+	sp, err := NewEncryptingSegmentProvider(ledger.Owner("bob"), 1, testKey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm := NewMap(sp)
+	ledger.SetQuota("bob", ledger.Usage("bob")+150)
+	inserted, rejected := fillUntilRejected(t, mm)
+	if v := mm.Check(); len(v) > 0 {
+		t.Fatalf("map is not consistent after a rejected write: %v", v)
+	}
+	if _, found := mm.Get(rejected); found {
+		t.Fatalf("rejected key %s is readable", rejected)
+	}
+	for _, k := range inserted {
+		if _, found := mm.Get(k); !found {
+			t.Fatalf("key %s is missing", k)
+		}
+	}
+}
+
+func TestEncryptingProviderReportsInnerErrors(t *testing.T) {
+	inner := NewByteSegmentProvider(false)
+	sp, err := NewEncryptingSegmentProvider(inner, 1, testKey1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm := NewMap(sp)
+	inner.segments[mm.metaSegmentID][1] ^= 1
+	if sp.GetSegment(mm.metaSegmentID) != nil {
+		t.Fatal("expected no segment for a corrupt one")
+	}
+	if err := sp.Err(); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected the checksum mismatch of the wrapped provider got %v", err)
+	}
+	if err := sp.Err(); err != nil {
+		t.Fatalf("expected the error to be cleared got %v", err)
+	}
+}
+
+func ExampleEncryptingSegmentProvider() {
+	store := NewByteSegmentProvider(false)
+	sp, err := NewEncryptingSegmentProvider(store, 1, []byte("0123456789abcdef"))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	mm := NewMap(sp)
+	for _, k := range []string{"A", "B", "C", "D", "E"} {
+		mm.Insert(StringMapItem{k, "XXXX"})
+	}
+	if err := sp.Rotate(2, []byte("fedcba9876543210")); err != nil {
+		fmt.Println(err)
+		return
+	}
+	// only the segments touched by the write move to the new key
+	before := len(sp.StaleSegments())
+	mm.Insert(StringMapItem{"E", "EEEE"})
+	item, _ := mm.Get("A")
+	fmt.Println(string(item.Encoded()), len(sp.StaleSegments()) < before, sp.Err())
+
+	// a segment stored under another id fails authentication
+	ids := sp.SegmentIDs()
+	store.segments[ids[0]], store.segments[ids[1]] = store.segments[ids[1]], store.segments[ids[0]]
+	fmt.Println(sp.GetSegment(ids[0]) == nil, sp.Err() != nil)
+	// Output:
+	// XXXX true <nil>
+	// true true
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// Exports are JSON Lines, a header line followed by one line per item in key or index order.
+// Values are base64 encoded bytes, child collections are written inline with their items. Map keys
+// are written as strings, keys that aren't valid UTF-8 (e.g. the ones of Int32KeyCodec) would be
+// mangled by JSON and are written as base64 encoded bytes in keyBytes instead.
+
+// jsonlHeader is the first line of an export
+type jsonlHeader struct {
+	Type         string `json:"type"` // "map" or "array"
+	MinThreshold int    `json:"minThreshold"`
+	MaxThreshold int    `json:"maxThreshold"`
+	MaxItemSize  int    `json:"maxItemSize"`
+}
+
+// jsonlItem is a single item of an export
+type jsonlItem struct {
+	Key        *string     `json:"key,omitempty"`
+	KeyBytes   []byte      `json:"keyBytes,omitempty"` // keys that aren't valid UTF-8
+	Index      *uint32     `json:"index,omitempty"`
+	Value      []byte      `json:"value,omitempty"`
+	Collection string      `json:"collection,omitempty"` // "map" or "array" for child collections
+	Items      []jsonlItem `json:"items,omitempty"`      // items of the child collection
+}
+
+func collectionName(kind byte) string {
+	if kind == collectionKindMap {
+		return "map"
+	}
+	return "array"
+}
+
+// ExportJSONL writes the map and its child collections as JSON Lines
+func (a *Map) ExportJSONL(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(newJSONLHeader("map")); err != nil {
+		return err
+	}
+	return a.exportItems(func(rec jsonlItem) error { return enc.Encode(rec) })
+}
+
+// ExportJSONL writes the array and its child collections as JSON Lines
+func (a *Array) ExportJSONL(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(newJSONLHeader("array")); err != nil {
+		return err
+	}
+	return a.exportItems(func(rec jsonlItem) error { return enc.Encode(rec) })
+}
+
+func newJSONLHeader(typ string) jsonlHeader {
+	return jsonlHeader{Type: typ, MinThreshold: minThreshold, MaxThreshold: maxThreshold, MaxItemSize: maxItemSize}
+}
+
+func (a *Map) exportItems(fn func(jsonlItem) error) error {
+	it := a.Iterator()
+	for it.Next() {
+		item := it.Item()
+		key := item.Key()
+		rec, err := exportValue(a.sp, item)
+		if err != nil {
+			return fmt.Errorf("key %q: %w", key, err)
+		}
+		if utf8.ValidString(key) {
+			rec.Key = &key
+		} else {
+			rec.KeyBytes = []byte(key)
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+func (a *Array) exportItems(fn func(jsonlItem) error) error {
+	mseg, err := a.metaSegment()
+	if err != nil {
+		return err
+	}
+	for _, segH := range mseg.sortedSegHeaders {
+		seg, err := a.segment(segH.segID)
+		if err != nil {
+			return err
+		}
+		for _, item := range seg.elements {
+			index := item.Index()
+			rec, err := exportValue(a.sp, item)
+			if err != nil {
+				return fmt.Errorf("index %d: %w", index, err)
+			}
+			rec.Index = &index
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// exportValue returns the record of an item without key or index, child collections are exported with their items
+func exportValue(sp SegmentProvider, item interface{ Encoded() []byte }) (jsonlItem, error) {
+	ref, ok := item.(collectionRef)
+	if !ok {
+		return jsonlItem{Value: item.Encoded()}, nil
+	}
+	rec := jsonlItem{Collection: collectionName(ref.CollectionKind()), Items: make([]jsonlItem, 0)}
+	collect := func(child jsonlItem) error {
+		rec.Items = append(rec.Items, child)
+		return nil
+	}
+	var err error
+	if ref.CollectionKind() == collectionKindMap {
+		err = FetchMap(ref.ChildMetaSegmentID(), sp).exportItems(collect)
+	} else {
+		err = FetchArray(ref.ChildMetaSegmentID(), sp).exportItems(collect)
+	}
+	return rec, err
+}
+
+// ImportMapJSONL creates a new map in sp from an export written by Map.ExportJSONL
+func ImportMapJSONL(sp SegmentProvider, r io.Reader) (*Map, error) {
+	m := NewMap(sp)
+	err := importJSONL(r, "map", func(rec jsonlItem) error { return m.importItem(rec) })
+	if err != nil {
+		dropCollection(sp, m.metaSegmentID)
+		return nil, err
+	}
+	return m, nil
+}
+
+// ImportArrayJSONL creates a new array in sp from an export written by Array.ExportJSONL
+func ImportArrayJSONL(sp SegmentProvider, r io.Reader) (*Array, error) {
+	a := NewArray(sp)
+	err := importJSONL(r, "array", func(rec jsonlItem) error { return a.importItem(rec) })
+	if err != nil {
+		dropCollection(sp, a.metaSegmentID)
+		return nil, err
+	}
+	return a, nil
+}
+
+// importJSONL checks the header and calls fn for every item line, items that were valid under
+// the thresholds of the export but are too large for the current ones fail with ErrItemTooLarge
+func importJSONL(r io.Reader, typ string, fn func(jsonlItem) error) error {
+	dec := json.NewDecoder(r)
+	var header jsonlHeader
+	if err := dec.Decode(&header); err != nil {
+		return fmt.Errorf("header: %w", err)
+	}
+	if header.Type != typ {
+		return fmt.Errorf("expected an export of a %s got %q", typ, header.Type)
+	}
+	for line := 2; ; line++ {
+		var rec jsonlItem
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil {
+			err = fn(rec)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+}
+
+func (a *Map) importItem(rec jsonlItem) error {
+	var key string
+	switch {
+	case rec.Key != nil:
+		key = *rec.Key
+	case rec.KeyBytes != nil:
+		key = string(rec.KeyBytes)
+	default:
+		return fmt.Errorf("map item without key")
+	}
+	switch rec.Collection {
+	case "":
+		return a.Insert(BytesMapItem{key, rec.Value})
+	case "map":
+		child, err := a.NewChildMap(key)
+		if err != nil {
+			return err
+		}
+		return importChildItems(rec.Items, child.importItem)
+	case "array":
+		child, err := a.NewChildArray(key)
+		if err != nil {
+			return err
+		}
+		return importChildItems(rec.Items, child.importItem)
+	}
+	return fmt.Errorf("key %q: unknown collection %q", key, rec.Collection)
+}
+
+func (a *Array) importItem(rec jsonlItem) error {
+	if rec.Index == nil {
+		return fmt.Errorf("array item without index")
+	}
+	index := *rec.Index
+	var item ArrayItem
+	switch rec.Collection {
+	case "":
+		item = BytesArrayItem{index, rec.Value}
+	case "map":
+		child := NewMap(a.sp)
+		if err := importChildItems(rec.Items, child.importItem); err != nil {
+			dropCollection(a.sp, child.metaSegmentID)
+			return err
+		}
+		item = CollectionArrayItem{index, collectionKindMap, child.metaSegmentID}
+	case "array":
+		child := NewArray(a.sp)
+		if err := importChildItems(rec.Items, child.importItem); err != nil {
+			dropCollection(a.sp, child.metaSegmentID)
+			return err
+		}
+		item = CollectionArrayItem{index, collectionKindArray, child.metaSegmentID}
+	default:
+		return fmt.Errorf("index %d: unknown collection %q", index, rec.Collection)
+	}
+	if item.Size() > maxItemSize {
+		if ref, ok := item.(collectionRef); ok {
+			dropCollection(a.sp, ref.ChildMetaSegmentID())
+		}
+		return fmt.Errorf("index %d: %w", index, ErrItemTooLarge)
+	}
+	if err := a.Insert(item); err != nil {
+		if ref, ok := item.(collectionRef); ok {
+			dropCollection(a.sp, ref.ChildMetaSegmentID())
+		}
+		return err
+	}
+	return nil
+}
+
+func importChildItems(items []jsonlItem, fn func(jsonlItem) error) error {
+	for _, rec := range items {
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMapJSONLRoundTrip(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	mm := NewMap(sp)
+	for _, k := range []string{"a", "b", "c", "d", "e", "f"} {
+		if err := mm.Insert(BytesMapItem{k, []byte{0, 0xff}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	childMap, err := mm.NewChildMap("M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	childMap.Insert(StringMapItem{"x", "1"})
+	childArray, err := mm.NewChildArray("L")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillArray(t, childArray, 12)
+
+	var exported bytes.Buffer
+	if err := mm.ExportJSONL(&exported); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(exported.String(), "\n"); lines != 9 {
+		t.Fatalf("expected a header and 8 items got %d lines", lines)
+	}
+
+	target := NewBasicSegmentProvider()
+	imported, err := ImportMapJSONL(target, bytes.NewReader(exported.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var again bytes.Buffer
+	if err := imported.ExportJSONL(&again); err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != exported.String() {
+		t.Fatalf("import changed the content:\n%s\n%s", exported.String(), again.String())
+	}
+	if arr, ok := imported.GetArray("L"); !ok || len(arr.Check()) > 0 {
+		t.Fatal("expected a consistent child array after import")
+	}
+}
+
+func TestArrayJSONLRoundTrip(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	aa := NewArray(sp)
+	fillArray(t, aa, 25)
+	aa.Remove(7)
+	var exported bytes.Buffer
+	if err := aa.ExportJSONL(&exported); err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ImportArrayJSONL(NewBasicSegmentProvider(), bytes.NewReader(exported.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := imported.Get(7); found {
+		t.Fatal("removed index came back with the import")
+	}
+	if item, found := imported.Get(24); !found || item.Encoded()[0] != 24 {
+		t.Fatal("expected the last item to be imported")
+	}
+	if v := imported.Check(); len(v) > 0 {
+		t.Fatalf("imported array is not consistent: %v", v)
+	}
+}
+
+func TestBinaryKeysJSONLRoundTrip(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	tm := NewTypedMap[int32, []byte](sp, Int32KeyCodec{}, BytesCodec{})
+	// flipping the sign bit makes every key start with 0x80 or above, none of them is valid UTF-8
+	keys := []int32{-70000, -1, 0, 1, 255, 1 << 20}
+	for i, k := range keys {
+		if err := tm.Put(k, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var exported bytes.Buffer
+	if err := tm.Map().ExportJSONL(&exported); err != nil {
+		t.Fatal(err)
+	}
+	imported, err := ImportMapJSONL(NewBasicSegmentProvider(), &exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := FetchTypedMap[int32, []byte](imported.metaSegmentID, imported.sp, Int32KeyCodec{}, BytesCodec{})
+	for i, k := range keys {
+		v, found, err := got.Get(k)
+		if err != nil || !found || !bytes.Equal(v, []byte{byte(i)}) {
+			t.Fatalf("key %d: expected %v got %v %v %v", k, []byte{byte(i)}, v, found, err)
+		}
+	}
+	if n := imported.Stats().Elements; n != uint64(len(keys)) {
+		t.Fatalf("expected %d keys got %d", len(keys), n)
+	}
+}
+
+func TestImportJSONLErrors(t *testing.T) {
+	header := `{"type":"map","minThreshold":10,"maxThreshold":20,"maxItemSize":6}` + "\n"
+	for name, tc := range map[string]struct {
+		input string
+		want  string
+	}{
+		"wrong type":   {`{"type":"array"}` + "\n", "expected an export of a map"},
+		"no key":       {header + `{"value":"AQ=="}` + "\n", "line 2: map item without key"},
+		"bad json":     {header + `{"key":` + "\n", "line 2"},
+		"unknown kind": {header + `{"key":"a","collection":"set"}` + "\n", "unknown collection"},
+		"too large":    {header + `{"key":"a","value":"AQ=="}` + "\n" + `{"key":"b","value":"AQIDBAUG"}` + "\n", "line 3"},
+	} {
+		sp := NewBasicSegmentProvider()
+		_, err := ImportMapJSONL(sp, strings.NewReader(tc.input))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected an error containing %q got %v", name, tc.want, err)
+		}
+		if name == "too large" && !errors.Is(err, ErrItemTooLarge) {
+			t.Errorf("%s: expected ErrItemTooLarge got %v", name, err)
+		}
+		if n := len(sp.SegmentIDs()); n != 0 {
+			t.Errorf("%s: a failed import left %d segments behind", name, n)
+		}
+	}
+}
+
+func ExampleMap_ExportJSONL() {
+	sp := NewBasicSegmentProvider()
+	mm := NewMap(sp)
+	mm.Insert(StringMapItem{"A", "AAAA"})
+	mm.Insert(StringMapItem{"B", "BB"})
+	tags, _ := mm.NewChildArray("T")
+	tags.AppendByteArrayItem(7)
+	var buf bytes.Buffer
+	if err := mm.ExportJSONL(&buf); err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Print(buf.String())
+
+	imported, err := ImportMapJSONL(NewBasicSegmentProvider(), bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	var again bytes.Buffer
+	imported.ExportJSONL(&again)
+	fmt.Println(bytes.Equal(buf.Bytes(), again.Bytes()))
+	// Output:
+	// {"type":"map","minThreshold":10,"maxThreshold":20,"maxItemSize":6}
+	// {"key":"A","value":"QUFBQQ=="}
+	// {"key":"B","value":"QkI="}
+	// {"key":"T","collection":"array","items":[{"index":1,"value":"Bw=="}]}
+	// true
+}
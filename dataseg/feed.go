@@ -0,0 +1,141 @@
+package main
+
+import "fmt"
+
+// ChangeOp is the kind of a change event
+type ChangeOp int
+
+const (
+	OpInsert       ChangeOp = iota + 1 // a new key or index was added
+	OpUpdate                           // the value of an existing key or index was replaced
+	OpRemove                           // a key or index was removed
+	OpSplit                            // a segment was split, Segments holds the old and the new segment
+	OpMerge                            // two segments were merged, Segments holds the kept and the removed segment
+	OpRedistribute                     // items were moved between two neighboring segments
+)
+
+func (o ChangeOp) String() string {
+	switch o {
+	case OpInsert:
+		return "insert"
+	case OpUpdate:
+		return "update"
+	case OpRemove:
+		return "remove"
+	case OpSplit:
+		return "split"
+	case OpMerge:
+		return "merge"
+	case OpRedistribute:
+		return "redistribute"
+	}
+	return fmt.Sprintf("op(%d)", int(o))
+}
+
+// ChangeEvent describes a single mutation of an Array or Map, Key is set for maps and Index for arrays,
+// Old and New hold the encoded values (nil when there is none) and are not set for structural events
+type ChangeEvent struct {
+	Op       ChangeOp
+	Key      string
+	Index    uint32
+	Old      []byte
+	New      []byte
+	Segments []SegmentID // segments written or removed by the change
+}
+
+// ChangeFeed delivers change events to subscribers, callbacks are called synchronously
+// and channels are bounded, events that don't fit into a full channel are dropped and counted
+type ChangeFeed struct {
+	subscribers []func(ChangeEvent)
+	channels    []chan ChangeEvent
+	dropped     uint64
+}
+
+// Subscribe registers a callback called for every event
+func (f *ChangeFeed) Subscribe(fn func(ChangeEvent)) {
+	f.subscribers = append(f.subscribers, fn)
+}
+
+// SubscribeChan returns a channel receiving events, at most size events are buffered
+func (f *ChangeFeed) SubscribeChan(size int) <-chan ChangeEvent {
+	ch := make(chan ChangeEvent, size)
+	f.channels = append(f.channels, ch)
+	return ch
+}
+
+// Dropped returns the number of events dropped because a channel was full
+func (f *ChangeFeed) Dropped() uint64 {
+	return f.dropped
+}
+
+func (f *ChangeFeed) emit(e ChangeEvent) {
+	if f == nil {
+		return
+	}
+	for _, fn := range f.subscribers {
+		fn(e)
+	}
+	for _, ch := range f.channels {
+		select {
+		case ch <- e:
+		default:
+			f.dropped++
+		}
+	}
+}
+
+// Changes returns the change feed of the array, events are only emitted for mutations made through this Array value
+func (a *Array) Changes() *ChangeFeed {
+	if a.feed == nil {
+		a.feed = &ChangeFeed{}
+	}
+	return a.feed
+}
+
+// Changes returns the change feed of the map, events are only emitted for mutations made through this Map value
+func (a *Map) Changes() *ChangeFeed {
+	if a.feed == nil {
+		a.feed = &ChangeFeed{}
+	}
+	return a.feed
+}
+
+// writeOp returns OpUpdate if an item was replaced and OpInsert otherwise
+func writeOp(replaced bool) ChangeOp {
+	if replaced {
+		return OpUpdate
+	}
+	return OpInsert
+}
+
+// oldValue returns the encoded value of the replaced item, nil if nothing was replaced
+func oldValue(item interface{ Encoded() []byte }, replaced bool) []byte {
+	if !replaced {
+		return nil
+	}
+	return item.Encoded()
+}
+
+// emitWrite emits the structural changes (a split and any rebalancing) followed by the write
+// event, the split segments are part of the segments written by the change
+func (a *Array) emitWrite(structural []ChangeEvent, e ChangeEvent) {
+	for _, s := range structural {
+		a.feed.emit(s)
+		if s.Op == OpSplit {
+			e.Segments = s.Segments
+		}
+	}
+	a.feed.emit(e)
+}
+
+// emitWrite emits the structural changes (a split and any rebalancing) followed by the write
+// event, the split segments are part of the segments written by the change
+func (a *Map) emitWrite(structural []ChangeEvent, e ChangeEvent) {
+	for _, s := range structural {
+		a.feed.emit(s)
+		if s.Op == OpSplit {
+			e.Segments = s.Segments
+		}
+	}
+	a.feed.emit(e)
+}
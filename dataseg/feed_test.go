@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// recordOps subscribes to the feed and counts the events per op
+func recordOps(f *ChangeFeed) map[ChangeOp]int {
+	ops := make(map[ChangeOp]int)
+	f.Subscribe(func(e ChangeEvent) { ops[e.Op]++ })
+	return ops
+}
+
+func TestAppendEmitsEvents(t *testing.T) {
+	aa := NewArray(NewBasicSegmentProvider())
+	ops := recordOps(aa.Changes())
+	for i := 0; i < 20; i++ {
+		if err := aa.AppendByteArrayItem(uint8(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments := len(aa.ArrayMetaSegment().sortedSegHeaders)
+	if ops[OpInsert] != 20 {
+		t.Fatalf("expected 20 insert events got %d", ops[OpInsert])
+	}
+	if ops[OpSplit] != segments-1 {
+		t.Fatalf("expected %d split events for %d segments got %d", segments-1, segments, ops[OpSplit])
+	}
+}
+
+func TestMapEvents(t *testing.T) {
+	mm := NewMap(NewBasicSegmentProvider())
+	events := make([]ChangeEvent, 0)
+	mm.Changes().Subscribe(func(e ChangeEvent) { events = append(events, e) })
+	mm.Insert(StringMapItem{"A", "1"})
+	mm.Insert(StringMapItem{"A", "2"})
+	mm.Remove("A")
+	mm.Remove("A")
+	want := []ChangeEvent{
+		{Op: OpInsert, Key: "A", New: []byte("1")},
+		{Op: OpUpdate, Key: "A", Old: []byte("1"), New: []byte("2")},
+		{Op: OpRemove, Key: "A", Old: []byte("2")},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("expected %d events got %v", len(want), events)
+	}
+	for i, e := range events {
+		w := want[i]
+		if e.Op != w.Op || e.Key != w.Key || !bytes.Equal(e.Old, w.Old) || !bytes.Equal(e.New, w.New) {
+			t.Errorf("event %d: got %+v want %+v", i, e, w)
+		}
+	}
+}
+
+func TestDequePopsEmitEvents(t *testing.T) {
+	dq := NewDeque(NewBasicSegmentProvider())
+	ops := recordOps(dq.array.Changes())
+	for i := 0; i < 10; i++ {
+		dq.PushBack([]byte{byte(i)})
+		dq.PushFront([]byte{byte(100 + i)})
+	}
+	for i := 0; i < 10; i++ {
+		if _, ok, err := dq.PopFront(); !ok || err != nil {
+			t.Fatalf("pop front %d: %v %v", i, ok, err)
+		}
+		v, ok, err := dq.PopBack()
+		if !ok || err != nil || !bytes.Equal(v, []byte{byte(9 - i)}) {
+			t.Fatalf("pop back %d: got %v %v %v", i, v, ok, err)
+		}
+		if c := dq.array.Check(); len(c) > 0 {
+			t.Fatalf("deque is not consistent: %v", c)
+		}
+	}
+	if ops[OpRemove] != 20 {
+		t.Fatalf("expected 20 remove events got %d", ops[OpRemove])
+	}
+	if ops[OpMerge] == 0 {
+		t.Fatal("draining the deque emitted no merge events")
+	}
+	if _, ok, _ := dq.PopBack(); ok {
+		t.Fatal("pop from an empty deque")
+	}
+}
+
+func ExampleChangeFeed() {
+	sp := NewBasicSegmentProvider()
+	mm := NewMap(sp)
+	mm.Changes().Subscribe(func(e ChangeEvent) {
+		fmt.Println(e.Op, e.Key, string(e.Old), string(e.New), len(e.Segments))
+	})
+	// a channel subscriber that isn't read drops the events that don't fit its buffer
+	events := mm.Changes().SubscribeChan(2)
+	mm.Insert(StringMapItem{"A", "AAAA"})
+	mm.Insert(StringMapItem{"B", "BBB"})
+	mm.Insert(StringMapItem{"A", "AAAAA"})
+	mm.Insert(StringMapItem{"C", "CC"})
+	mm.Insert(StringMapItem{"D", "DDDD"})
+	mm.Remove("D")
+	fmt.Println(len(events), mm.Changes().Dropped())
+	// Output:
+	// insert A  AAAA 1
+	// insert B  BBB 1
+	// update A AAAA AAAAA 1
+	// insert C  CC 1
+	// insert D  DDDD 1
+	// remove D DDDD  1
+	// 2 4
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const segmentFileExt = ".seg"
+
+// FileSegmentProvider keeps every segment in its own file inside a directory, files are named after
+// the segment id. Writes go to a temporary file that is renamed into place, so a crash leaves either
+// the old or the new version of a segment. Failed reads and writes are reported through Err.
+type FileSegmentProvider struct {
+	dir string
+	err error
+}
+
+// OpenFileSegmentProvider opens the store in dir, creating the directory if needed. The ids found
+// in the directory are reserved so new segments never overwrite existing ones.
+func OpenFileSegmentProvider(dir string) (*FileSegmentProvider, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	p := &FileSegmentProvider{dir: dir}
+	ids, err := p.listIDs()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		reserveSegmentID(id)
+	}
+	return p, nil
+}
+
+func (p *FileSegmentProvider) path(id SegmentID) string {
+	return filepath.Join(p.dir, strconv.FormatUint(uint64(id), 10)+segmentFileExt)
+}
+
+func (p *FileSegmentProvider) setErr(err error) {
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// GetSegment returns nil if the segment doesn't exist or can't be read
+func (p *FileSegmentProvider) GetSegment(id SegmentID) Segment {
+	data, err := os.ReadFile(p.path(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		p.setErr(err)
+		return nil
+	}
+	seg, err := DecodeSegment(id, data)
+	if err != nil {
+		p.setErr(err)
+		return nil
+	}
+	return seg
+}
+
+func (p *FileSegmentProvider) AddSegment(seg Segment) {
+	if err := p.write(seg.ID(), seg.Encoded()); err != nil {
+		p.setErr(fmt.Errorf("segment %d: %w", seg.ID(), err))
+	}
+}
+
+func (p *FileSegmentProvider) write(id SegmentID, data []byte) error {
+	f, err := os.CreateTemp(p.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p.path(id))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (p *FileSegmentProvider) RemoveSegment(seg Segment) {
+	if err := os.Remove(p.path(seg.ID())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		p.setErr(err)
+	}
+}
+
+// SegmentIDs returns the ids of all segment files in ascending order
+func (p *FileSegmentProvider) SegmentIDs() []SegmentID {
+	ids, err := p.listIDs()
+	if err != nil {
+		p.setErr(err)
+	}
+	return ids
+}
+
+func (p *FileSegmentProvider) listIDs() ([]SegmentID, error) {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]SegmentID, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentFileExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentFileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, SegmentID(id))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// Err returns the first failed read or write since the last call and clears it
+func (p *FileSegmentProvider) Err() error {
+	err := p.err
+	p.err = nil
+	return err
+}
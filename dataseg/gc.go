@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// segmentReferrer is implemented by segments that point to other segments (e.g. meta segments)
+type segmentReferrer interface {
+	References() []SegmentID
+}
+
+// GCReport describes the outcome of a garbage collection run
+type GCReport struct {
+	DryRun    bool
+	Reachable int         // number of segments reachable from the roots
+	Removed   []SegmentID // unreachable segments, deleted unless DryRun is set
+	Missing   []SegmentID // referenced segments that are not in the provider, nothing is removed if there are any
+}
+
+// markReachable walks all segments referenced from the roots and returns the set of visited ids,
+// references to segments that are not in the provider are returned separately. The error is the
+// first segment that is in the provider but can't be read (e.g. it fails its checksum), the segments
+// it references are not visited.
+func markReachable(sp SegmentProvider, roots []SegmentID) (map[SegmentID]bool, []SegmentID, error) {
+	marked := make(map[SegmentID]bool)
+	missing := make([]SegmentID, 0)
+	var readErr error
+	stack := append([]SegmentID{}, roots...)
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if marked[id] {
+			continue
+		}
+		seg, err := loadSegment(sp, id)
+		if errors.Is(err, ErrSegmentNotFound) {
+			missing = append(missing, id)
+			continue
+		}
+		if err != nil {
+			if readErr == nil {
+				readErr = err
+			}
+			continue
+		}
+		marked[id] = true
+		if r, ok := seg.(segmentReferrer); ok {
+			stack = append(stack, r.References()...)
+		}
+	}
+	return marked, missing, readErr
+}
+
+// CollectGarbage removes every segment that is not reachable from the given root meta segments
+// (e.g. Array.metaSegmentID or Map.metaSegmentID), with dryRun nothing is removed and
+// the report lists what would have been deleted.
+//
+// The provider has to implement SegmentLister. As a safety measure nothing is swept if one of the
+// roots can't be found, a wrong root id would otherwise wipe the whole collection. For the same reason
+// nothing is swept, not even in a dry run, if a referenced segment is missing or can't be read, as the
+// segments below it can't be marked. The report then lists what was marked and what is missing.
+func CollectGarbage(sp SegmentProvider, roots []SegmentID, dryRun bool) (GCReport, error) {
+	lister, ok := sp.(SegmentLister)
+	if !ok {
+		return GCReport{}, fmt.Errorf("segment provider %T can't list its segments", sp)
+	}
+	for _, root := range roots {
+		if _, err := loadSegment(sp, root); errors.Is(err, ErrSegmentNotFound) {
+			return GCReport{}, fmt.Errorf("root segment %d not found", root)
+		} else if err != nil {
+			return GCReport{}, fmt.Errorf("root segment %d: %w", root, err)
+		}
+	}
+
+	marked, missing, err := markReachable(sp, roots)
+	report := GCReport{
+		DryRun:    dryRun,
+		Reachable: len(marked),
+		Removed:   make([]SegmentID, 0),
+		Missing:   missing,
+	}
+	if err != nil {
+		return report, fmt.Errorf("marking reachable segments: %w", err)
+	}
+	if len(missing) > 0 {
+		return report, fmt.Errorf("segments %v are referenced but missing", missing)
+	}
+	for _, id := range lister.SegmentIDs() {
+		if !marked[id] {
+			report.Removed = append(report.Removed, id)
+		}
+	}
+	sort.Slice(report.Removed, func(i, j int) bool { return report.Removed[i] < report.Removed[j] })
+	if dryRun {
+		return report, nil
+	}
+	for _, id := range report.Removed {
+		if seg := sp.GetSegment(id); seg != nil {
+			sp.RemoveSegment(seg)
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+// fillArray inserts n ByteArrayItems, enough for a few segments
+func fillArray(t *testing.T, aa *Array, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := aa.Insert(ByteArrayItem{uint32(i), byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCollectGarbageRemovesUnreachable(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	kept, dropped := NewArray(sp), NewArray(sp)
+	fillArray(t, kept, 20)
+	fillArray(t, dropped, 20)
+	orphans := append(dropped.ArrayMetaSegment().References(), dropped.metaSegmentID)
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i] < orphans[j] })
+	total := len(sp.SegmentIDs())
+
+	report, err := CollectGarbage(sp, []SegmentID{kept.metaSegmentID}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalIDs(report.Removed, orphans) || len(sp.SegmentIDs()) != total {
+		t.Fatalf("dry run should list %v and keep everything, got %v", orphans, report.Removed)
+	}
+
+	report, err = CollectGarbage(sp, []SegmentID{kept.metaSegmentID}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalIDs(report.Removed, orphans) || report.Reachable != total-len(orphans) || len(report.Missing) > 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if len(sp.SegmentIDs()) != report.Reachable {
+		t.Fatalf("expected %d segments left got %d", report.Reachable, len(sp.SegmentIDs()))
+	}
+	if v := kept.Check(); len(v) > 0 {
+		t.Fatalf("kept array is damaged: %v", v)
+	}
+}
+
+func TestCollectGarbageKeepsNestedCollections(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	parent := NewMap(sp)
+	child, err := parent.NewChildArray("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillArray(t, child, 5)
+	report, err := CollectGarbage(sp, []SegmentID{parent.metaSegmentID}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Removed) > 0 {
+		t.Fatalf("expected nothing to be removed got %v", report.Removed)
+	}
+}
+
+func TestCollectGarbageRefusesUnknownRoot(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	fillArray(t, NewArray(sp), 5)
+	total := len(sp.SegmentIDs())
+	if _, err := CollectGarbage(sp, []SegmentID{SegmentID(1 << 40)}, false); err == nil {
+		t.Fatal("expected an error for an unknown root")
+	}
+	if len(sp.SegmentIDs()) != total {
+		t.Fatal("nothing should be removed for an unknown root")
+	}
+}
+
+func TestCollectGarbageReportsMissing(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	aa := NewArray(sp)
+	fillArray(t, aa, 20)
+	lost := aa.ArrayMetaSegment().sortedSegHeaders[0].segID
+	sp.RemoveSegment(sp.GetSegment(lost))
+	// the segments below a missing one can't be marked, so nothing is swept
+	unreachable := NewArray(sp).metaSegmentID
+	report, err := CollectGarbage(sp, []SegmentID{aa.metaSegmentID}, false)
+	if err == nil {
+		t.Fatal("expected an error for a missing segment")
+	}
+	if !equalIDs(report.Missing, []SegmentID{lost}) {
+		t.Fatalf("expected %d to be missing got %v", lost, report.Missing)
+	}
+	if len(report.Removed) > 0 || sp.GetSegment(unreachable) == nil {
+		t.Fatalf("expected nothing to be removed got %v", report.Removed)
+	}
+}
+
+func TestCollectGarbageRefusesCorruptSegment(t *testing.T) {
+	sp := NewByteSegmentProvider(false)
+	mm := NewMap(sp)
+	child, err := mm.NewChildMap("K")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Insert(StringMapItem{"A", "AAA"}); err != nil {
+		t.Fatal(err)
+	}
+	before := len(sp.SegmentIDs())
+	sp.segments[child.metaSegmentID][1] ^= 1
+	if _, err := CollectGarbage(sp, []SegmentID{mm.metaSegmentID}, false); err == nil {
+		t.Fatal("expected an error for a corrupt segment")
+	}
+	if got := len(sp.SegmentIDs()); got != before {
+		t.Fatalf("expected %d segments to be kept got %d", before, got)
+	}
+}
+
+func equalIDs(a, b []SegmentID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func ExampleCollectGarbage() {
+	sp := NewBasicSegmentProvider()
+	mm := NewMap(sp)
+	mm.Insert(StringMapItem{"A", "AAAA"})
+	mm.Insert(StringMapItem{"B", "BBB"})
+	// an array that nobody keeps a reference to
+	aa := NewArray(sp)
+	aa.AppendByteArrayItem(1)
+	report, err := CollectGarbage(sp, []SegmentID{mm.metaSegmentID}, true)
+	fmt.Println("dry run", report.Reachable, len(report.Removed), err)
+	report, err = CollectGarbage(sp, []SegmentID{mm.metaSegmentID}, false)
+	fmt.Println("sweep", report.Reachable, len(report.Removed), err)
+	fmt.Println(sp.GetSegment(aa.metaSegmentID) == nil)
+	// Output:
+	// dry run 2 2 <nil>
+	// sweep 2 2 <nil>
+	// true
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// IndexExtractor returns the secondary key of an item, items it returns false for are not indexed
+type IndexExtractor func(item MapItem) (key string, ok bool)
+
+// secondaryIndex maps secondary keys to the primary keys of the items having them
+type secondaryIndex struct {
+	extract IndexExtractor
+	entries *MultiMap
+}
+
+// AddIndex creates a secondary index stored in the same provider as the map, the index is built
+// from the current items and then kept up to date by every Insert and Remove on this Map value.
+// An index entry holds the secondary and the primary key, items whose entry doesn't fit maxItemSize
+// are rejected by Insert with ErrItemTooLarge.
+// The index is recorded in the map meta segment, so it is kept by CollectGarbage and snapshots.
+// It returns the meta segment id of the index.
+func (a *Map) AddIndex(name string, extract IndexExtractor) (SegmentID, error) {
+	if _, ok := a.indexes[name]; ok {
+		return 0, fmt.Errorf("index %q already exists", name)
+	}
+	idx := &secondaryIndex{extract: extract, entries: NewMultiMap(a.sp)}
+	it := a.Iterator()
+	for it.Next() {
+		if err := idx.add(it.Item()); err != nil {
+			dropCollection(a.sp, idx.entries.MetaSegmentID())
+			return 0, fmt.Errorf("building index %q: %w", name, err)
+		}
+	}
+	if err := a.recordIndex(name, idx.entries.MetaSegmentID()); err != nil {
+		dropCollection(a.sp, idx.entries.MetaSegmentID())
+		return 0, fmt.Errorf("recording index %q: %w", name, err)
+	}
+	a.attach(name, idx)
+	return idx.entries.MetaSegmentID(), nil
+}
+
+// AttachIndex registers an index previously created with AddIndex, the extractor has to be the same.
+// Extractors can't be stored, so indexes have to be attached again after FetchMap.
+func (a *Map) AttachIndex(name string, metaSegmentID SegmentID, extract IndexExtractor) error {
+	if err := a.recordIndex(name, metaSegmentID); err != nil {
+		return fmt.Errorf("recording index %q: %w", name, err)
+	}
+	a.attach(name, &secondaryIndex{extract: extract, entries: FetchMultiMap(metaSegmentID, a.sp)})
+	return nil
+}
+
+// IndexRoots returns the meta segment ids of the indexes recorded for the map by name
+func (a *Map) IndexRoots() map[string]SegmentID {
+	res := make(map[string]SegmentID)
+	for _, idx := range a.MapMetaSegment().indexes {
+		res[idx.name] = idx.metaID
+	}
+	return res
+}
+
+// recordIndex writes the index root to the map meta segment unless it is already there
+func (a *Map) recordIndex(name string, metaSegmentID SegmentID) error {
+	return a.apply(func() error {
+		mseg, err := a.metaSegment()
+		if err != nil {
+			return err
+		}
+		for _, idx := range mseg.indexes {
+			if idx.name == name && idx.metaID == metaSegmentID {
+				return nil
+			}
+		}
+		mseg.setIndex(name, metaSegmentID)
+		a.sp.AddSegment(mseg)
+		return nil
+	})
+}
+
+func (a *Map) attach(name string, idx *secondaryIndex) {
+	if a.indexes == nil {
+		a.indexes = make(map[string]*secondaryIndex)
+	}
+	a.indexes[name] = idx
+}
+
+// DropIndex stops maintaining the index and removes its segments
+func (a *Map) DropIndex(name string) error {
+	idx, ok := a.indexes[name]
+	if !ok {
+		return nil
+	}
+	err := a.apply(func() error {
+		mseg, err := a.metaSegment()
+		if err != nil {
+			return err
+		}
+		if mseg.removeIndex(name) {
+			a.sp.AddSegment(mseg)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("dropping index %q: %w", name, err)
+	}
+	delete(a.indexes, name)
+	dropCollection(a.sp, idx.entries.MetaSegmentID())
+	return nil
+}
+
+// LookupBy returns the items whose secondary key in the given index is key, ordered by primary key
+func (a *Map) LookupBy(name string, key string) ([]MapItem, error) {
+	idx, ok := a.indexes[name]
+	if !ok {
+		return nil, fmt.Errorf("index %q not found", name)
+	}
+	res := make([]MapItem, 0)
+	primaryKeys := idx.entries.GetAll(key)
+	for primaryKeys.Next() {
+		item, found := a.Get(primaryKeys.Value())
+		if !found {
+			return res, fmt.Errorf("index %q points to missing key %q", name, primaryKeys.Value())
+		}
+		res = append(res, item)
+	}
+	if err := primaryKeys.Err(); err != nil {
+		return res, fmt.Errorf("reading index %q: %w", name, err)
+	}
+	return res, nil
+}
+
+// Err returns the first segment read that failed since the last call and clears it,
+// reads like Get can't return an error, so it is kept here
+func (a *Map) Err() error {
+	err := a.err
+	a.err = nil
+	return err
+}
+
+// indexNames returns the names of the attached indexes in order, so they are updated in the same order every time
+func (a *Map) indexNames() []string {
+	names := make([]string, 0, len(a.indexes))
+	for name := range a.indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkIndexes returns ErrItemTooLarge if an index entry of item doesn't fit, it is called before
+// the item is written so an item that can't be indexed isn't stored either
+func (a *Map) checkIndexes(item MapItem) error {
+	for _, name := range a.indexNames() {
+		key, ok := a.indexes[name].extract(item)
+		if !ok {
+			continue
+		}
+		if entry := (SetItem{EncodeTuple(key, item.Key())}); entry.Size() > maxItemSize {
+			return fmt.Errorf("index %q entry %q of key %q: %w", name, key, item.Key(), ErrItemTooLarge)
+		}
+	}
+	return nil
+}
+
+// updateIndexes replaces the index entries of old (if hadOld) with the ones of new (if not nil). It is
+// called inside the apply of the operation and writes through a.sp, so the index entries are part of
+// the same batch as the item and a failed update rejects the whole operation.
+func (a *Map) updateIndexes(old MapItem, hadOld bool, new MapItem) error {
+	for _, name := range a.indexNames() {
+		idx := a.indexes[name]
+		err := idx.withProvider(a.sp, func() error {
+			if hadOld {
+				if err := idx.remove(old); err != nil {
+					return err
+				}
+			}
+			if new == nil {
+				return nil
+			}
+			return idx.add(new)
+		})
+		if err != nil {
+			return fmt.Errorf("updating index %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// withProvider runs fn with the index entries reading and writing through sp
+func (idx *secondaryIndex) withProvider(sp SegmentProvider, fn func() error) error {
+	orig := idx.entries.m.sp
+	idx.entries.m.sp = sp
+	defer func() { idx.entries.m.sp = orig }()
+	return fn()
+}
+
+func (idx *secondaryIndex) add(item MapItem) error {
+	key, ok := idx.extract(item)
+	if !ok {
+		return nil
+	}
+	return idx.entries.Add(key, item.Key())
+}
+
+func (idx *secondaryIndex) remove(item MapItem) error {
+	key, ok := idx.extract(item)
+	if !ok {
+		return nil
+	}
+	return idx.entries.RemoveValue(key, item.Key())
+}
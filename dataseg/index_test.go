@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func cityOf(item MapItem) (string, bool) {
+	return string(item.Encoded()), true
+}
+
+func lookupKeys(t *testing.T, mm *Map, name, key string) []string {
+	t.Helper()
+	items, err := mm.LookupBy(name, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = item.Key()
+	}
+	return keys
+}
+
+func newIndexedMap(t *testing.T, sp SegmentProvider) *Map {
+	t.Helper()
+	people := NewMap(sp)
+	for i, city := range []string{"N", "S", "N", "E", "N", "S", "E", "N", "S", "N", "E", "N"} {
+		if err := people.Insert(StringMapItem{string(rune('A' + i)), city}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := people.AddIndex("city", cityOf); err != nil {
+		t.Fatal(err)
+	}
+	return people
+}
+
+func TestIndexSurvivesGarbageCollection(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	people := newIndexedMap(t, sp)
+	report, err := CollectGarbage(sp, []SegmentID{people.metaSegmentID}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Removed) != 0 {
+		t.Fatalf("garbage collection removed %v", report.Removed)
+	}
+	people.Insert(StringMapItem{"M", "S"})
+	if got := lookupKeys(t, people, "city", "S"); len(got) != 4 {
+		t.Fatalf("unexpected lookup result %v", got)
+	}
+
+	if err := people.DropIndex("city"); err != nil {
+		t.Fatal(err)
+	}
+	if len(people.IndexRoots()) != 0 {
+		t.Fatalf("dropped index is still recorded %v", people.IndexRoots())
+	}
+	report, err = CollectGarbage(sp, []SegmentID{people.metaSegmentID}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Removed) != 0 {
+		t.Fatalf("dropped index left segments %v", report.Removed)
+	}
+}
+
+func TestIndexIsPartOfSnapshot(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	people := newIndexedMap(t, sp)
+	var buf bytes.Buffer
+	if _, err := WriteSnapshot(&buf, sp, []SegmentID{people.metaSegmentID}); err != nil {
+		t.Fatal(err)
+	}
+	restoredSp := NewBasicSegmentProvider()
+	if _, err := RestoreSnapshot(&buf, restoredSp); err != nil {
+		t.Fatal(err)
+	}
+	restored := FetchMap(people.metaSegmentID, restoredSp)
+	root, ok := restored.IndexRoots()["city"]
+	if !ok {
+		t.Fatal("index root was not restored")
+	}
+	if err := restored.AttachIndex("city", root, cityOf); err != nil {
+		t.Fatal(err)
+	}
+	if got := lookupKeys(t, restored, "city", "E"); len(got) != 3 || got[0] != "D" || got[1] != "G" || got[2] != "K" {
+		t.Fatalf("unexpected lookup result %v", got)
+	}
+}
+
+func TestAddIndexTwice(t *testing.T) {
+	people := newIndexedMap(t, NewBasicSegmentProvider())
+	if _, err := people.AddIndex("city", cityOf); err == nil {
+		t.Fatal("expected an error for a duplicate index")
+	}
+}
+
+func TestIndexRejectsEntryThatDoesNotFit(t *testing.T) {
+	people := newIndexedMap(t, NewBasicSegmentProvider())
+	// the entry holds both keys and the tuple encoding, a 2 char primary key doesn't fit
+	if err := people.Insert(StringMapItem{"AB", "N"}); !errors.Is(err, ErrItemTooLarge) {
+		t.Fatalf("expected ErrItemTooLarge got %v", err)
+	}
+	if _, found := people.Get("AB"); found {
+		t.Fatal("rejected item was stored")
+	}
+	if got := lookupKeys(t, people, "city", "N"); len(got) != 6 {
+		t.Fatalf("unexpected lookup result %v", got)
+	}
+}
+
+func TestIndexUpdateIsPartOfTheBatch(t *testing.T) {
+	initial := func(item MapItem) (string, bool) { return string(item.Encoded()[:1]), true }
+	// every quota rejects a different write, some of them are index writes
+	for extra := uint64(10); extra <= 200; extra += 10 {
+		ledger := NewStorageLedger(NewBasicSegmentProvider())
+		mm := NewMap(ledger.Owner("bob"))
+		if _, err := mm.AddIndex("initial", initial); err != nil {
+			t.Fatal(err)
+		}
+		quota := ledger.Usage("bob") + extra
+		ledger.SetQuota("bob", quota)
+		inserted, _ := fillUntilRejected(t, mm)
+		got := lookupKeys(t, mm, "initial", "X")
+		if len(got) != len(inserted) {
+			t.Fatalf("quota %d: inserted %v but the index holds %v", quota, inserted, got)
+		}
+		for i := range got {
+			if got[i] != inserted[i] {
+				t.Fatalf("quota %d: inserted %v but the index holds %v", quota, inserted, got)
+			}
+		}
+	}
+}
+
+func ExampleMap_AddIndex() {
+	sp := NewBasicSegmentProvider()
+	people := NewMap(sp)
+	people.Insert(StringMapItem{"1", "N"})
+	people.Insert(StringMapItem{"2", "S"})
+	_, err := people.AddIndex("city", func(item MapItem) (string, bool) {
+		return string(item.Encoded()), true
+	})
+	fmt.Println(err)
+	people.Insert(StringMapItem{"3", "N"})
+	people.Insert(StringMapItem{"2", "N"})
+	people.Remove("1")
+	for _, city := range []string{"N", "S"} {
+		items, err := people.LookupBy("city", city)
+		keys := make([]string, len(items))
+		for i, item := range items {
+			keys[i] = item.Key()
+		}
+		fmt.Println(city, keys, err)
+	}
+	// Output:
+	// <nil>
+	// N [2 3] <nil>
+	// S [] <nil>
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// MapIterator walks the items of a map in key order, segments are loaded one at a time.
+// The map must not be modified while iterating. Iterating stops at a segment that can't be read,
+// the error is reported by Err (and by the Err method of the map).
+type MapIterator struct {
+	m        *Map
+	headers  []MapSegmentHeader
+	segIndex int
+	seg      *MapSegment
+	pos      int
+	started  bool
+	err      error
+	record   bool // failed reads are recorded in the Err of the map too
+}
+
+// Iterator returns an iterator positioned before the first item of the map
+func (a *Map) Iterator() *MapIterator {
+	return a.Seek("")
+}
+
+// Seek returns an iterator positioned before the first item with a key larger than or equal to key
+func (a *Map) Seek(key string) *MapIterator {
+	it := a.seek(key)
+	it.record = true
+	if it.err != nil {
+		a.setErr(it.err)
+	}
+	return it
+}
+
+// seek is Seek for callers that check the Err of the iterator, failed reads are not recorded in the map
+func (a *Map) seek(key string) *MapIterator {
+	mseg, err := a.metaSegment()
+	if err != nil {
+		return &MapIterator{m: a, seg: NewMapSegment(0), err: err}
+	}
+	it := &MapIterator{
+		m:        a,
+		headers:  mseg.sortedSegHeaders,
+		segIndex: mseg.segmentIndex(key),
+	}
+	seg, err := a.segment(it.headers[it.segIndex].segID)
+	if err != nil {
+		it.seg, it.segIndex, it.err = NewMapSegment(0), len(it.headers), err
+		return it
+	}
+	it.seg = seg
+	it.pos = sort.SearchStrings(it.seg.keys, key)
+	return it
+}
+
+// Next moves to the next item and reports whether there is one
+func (it *MapIterator) Next() bool {
+	if it.started {
+		it.pos++
+	}
+	it.started = true
+	for it.pos >= len(it.seg.keys) {
+		if it.segIndex+1 >= len(it.headers) {
+			return false
+		}
+		it.segIndex++
+		seg, err := it.m.segment(it.headers[it.segIndex].segID)
+		if err != nil {
+			if it.record {
+				it.m.setErr(err)
+			}
+			it.segIndex, it.err = len(it.headers), err
+			return false
+		}
+		it.seg = seg
+		it.pos = 0
+	}
+	return true
+}
+
+// Item returns the current item, only valid after Next returned true
+func (it *MapIterator) Item() MapItem {
+	return it.seg.lookup[it.seg.keys[it.pos]]
+}
+
+// Err returns the error that stopped the iteration, nil if all items were visited
+func (it *MapIterator) Err() error {
+	return it.err
+}
+
+// SegmentID returns the id of the segment holding the current item
+func (it *MapIterator) SegmentID() SegmentID {
+	return it.seg.id
+}
+
+// Scan calls fn for every item with from <= key < to in key order, an empty to means no upper bound,
+// scanning stops when fn returns false
+func (a *Map) Scan(from, to string, fn func(MapItem) bool) {
+	it := a.Seek(from)
+	for it.Next() {
+		item := it.Item()
+		if to != "" && item.Key() >= to {
+			return
+		}
+		if !fn(item) {
+			return
+		}
+	}
+}
+
+// ScanPrefix calls fn for every item whose key starts with prefix in key order,
+// scanning stops when fn returns false
+func (a *Map) ScanPrefix(prefix string, fn func(MapItem) bool) {
+	it := a.Seek(prefix)
+	for it.Next() {
+		item := it.Item()
+		if !strings.HasPrefix(item.Key(), prefix) || !fn(item) {
+			return
+		}
+	}
+}
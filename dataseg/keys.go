@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Order preserving key encodings, the encoded keys compare (as go strings) in the same order as the
+// original values, so maps keyed by them iterate and scan in the natural order of the values.
+//
+// The key counts towards the item size, so with maxItemSize at 6 only the 4 byte codecs leave room
+// for a value (up to 2 bytes). Keys of the 8 byte codecs (Uint64, Int64, Time) and tuples, which add
+// 2 bytes per part, are always rejected with ErrItemTooLarge until maxItemSize is raised.
+
+// Uint32KeyCodec encodes unsigned integers as 4 bytes big endian
+type Uint32KeyCodec struct{}
+
+func (Uint32KeyCodec) EncodeKey(k uint32) string {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], k)
+	return string(buf[:])
+}
+
+func (Uint32KeyCodec) DecodeKey(s string) (uint32, error) {
+	if len(s) != 4 {
+		return 0, fmt.Errorf("invalid uint32 key length %d", len(s))
+	}
+	return binary.BigEndian.Uint32([]byte(s)), nil
+}
+
+// Uint64KeyCodec encodes unsigned integers as 8 bytes big endian
+type Uint64KeyCodec struct{}
+
+func (Uint64KeyCodec) EncodeKey(k uint64) string {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], k)
+	return string(buf[:])
+}
+
+func (Uint64KeyCodec) DecodeKey(s string) (uint64, error) {
+	if len(s) != 8 {
+		return 0, fmt.Errorf("invalid uint64 key length %d", len(s))
+	}
+	return binary.BigEndian.Uint64([]byte(s)), nil
+}
+
+// Int32KeyCodec encodes signed integers as 4 bytes big endian with the sign bit flipped,
+// so negative values sort before positive ones
+type Int32KeyCodec struct{}
+
+func (Int32KeyCodec) EncodeKey(k int32) string {
+	return Uint32KeyCodec{}.EncodeKey(uint32(k) ^ (1 << 31))
+}
+
+func (Int32KeyCodec) DecodeKey(s string) (int32, error) {
+	u, err := Uint32KeyCodec{}.DecodeKey(s)
+	return int32(u ^ (1 << 31)), err
+}
+
+// Int64KeyCodec encodes signed integers as 8 bytes big endian with the sign bit flipped,
+// so negative values sort before positive ones
+type Int64KeyCodec struct{}
+
+func (Int64KeyCodec) EncodeKey(k int64) string {
+	return Uint64KeyCodec{}.EncodeKey(uint64(k) ^ (1 << 63))
+}
+
+func (Int64KeyCodec) DecodeKey(s string) (int64, error) {
+	u, err := Uint64KeyCodec{}.DecodeKey(s)
+	return int64(u ^ (1 << 63)), err
+}
+
+// TimeKeyCodec encodes timestamps as signed unix nanoseconds, decoded times are in UTC
+type TimeKeyCodec struct{}
+
+func (TimeKeyCodec) EncodeKey(k time.Time) string {
+	return Int64KeyCodec{}.EncodeKey(k.UnixNano())
+}
+
+func (TimeKeyCodec) DecodeKey(s string) (time.Time, error) {
+	ns, err := Int64KeyCodec{}.DecodeKey(s)
+	return time.Unix(0, ns).UTC(), err
+}
+
+const (
+	tupleEscape     byte = 0x00
+	tupleEscapedNul byte = 0xFF // 0x00 inside a part is written as 0x00 0xFF
+	tupleTerminator byte = 0x01 // every part ends with 0x00 0x01
+)
+
+// EncodeTuple encodes a composite key, tuples compare part by part and a tuple sorts before any
+// longer tuple it is a prefix of. The encoding of a prefix of parts is also a byte prefix of the
+// full encoding, so EncodeTuple(a) can be used to scan every key starting with part a.
+func EncodeTuple(parts ...string) string {
+	res := make([]byte, 0)
+	for _, p := range parts {
+		for i := 0; i < len(p); i++ {
+			if p[i] == tupleEscape {
+				res = append(res, tupleEscape, tupleEscapedNul)
+				continue
+			}
+			res = append(res, p[i])
+		}
+		res = append(res, tupleEscape, tupleTerminator)
+	}
+	return string(res)
+}
+
+// DecodeTuple splits a key produced by EncodeTuple into its parts
+func DecodeTuple(s string) ([]string, error) {
+	parts := make([]string, 0)
+	part := make([]byte, 0)
+	for i := 0; i < len(s); i++ {
+		if s[i] != tupleEscape {
+			part = append(part, s[i])
+			continue
+		}
+		if i+1 >= len(s) {
+			return nil, fmt.Errorf("truncated tuple key %q", s)
+		}
+		i++
+		switch s[i] {
+		case tupleEscapedNul:
+			part = append(part, tupleEscape)
+		case tupleTerminator:
+			parts = append(parts, string(part))
+			part = make([]byte, 0)
+		default:
+			return nil, fmt.Errorf("invalid escape in tuple key %q", s)
+		}
+	}
+	if len(part) > 0 {
+		return nil, fmt.Errorf("unterminated tuple key %q", s)
+	}
+	return parts, nil
+}
+
+// Pair is a two part composite key
+type Pair[A any, B any] struct {
+	First  A
+	Second B
+}
+
+// PairKeyCodec encodes pairs as tuples of the encoded parts, pairs sort by First and then by Second
+type PairKeyCodec[A any, B any] struct {
+	First  KeyCodec[A]
+	Second KeyCodec[B]
+}
+
+func (c PairKeyCodec[A, B]) EncodeKey(k Pair[A, B]) string {
+	return EncodeTuple(c.First.EncodeKey(k.First), c.Second.EncodeKey(k.Second))
+}
+
+func (c PairKeyCodec[A, B]) DecodeKey(s string) (k Pair[A, B], err error) {
+	parts, err := DecodeTuple(s)
+	if err != nil {
+		return k, err
+	}
+	if len(parts) != 2 {
+		return k, fmt.Errorf("expected 2 parts in pair key, got %d", len(parts))
+	}
+	if k.First, err = c.First.DecodeKey(parts[0]); err != nil {
+		return k, err
+	}
+	k.Second, err = c.Second.DecodeKey(parts[1])
+	return k, err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestKeyCodecsPreserveOrder(t *testing.T) {
+	i64 := Int64KeyCodec{}
+	values := []int64{-1 << 63, -5, -1, 0, 1, 7, 1<<63 - 1}
+	for i := 1; i < len(values); i++ {
+		if i64.EncodeKey(values[i-1]) >= i64.EncodeKey(values[i]) {
+			t.Fatalf("%d doesn't sort before %d", values[i-1], values[i])
+		}
+	}
+	for _, v := range values {
+		if got, err := i64.DecodeKey(i64.EncodeKey(v)); err != nil || got != v {
+			t.Fatalf("expected %d got %d (%v)", v, got, err)
+		}
+	}
+	if EncodeTuple("a") >= EncodeTuple("a", "") || EncodeTuple("a", "b") >= EncodeTuple("a\x00") {
+		t.Fatal("tuples don't sort part by part")
+	}
+	parts, err := DecodeTuple(EncodeTuple("x\x00y", ""))
+	if err != nil || len(parts) != 2 || parts[0] != "x\x00y" || parts[1] != "" {
+		t.Fatalf("unexpected tuple parts %q (%v)", parts, err)
+	}
+}
+
+// TestKeyCodecsInMap inserts a key of each codec with a single byte value, only the 4 byte codecs fit
+func TestKeyCodecsInMap(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	value := []byte{1}
+	for _, tc := range []struct {
+		name string
+		put  func() error
+		fits bool
+	}{
+		{"uint32", func() error { return NewTypedMap[uint32, []byte](sp, Uint32KeyCodec{}, BytesCodec{}).Put(7, value) }, true},
+		{"int32", func() error { return NewTypedMap[int32, []byte](sp, Int32KeyCodec{}, BytesCodec{}).Put(-7, value) }, true},
+		{"uint64", func() error { return NewTypedMap[uint64, []byte](sp, Uint64KeyCodec{}, BytesCodec{}).Put(7, value) }, false},
+		{"int64", func() error { return NewTypedMap[int64, []byte](sp, Int64KeyCodec{}, BytesCodec{}).Put(-7, value) }, false},
+		{"time", func() error {
+			return NewTypedMap[time.Time, []byte](sp, TimeKeyCodec{}, BytesCodec{}).Put(time.Unix(7, 0), value)
+		}, false},
+		{"pair", func() error {
+			codec := PairKeyCodec[uint32, uint32]{Uint32KeyCodec{}, Uint32KeyCodec{}}
+			return NewTypedMap[Pair[uint32, uint32], []byte](sp, codec, BytesCodec{}).Put(Pair[uint32, uint32]{1, 2}, value)
+		}, false},
+	} {
+		err := tc.put()
+		if tc.fits && err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if !tc.fits && !errors.Is(err, ErrItemTooLarge) {
+			t.Errorf("%s: expected ErrItemTooLarge got %v", tc.name, err)
+		}
+	}
+
+	m := NewTypedMap[uint32, []byte](sp, Uint32KeyCodec{}, BytesCodec{})
+	for _, k := range []uint32{300, 2, 1 << 20} {
+		if err := m.Put(k, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Put(5, []byte{1, 2, 3}); !errors.Is(err, ErrItemTooLarge) {
+		t.Fatalf("expected ErrItemTooLarge for a 3 byte value got %v", err)
+	}
+	keys := make([]uint32, 0)
+	it := m.Map().Iterator()
+	for it.Next() {
+		k, err := Uint32KeyCodec{}.DecodeKey(it.Item().Key())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) != 3 || keys[0] != 2 || keys[1] != 300 || keys[2] != 1<<20 {
+		t.Fatalf("expected keys in numeric order got %v", keys)
+	}
+}
+
+func ExampleInt32KeyCodec() {
+	sp := NewBasicSegmentProvider()
+	mm := NewTypedMap[int32, string](sp, Int32KeyCodec{}, StringCodec{})
+	for i, k := range []int32{-5, 3, -1, 100, 0, 7, -300} {
+		mm.Put(k, string(rune('a'+i)))
+	}
+	mm.Range(-10, 50, func(k int32, v string) bool {
+		fmt.Println(k, v)
+		return true
+	})
+	parts, err := DecodeTuple(EncodeTuple("user", "a\x00b"))
+	fmt.Printf("%q %v\n", parts, err)
+	// Output:
+	// -5 a
+	// -1 c
+	// 0 e
+	// 3 b
+	// 7 f
+	// ["user" "a\x00b"] <nil>
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// CollectionLayout describes how a collection is split into segments, it is meant for debugging
+// fragmentation and can be written as JSON or as a Graphviz DOT graph
+type CollectionLayout struct {
+	Type          string          `json:"type"` // "map" or "array"
+	MetaSegmentID SegmentID       `json:"metaSegmentId"`
+	Size          uint32          `json:"size"`
+	MinThreshold  uint32          `json:"minThreshold"`
+	MaxThreshold  uint32          `json:"maxThreshold"`
+	Segments      []SegmentLayout `json:"segments"` // in header order
+}
+
+// SegmentLayout describes a single segment of a collection as seen from the meta segment
+type SegmentLayout struct {
+	ID         SegmentID `json:"id"`
+	FirstKey   *string   `json:"firstKey,omitempty"`   // header boundary of map segments
+	StartIndex *uint32   `json:"startIndex,omitempty"` // header boundary of array segments
+	Items      int       `json:"items"`
+	Size       uint32    `json:"size"` // size recorded in the header
+	Fill       float64   `json:"fill"` // size relative to maxThreshold
+	BelowMin   bool      `json:"belowMin,omitempty"`
+	AboveMax   bool      `json:"aboveMax,omitempty"`
+	Missing    bool      `json:"missing,omitempty"` // the segment is not in the provider
+}
+
+func newSegmentLayout(id SegmentID, size uint32) SegmentLayout {
+	return SegmentLayout{
+		ID:       id,
+		Size:     size,
+		Fill:     float64(size) / maxThreshold,
+		BelowMin: size < minThreshold,
+		AboveMax: size > maxThreshold,
+	}
+}
+
+// Layout returns the segment layout of the map
+func (a *Map) Layout() CollectionLayout {
+	mseg := a.MapMetaSegment()
+	res := CollectionLayout{Type: "map", MetaSegmentID: mseg.id, Size: mseg.size, MinThreshold: minThreshold, MaxThreshold: maxThreshold}
+	for _, h := range mseg.sortedSegHeaders {
+		sl := newSegmentLayout(h.segID, h.size)
+		firstKey := h.firstKey
+		sl.FirstKey = &firstKey
+		if seg, ok := a.sp.GetSegment(h.segID).(*MapSegment); ok {
+			sl.Items = len(seg.keys)
+		} else {
+			sl.Missing = true
+		}
+		res.Segments = append(res.Segments, sl)
+	}
+	return res
+}
+
+// Layout returns the segment layout of the array
+func (a *Array) Layout() CollectionLayout {
+	mseg := a.ArrayMetaSegment()
+	res := CollectionLayout{Type: "array", MetaSegmentID: mseg.id, Size: mseg.size, MinThreshold: minThreshold, MaxThreshold: maxThreshold}
+	for _, h := range mseg.sortedSegHeaders {
+		sl := newSegmentLayout(h.segID, h.size)
+		startIndex := h.startIndex
+		sl.StartIndex = &startIndex
+		if seg, ok := a.sp.GetSegment(h.segID).(*ArraySegment); ok {
+			sl.Items = len(seg.elements)
+		} else {
+			sl.Missing = true
+		}
+		res.Segments = append(res.Segments, sl)
+	}
+	return res
+}
+
+// WriteJSON writes the layout as an indented JSON document
+func (l CollectionLayout) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(l)
+}
+
+// boundary returns the header boundary of a segment as shown in DOT labels
+func (s SegmentLayout) boundary() string {
+	if s.FirstKey != nil {
+		return fmt.Sprintf("key %q", *s.FirstKey)
+	}
+	if s.StartIndex != nil {
+		return fmt.Sprintf("index %d", *s.StartIndex)
+	}
+	return ""
+}
+
+// color marks segments outside of the thresholds
+func (s SegmentLayout) color() string {
+	switch {
+	case s.Missing || s.AboveMax:
+		return "tomato"
+	case s.BelowMin:
+		return "lightblue"
+	}
+	return "palegreen"
+}
+
+// dotEscape escapes a string for a double quoted DOT label
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// WriteDOT writes the layout as a Graphviz graph, the meta segment points to its segments in header
+// order, segments below minThreshold are blue, above maxThreshold or missing red, the others green
+func (l CollectionLayout) WriteDOT(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %s_%d {\n", l.Type, l.MetaSegmentID)
+	b.WriteString("  rankdir=TB;\n  node [shape=box, style=filled, fontname=monospace];\n")
+	fmt.Fprintf(&b, "  meta [label=\"%s meta %d\\n%d segments, %d bytes\\nthresholds %d..%d\", fillcolor=lightgray];\n",
+		l.Type, l.MetaSegmentID, len(l.Segments), l.Size, l.MinThreshold, l.MaxThreshold)
+	b.WriteString("  { rank=same;")
+	for _, s := range l.Segments {
+		fmt.Fprintf(&b, " seg%d;", s.ID)
+	}
+	b.WriteString(" }\n")
+	for i, s := range l.Segments {
+		status := fmt.Sprintf("%d items", s.Items)
+		if s.Missing {
+			status = "missing"
+		}
+		label := fmt.Sprintf("segment %d\n%s\n%s, %d/%d bytes (%.0f%%)", s.ID, s.boundary(), status, s.Size, l.MaxThreshold, s.Fill*100)
+		fmt.Fprintf(&b, "  seg%d [label=\"%s\", fillcolor=%s];\n", s.ID, dotEscape(label), s.color())
+		fmt.Fprintf(&b, "  meta -> seg%d [label=\"%d\"];\n", s.ID, i)
+		if i > 0 {
+			// keeps the segments in header order
+			fmt.Fprintf(&b, "  seg%d -> seg%d [style=invis];\n", l.Segments[i-1].ID, s.ID)
+		}
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMapLayout(t *testing.T) {
+	mm := splitMap(t)
+	mm.Insert(StringMapItem{`"q`, "v"})
+	l := mm.Layout()
+	headers := mm.MapMetaSegment().sortedSegHeaders
+	if l.Type != "map" || len(l.Segments) != len(headers) {
+		t.Fatalf("expected %d map segments got %d %s segments", len(headers), len(l.Segments), l.Type)
+	}
+	items := 0
+	for i, s := range l.Segments {
+		if s.ID != headers[i].segID || s.FirstKey == nil || *s.FirstKey != headers[i].firstKey || s.StartIndex != nil {
+			t.Fatalf("segment %d doesn't match its header: %+v", i, s)
+		}
+		if s.Fill != float64(s.Size)/maxThreshold || s.Missing {
+			t.Fatalf("unexpected fill of segment %d: %+v", i, s)
+		}
+		items += s.Items
+	}
+	if items != 31 {
+		t.Fatalf("expected 31 items got %d", items)
+	}
+
+	var b bytes.Buffer
+	if err := l.WriteJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+	var decoded CollectionLayout
+	if err := json.Unmarshal(b.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Segments) != len(l.Segments) || *decoded.Segments[0].FirstKey != *l.Segments[0].FirstKey {
+		t.Fatalf("JSON round trip changed the layout: %s", b.String())
+	}
+
+	b.Reset()
+	if err := l.WriteDOT(&b); err != nil {
+		t.Fatal(err)
+	}
+	dot := b.String()
+	for _, s := range l.Segments {
+		if !strings.Contains(dot, fmt.Sprintf("meta -> seg%d ", s.ID)) {
+			t.Fatalf("segment %d has no edge in\n%s", s.ID, dot)
+		}
+	}
+	if !strings.Contains(dot, `key \"\\\"q\"`) {
+		t.Fatalf("expected the quoted key to be escaped in\n%s", dot)
+	}
+}
+
+func TestArrayLayoutMarksMissingSegment(t *testing.T) {
+	aa := NewArray(NewBasicSegmentProvider())
+	fillArray(t, aa, 5)
+	if n := len(aa.ArrayMetaSegment().sortedSegHeaders); n != 2 {
+		t.Fatalf("expected 2 segments got %d", n)
+	}
+	lost := aa.ArrayMetaSegment().sortedSegHeaders[1].segID
+	aa.sp.RemoveSegment(aa.sp.GetSegment(lost))
+	l := aa.Layout()
+	if l.Type != "array" || len(l.Segments) != 2 || l.Segments[1].StartIndex == nil {
+		t.Fatalf("unexpected layout %+v", l)
+	}
+	if !l.Segments[1].Missing || l.Segments[0].Missing {
+		t.Fatal("expected only the removed segment to be missing")
+	}
+	var b bytes.Buffer
+	if err := l.WriteDOT(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), fmt.Sprintf("seg%d [label=\"segment %d\\nindex", lost, lost)) ||
+		!strings.Contains(b.String(), "missing, ") || !strings.Contains(b.String(), "fillcolor=tomato") {
+		t.Fatalf("expected the missing segment to be marked in\n%s", b.String())
+	}
+}
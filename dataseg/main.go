@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 )
 
 const minThreshold = 10
@@ -45,6 +46,7 @@ func arrayExample() {
 	aa.Insert(ByteArrayItem{uint32(4), byte(5)})
 	aa.Print()
 	fmt.Println(aa.ValidateCorrectness([]byte{4, 2, 0, 5, 0}))
+	fmt.Println(aa.Check())
 	fmt.Println("remove several")
 	aa.Remove(1)
 	aa.Remove(2)
@@ -85,15 +87,20 @@ func mapExample() {
 	fmt.Println(mm.Get("A"))
 	mm.Remove("D")
 	mm.Print()
+	fmt.Println(mm.Check())
 }
 
-func main() {
-	// arrayExample()
-	mapExample()
+// examples can be run with the example command
+var examples = map[string]func(){
+	"array": arrayExample,
+	"map":   mapExample,
 }
 
-// TODO add equal functionaity to create a list of values and compare it to an array
-// so we can have test with randomize updates
+func main() {
+	if err := runCLI(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
 
 // TODO add benchmarking on delays
-// add proper testing to each componenet
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"math"
+	"sort"
+	"time"
 )
 
 // another idea to have list with just map augmented
@@ -11,8 +13,8 @@ import (
 // MapItem holds anything that has to be stored in a map
 type MapItem interface {
 	Key() string
-	Encoded() []byte
-	Size() uint32 // including key and value
+	Encoded() []byte // encoded value, the key is stored separately by the segment
+	Size() uint32    // including key and value
 }
 
 // EmptyMapItem is returned when value not found
@@ -29,17 +31,34 @@ type StringMapItem struct {
 }
 
 func (s StringMapItem) Key() string     { return s.key }
-func (s StringMapItem) Encoded() []byte { return []byte{} } // TODO implement this
+func (s StringMapItem) Encoded() []byte { return []byte(s.value) }
 func (s StringMapItem) Size() uint32    { return uint32(len(s.key) + len(s.value)) }
 
+// BytesMapItem is a map item that holds an encoded value
+type BytesMapItem struct {
+	key   string
+	value []byte
+}
+
+func (b BytesMapItem) Key() string     { return b.key }
+func (b BytesMapItem) Encoded() []byte { return b.value }
+func (b BytesMapItem) Size() uint32    { return uint32(len(b.key) + len(b.value)) }
+
 // TODO encode should do sorted keys, we might need to keep sorted keys
 
+// mapRestartInterval is the number of items between restart points of an encoded map segment,
+// keys at restart points are stored in full
+const mapRestartInterval = 4
+
 type MapSegment struct {
 	id        SegmentID
 	totalSize uint32
 	// mask      Mask               // Mask captures valid prefixes for this segment
 	keys   []string           // keeps ordered keys
 	lookup map[string]MapItem // lookup is used for fast lookup for get
+	// lowerBound is the separator chosen when this segment was split off, it is smaller than
+	// or equal to the first key and larger than any key in the previous segment
+	lowerBound string
 }
 
 func NewMapSegment(id SegmentID) *MapSegment {
@@ -77,6 +96,12 @@ func (a *MapSegment) AddItem(s MapItem) {
 	if s.Size() > maxItemSize {
 		return
 	}
+	if len(a.keys) == 0 {
+		a.keys = append(a.keys, s.Key())
+		a.lookup[s.Key()] = s
+		a.updateSize()
+		return
+	}
 	// // this should never happen but lets keep it for sanity check for now
 	// if !a.mask.IsMember(s.Key()) {
 	// 	fmt.Println("NOT A MEMBER !!!!")
@@ -88,22 +113,20 @@ func (a *MapSegment) AddItem(s MapItem) {
 		newKeys := make([]string, 1)
 		newKeys[0] = s.Key()
 		a.keys = append(newKeys, a.keys...)
-		a.totalSize += s.Size()
 		a.lookup[string(s.Key())] = s
+		a.updateSize()
 		return
 	}
 	if s.Key() > a.LastKey() {
 		// append
 		a.keys = append(a.keys, s.Key())
-		a.totalSize += s.Size()
 		a.lookup[string(s.Key())] = s
+		a.updateSize()
 		return
 	}
 	for i, e := range a.keys {
 		// if already exist replace
 		if s.Key() == e {
-			oldSize := a.lookup[string(s.Key())].Size()
-			a.totalSize = a.totalSize - oldSize + s.Size()
 			a.lookup[string(s.Key())] = s
 			break
 		}
@@ -114,12 +137,11 @@ func (a *MapSegment) AddItem(s MapItem) {
 			newKeys[i] = s.Key()
 			copy(newKeys[i+1:], a.keys[i:])
 			a.keys = newKeys
-			a.totalSize += s.Size()
 			a.lookup[string(s.Key())] = s
 			break
 		}
 	}
-
+	a.updateSize()
 }
 
 func (a *MapSegment) RemoveItem(key string) {
@@ -139,38 +161,86 @@ func (a *MapSegment) RemoveItem(key string) {
 				}
 			}
 			a.keys = newKeys
-			oldSize := a.lookup[string(key)].Size()
-			a.totalSize = a.totalSize - oldSize
 			break
 		}
 	}
 	delete(a.lookup, key)
+	a.updateSize()
 }
 
 func (a *MapSegment) Split() (seg2 *MapSegment) {
-	// TODO change this logic to act based on the size of values (if hetro)
+	return a.SplitWithConfig(DefaultSplitConfig())
+}
+
+// SplitWithConfig moves the upper part of the items into a new segment. Among the split points that
+// keep the left part close to c.Bias share of the bytes, it picks the one with the shortest separator
+// key, the separator becomes the lower bound of the new segment and is used in its header.
+func (a *MapSegment) SplitWithConfig(c SplitConfig) (seg2 *MapSegment) {
 	// TODO deal with very large values
-	d := float64(len(a.lookup)) / float64(2)
-	breakPoint := int(math.Ceil(d))
+	breakPoint := a.separatorSplitPoint(a.itemSizes(), c)
 
 	newSeg := NewMapSegment(generateUUID())
-	newSeg.keys = a.keys[breakPoint:len(a.keys)]
+	// copy so appends to either segment don't write into the other one
+	newSeg.keys = append(newSeg.keys, a.keys[breakPoint:]...)
 	for _, e := range newSeg.keys {
 		item := a.lookup[e]
 		newSeg.lookup[e] = item
 		delete(a.lookup, e)
-		a.totalSize = a.totalSize - item.Size()
-		newSeg.totalSize += item.Size()
-
 	}
 
 	// m1, m2 := NewSplitMasks(a.mask, a.LastKey(), newSeg.keys[0])
 	// newSeg.mask = m2
 	// a.mask = m1
-	a.keys = a.keys[:breakPoint]
+	a.keys = a.keys[:breakPoint:breakPoint]
+	a.updateSize()
+	newSeg.updateSize()
+	if len(newSeg.keys) > 0 && len(a.keys) > 0 {
+		newSeg.lowerBound = shortestSeparator(a.LastKey(), newSeg.FirstKey())
+	}
 	return newSeg
 }
 
+// separatorSplitPoint returns the split point with the shortest separator key among the ones whose
+// left part is within c.Window of the balanced split, ties go to the most balanced one. Split points
+// keeping both sides within the thresholds are preferred over any other.
+// Sizes are the full item sizes, both sides are measured front coded on their own.
+func (a *MapSegment) separatorSplitPoint(sizes []uint32, c SplitConfig) int {
+	balanced := balancedSplitPoint(frontCodedSizes(a.keys, sizes), c.Bias)
+	if len(sizes) < 2 {
+		return balanced
+	}
+	left, right := frontCodedSplitSizes(a.keys, sizes, balanced)
+	total := left + right
+	target := c.Bias * float64(total)
+	window := c.Window * float64(total)
+
+	// split points keeping both sides within the thresholds come first, split points outside of
+	// the window are only used if none inside keeps both sides under maxThreshold
+	best := -1
+	bestTier, bestOut, bestSep, bestDist := 0, false, 0, 0.0
+	for bp := 1; bp < len(sizes); bp++ {
+		left, right := frontCodedSplitSizes(a.keys, sizes, bp)
+		tier := splitTier(left, right)
+		if tier == 2 {
+			continue
+		}
+		dist := math.Abs(float64(left) - target)
+		out := dist > window
+		sep := 0
+		if !out {
+			sep = len(shortestSeparator(a.keys[bp-1], a.keys[bp]))
+		}
+		if best < 0 || tier < bestTier || (tier == bestTier && ((bestOut && !out) ||
+			(out == bestOut && (sep < bestSep || (sep == bestSep && dist < bestDist))))) {
+			best, bestTier, bestOut, bestSep, bestDist = bp, tier, out, sep, dist
+		}
+	}
+	if best < 0 {
+		return balanced
+	}
+	return best
+}
+
 func (a *MapSegment) Merge(seg2 *MapSegment) {
 	// if a.mask.index != seg2.mask.index {
 	// 	fmt.Println("Warning merging segments that are not parallel")
@@ -181,36 +251,342 @@ func (a *MapSegment) Merge(seg2 *MapSegment) {
 	for k, v := range seg2.lookup {
 		a.lookup[k] = v
 	}
-	a.totalSize = a.totalSize + seg2.totalSize
+	a.updateSize()
+}
+
+// MergedSize returns the size of the segment that Merge would produce, front coding makes it
+// differ from the sum of both sizes
+func (a *MapSegment) MergedSize(seg2 *MapSegment) uint32 {
+	keys := append(append(make([]string, 0, len(a.keys)+len(seg2.keys)), a.keys...), seg2.keys...)
+	sizes := append(a.itemSizes(), seg2.itemSizes()...)
+	return prefixSize(frontCodedSizes(keys, sizes), len(keys))
+}
+
+// canRebalance reports whether a and its right neighbor can be merged into one segment or have their
+// items redistributed so both end up within the thresholds
+func (a *MapSegment) canRebalance(right *MapSegment) bool {
+	if a.MergedSize(right) <= maxThreshold {
+		return true
+	}
+	keys := append(append(make([]string, 0, len(a.keys)+len(right.keys)), a.keys...), right.keys...)
+	bp, tier := evenFrontCodedSplitPoint(keys, append(a.itemSizes(), right.itemSizes()...))
+	return bp > 0 && tier == 0
+}
+
+// Redistribute moves items between two neighboring segments (a is the left one) so both hold about
+// the same number of bytes, the lower bound of the right segment is moved to the new boundary.
+// Among the split points keeping both sides under maxThreshold it picks the most even one, preferring
+// the ones that keep both sides above minThreshold.
+func (a *MapSegment) Redistribute(right *MapSegment) {
+	all := make([]string, 0, len(a.keys)+len(right.keys))
+	all = append(all, a.keys...)
+	all = append(all, right.keys...)
+	items := make(map[string]MapItem, len(all))
+	sizes := make([]uint32, len(all))
+	for i, k := range all {
+		item, ok := a.lookup[k]
+		if !ok {
+			item = right.lookup[k]
+		}
+		items[k] = item
+		sizes[i] = item.Size()
+	}
+	breakPoint := balancedSplitPoint(frontCodedSizes(all, sizes), 0.5)
+	if bp, _ := evenFrontCodedSplitPoint(all, sizes); bp > 0 {
+		breakPoint = bp
+	}
+
+	a.keys = all[:breakPoint:breakPoint]
+	right.keys = append(make([]string, 0, len(all)-breakPoint), all[breakPoint:]...)
+	a.lookup = make(map[string]MapItem, len(a.keys))
+	for _, k := range a.keys {
+		a.lookup[k] = items[k]
+	}
+	right.lookup = make(map[string]MapItem, len(right.keys))
+	for _, k := range right.keys {
+		right.lookup[k] = items[k]
+	}
+	a.updateSize()
+	right.updateSize()
+	right.lowerBound = shortestSeparator(a.LastKey(), right.FirstKey())
+}
+
+// itemSizes returns the full size of every item in key order
+func (a *MapSegment) itemSizes() []uint32 {
+	sizes := make([]uint32, len(a.keys))
+	for i, k := range a.keys {
+		sizes[i] = a.lookup[k].Size()
+	}
+	return sizes
+}
+
+// updateSize recomputes totalSize, it has to be called after every change of the keys
+// since the size of an item depends on the key before it
+func (a *MapSegment) updateSize() {
+	a.totalSize = prefixSize(frontCodedSizes(a.keys, a.itemSizes()), len(a.keys))
+}
+
+// frontCodedSizes returns the size of each item once its key is front coded, the full size at
+// restart points and otherwise the full size minus the prefix shared with the previous key
+func frontCodedSizes(keys []string, sizes []uint32) []uint32 {
+	res := make([]uint32, len(keys))
+	for i, k := range keys {
+		res[i] = sizes[i]
+		if i%mapRestartInterval != 0 {
+			res[i] -= uint32(sharedPrefixLen(keys[i-1], k))
+		}
+	}
+	return res
+}
+
+// frontCodedSplitSizes returns the sizes of both sides when the keys are split at bp
+// evenFrontCodedSplitPoint returns the most even split point of the keys among the ones keeping both
+// sides under maxThreshold, the ones that also keep both sides above minThreshold come first. It
+// returns 0 if there is none and the tier of the split point (see splitTier).
+func evenFrontCodedSplitPoint(keys []string, sizes []uint32) (breakPoint int, tier int) {
+	bestDiff := -1
+	for bp := 1; bp < len(keys); bp++ {
+		left, right := frontCodedSplitSizes(keys, sizes, bp)
+		t := splitTier(left, right)
+		if t == 2 {
+			continue
+		}
+		diff := int(left) - int(right)
+		if diff < 0 {
+			diff = -diff
+		}
+		if bestDiff < 0 || t < tier || (t == tier && diff < bestDiff) {
+			breakPoint, tier, bestDiff = bp, t, diff
+		}
+	}
+	return breakPoint, tier
+}
+
+func frontCodedSplitSizes(keys []string, sizes []uint32, bp int) (left, right uint32) {
+	left = prefixSize(frontCodedSizes(keys[:bp], sizes[:bp]), bp)
+	right = prefixSize(frontCodedSizes(keys[bp:], sizes[bp:]), len(keys)-bp)
+	return left, right
+}
+
+func sharedPrefixLen(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
 }
 
 func (a MapSegment) ID() SegmentID {
 	return a.id
 }
 
+// Encoded writes the kind, the lower bound, the number of keys, the restart offsets and then the
+// items in key order. Keys are front coded, every item starts with the length of the prefix it
+// shares with the previous key followed by the rest of the key, its flag and its value. Every
+// mapRestartInterval items the shared length is zero and the offset of the item is recorded as
+// a restart point, so a key can be found by binary search over the restart points.
 func (a MapSegment) Encoded() []byte {
-	// TODO implement me
-	return []byte{}
+	entries := make([]byte, 0)
+	restarts := make([]uint32, 0, len(a.keys)/mapRestartInterval+1)
+	for i, k := range a.keys {
+		shared := 0
+		if i%mapRestartInterval == 0 {
+			restarts = append(restarts, uint32(len(entries)))
+		} else {
+			shared = sharedPrefixLen(a.keys[i-1], k)
+		}
+		item := a.lookup[k]
+		entries = appendUvarint(entries, uint64(shared))
+		entries = appendUvarintBytes(entries, []byte(k[shared:]))
+		entries = append(entries, itemFlag(item))
+		entries = appendUvarintBytes(entries, item.Encoded())
+	}
+	res := []byte{segKindMap}
+	res = appendBytes(res, []byte(a.lowerBound))
+	res = appendUint32(res, uint32(len(a.keys)))
+	res = appendUint32(res, uint32(len(restarts)))
+	for _, r := range restarts {
+		res = appendUint32(res, r)
+	}
+	res = append(res, entries...)
+	return sealSegment(res)
 }
 
-func (a MapSegment) Load([]byte) error {
-	// TODO implement me
+// mapEntry reads a front coded item, prev is the key of the previous item
+func (d *decoder) mapEntry(prev string) (key string, flag byte, value []byte) {
+	shared := d.uvarint()
+	suffix := d.uvarintBytes()
+	flag = d.byte()
+	value = d.uvarintBytes()
+	if d.err == nil && shared > uint64(len(prev)) {
+		d.err = &CorruptSegmentError{ID: d.id, Reason: fmt.Sprintf("shared prefix %d is longer than previous key %q", shared, prev)}
+	}
+	if d.err != nil {
+		return "", 0, nil
+	}
+	return prev[:shared] + string(suffix), flag, value
+}
+
+// decodeMapItem creates the item for an encoded value
+func decodeMapItem(id SegmentID, key string, flag byte, value []byte) (MapItem, error) {
+	if flag == itemFlagCollection {
+		kind, metaID, err := decodeCollectionRef(value)
+		if err != nil {
+			return nil, &CorruptSegmentError{ID: id, Reason: err.Error()}
+		}
+		return CollectionMapItem{key, kind, metaID}, nil
+	}
+	return BytesMapItem{key, value}, nil
+}
+
+// mapSegmentBody reads the fields before the items and returns the restart offsets
+func mapSegmentBody(d *decoder) (lowerBound string, n uint32, restarts []uint32) {
+	lowerBound = string(d.bytes())
+	n = d.uint32()
+	r := d.uint32()
+	if d.err == nil && r != (n+mapRestartInterval-1)/mapRestartInterval {
+		d.err = &CorruptSegmentError{ID: d.id, Reason: fmt.Sprintf("%d restart points for %d keys", r, n)}
+	}
+	restarts = make([]uint32, 0)
+	for i := uint32(0); i < r && d.err == nil; i++ {
+		restarts = append(restarts, d.uint32())
+	}
+	return lowerBound, n, restarts
+}
+
+// SearchMapSegment looks up a key directly in an encoded map segment, it binary searches the
+// restart points and only decodes the items of a single restart interval
+func SearchMapSegment(id SegmentID, data []byte, key string) (MapItem, bool, error) {
+	d, err := openSegment(id, data, segKindMap)
+	if err != nil {
+		return EmptyMapItem{}, false, err
+	}
+	_, n, restarts := mapSegmentBody(d)
+	if d.err != nil {
+		return EmptyMapItem{}, false, d.err
+	}
+	entries := d.b
+	at := func(r int) *decoder {
+		if int(restarts[r]) > len(entries) {
+			return &decoder{id: id, err: &CorruptSegmentError{ID: id, Reason: fmt.Sprintf("restart offset %d out of range", restarts[r])}}
+		}
+		return &decoder{id: id, b: entries[restarts[r]:]}
+	}
+	var searchErr error
+	// first restart point with a key larger than the searched one, the key can only be in the interval before
+	r := sort.Search(len(restarts), func(r int) bool {
+		e := at(r)
+		k, _, _ := e.mapEntry("")
+		if e.err != nil {
+			searchErr = e.err
+			return true
+		}
+		return k > key
+	})
+	if searchErr != nil {
+		return EmptyMapItem{}, false, searchErr
+	}
+	if r == 0 {
+		return EmptyMapItem{}, false, nil
+	}
+	e := at(r - 1)
+	prev := ""
+	for i := uint32(r-1) * mapRestartInterval; i < n && i < uint32(r)*mapRestartInterval; i++ {
+		k, flag, value := e.mapEntry(prev)
+		if e.err != nil {
+			return EmptyMapItem{}, false, e.err
+		}
+		if k == key {
+			item, err := decodeMapItem(id, k, flag, value)
+			if err != nil {
+				return EmptyMapItem{}, false, err
+			}
+			return item, true, nil
+		}
+		if k > key {
+			break
+		}
+		prev = k
+	}
+	return EmptyMapItem{}, false, nil
+}
+
+// References returns the meta segment ids of the child collections stored in this segment
+func (a MapSegment) References() []SegmentID {
+	res := make([]SegmentID, 0)
+	for _, k := range a.keys {
+		if ref, ok := a.lookup[k].(collectionRef); ok {
+			res = append(res, ref.ChildMetaSegmentID())
+		}
+	}
+	return res
+}
+
+func (a *MapSegment) Load(data []byte) error {
+	d, err := openSegment(a.id, data, segKindMap)
+	if err != nil {
+		return err
+	}
+	lowerBound, n, restarts := mapSegmentBody(d)
+	entriesLen := len(d.b)
+	keys := make([]string, 0)
+	lookup := make(map[string]MapItem)
+	prev := ""
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		if i%mapRestartInterval == 0 {
+			if offset := uint32(entriesLen - len(d.b)); offset != restarts[i/mapRestartInterval] {
+				return &CorruptSegmentError{ID: a.id, Reason: fmt.Sprintf("restart point %d at offset %d, expected %d", i/mapRestartInterval, offset, restarts[i/mapRestartInterval])}
+			}
+			prev = ""
+		}
+		key, flag, value := d.mapEntry(prev)
+		if d.err != nil {
+			break
+		}
+		if len(keys) > 0 && key <= keys[len(keys)-1] {
+			return &CorruptSegmentError{ID: a.id, Reason: fmt.Sprintf("key %q is not after key %q", key, keys[len(keys)-1])}
+		}
+		item, err := decodeMapItem(a.id, key, flag, value)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		lookup[key] = item
+		prev = key
+	}
+	if err := d.finish(); err != nil {
+		return err
+	}
+	a.lowerBound = lowerBound
+	a.keys = keys
+	a.lookup = lookup
+	a.updateSize()
 	return nil
 }
 
+// HeaderKey returns the key used in the header, the lower bound if there is one and otherwise the first key
+func (a *MapSegment) HeaderKey() string {
+	if a.lowerBound != "" {
+		return a.lowerBound
+	}
+	return a.FirstKey()
+}
+
 func (a *MapSegment) Header() MapSegmentHeader {
 	return MapSegmentHeader{
 		// mask:  a.mask,
-		firstKey: a.FirstKey(),
+		firstKey: a.HeaderKey(),
 		size:     a.totalSize,
+		count:    uint32(len(a.keys)),
 		segID:    a.id,
 	}
 }
 
 type MapSegmentHeader struct {
 	// mask  Mask
-	firstKey string
+	firstKey string // first key or lower bound of the segment
 	size     uint32
+	count    uint32 // number of keys, so stats don't have to load the segment
 	segID    SegmentID
 }
 
@@ -218,25 +594,126 @@ type MapMetaSegment struct {
 	id               SegmentID
 	sortedSegHeaders []MapSegmentHeader
 	size             uint32
+	indexes          []indexRoot // secondary indexes of the map sorted by name
+}
+
+// indexRoot is the meta segment of the MultiMap holding a secondary index
+type indexRoot struct {
+	name   string
+	metaID SegmentID
 }
 
 func (a MapMetaSegment) ID() SegmentID {
 	return a.id
 }
 
+// Encoded writes the kind, the format version, the size, the segment headers and then the index roots
 func (a MapMetaSegment) Encoded() []byte {
-	// TODO implement me
-	return []byte{}
+	res := []byte{segKindMapMetaVersioned, metaFormatVersion}
+	res = appendUint32(res, a.size)
+	res = appendUint32(res, uint32(len(a.sortedSegHeaders)))
+	for _, h := range a.sortedSegHeaders {
+		res = appendBytes(res, []byte(h.firstKey))
+		res = appendUint32(res, h.size)
+		res = appendUint32(res, h.count)
+		res = appendUint64(res, uint64(h.segID))
+	}
+	res = appendUint32(res, uint32(len(a.indexes)))
+	for _, idx := range a.indexes {
+		res = appendBytes(res, []byte(idx.name))
+		res = appendUint64(res, uint64(idx.metaID))
+	}
+	return sealSegment(res)
+}
+
+// References returns the ids of the segments holding the map items and the meta segments of its indexes
+func (a MapMetaSegment) References() []SegmentID {
+	res := make([]SegmentID, 0, len(a.sortedSegHeaders)+len(a.indexes))
+	for _, h := range a.sortedSegHeaders {
+		res = append(res, h.segID)
+	}
+	for _, idx := range a.indexes {
+		res = append(res, idx.metaID)
+	}
+	return res
 }
 
-func (a MapMetaSegment) Load([]byte) error {
-	// TODO implement me
+// setIndex records the meta segment of the named index, replacing the one recorded before
+func (a *MapMetaSegment) setIndex(name string, metaID SegmentID) {
+	i := sort.Search(len(a.indexes), func(i int) bool { return a.indexes[i].name >= name })
+	if i < len(a.indexes) && a.indexes[i].name == name {
+		a.indexes[i].metaID = metaID
+		return
+	}
+	a.indexes = append(a.indexes, indexRoot{})
+	copy(a.indexes[i+1:], a.indexes[i:])
+	a.indexes[i] = indexRoot{name, metaID}
+}
+
+// removeIndex forgets the named index, it returns false if none was recorded
+func (a *MapMetaSegment) removeIndex(name string) bool {
+	for i, idx := range a.indexes {
+		if idx.name == name {
+			a.indexes = append(a.indexes[:i], a.indexes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (a *MapMetaSegment) Load(data []byte) error {
+	d, version, err := openMetaSegment(a.id, data, segKindMapMetaVersioned)
+	if err != nil {
+		return err
+	}
+	size := d.uint32()
+	n := d.uint32()
+	// a map always has a segment, the lookups index the last header
+	if d.err == nil && n == 0 {
+		return &CorruptSegmentError{ID: a.id, Reason: "no segment headers"}
+	}
+	headers := make([]MapSegmentHeader, 0)
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		headers = append(headers, MapSegmentHeader{firstKey: string(d.bytes()), size: d.uint32(), count: d.uint32(), segID: d.segmentID()})
+	}
+	indexes := make([]indexRoot, 0)
+	if version >= 2 {
+		n := d.uint32()
+		for i := uint32(0); i < n && d.err == nil; i++ {
+			indexes = append(indexes, indexRoot{name: string(d.bytes()), metaID: d.segmentID()})
+		}
+	}
+	if err := d.finish(); err != nil {
+		return err
+	}
+	a.size = size
+	a.sortedSegHeaders = headers
+	a.indexes = indexes
 	return nil
 }
 
 type Map struct {
 	metaSegmentID SegmentID
 	sp            SegmentProvider
+	indexes       map[string]*secondaryIndex // secondary indexes maintained on Insert and Remove
+	err           error                      // first failed index update or segment read
+	feed          *ChangeFeed
+	counts        structuralCounts
+	pending       []structuralChange // structural changes of the running operation
+	observer      Observer
+	split         *SplitConfig
+}
+
+// SetSplitConfig sets how full segments of this map are split, the config is not persisted
+func (a *Map) SetSplitConfig(c SplitConfig) {
+	a.split = &c
+}
+
+func (a *Map) splitConfig() SplitConfig {
+	if a.split == nil {
+		return DefaultSplitConfig()
+	}
+	return *a.split
 }
 
 // TODO add keys method and back it up with an array, has functionality should be part of map
@@ -244,7 +721,7 @@ type Map struct {
 
 // Print is intended for debugging purpose only
 func (a *Map) Print() {
-	fmt.Println("============= array ================")
+	fmt.Println("============= map ==================")
 	mseg := a.MapMetaSegment()
 	for _, segH := range mseg.sortedSegHeaders {
 		seg := a.sp.GetSegment(segH.segID)
@@ -270,16 +747,58 @@ func NewMap(sp SegmentProvider) *Map {
 		size:             0,
 	}
 	sp.AddSegment(metaSeg)
-	return &Map{metaSegID, sp}
+	return &Map{metaSegmentID: metaSegID, sp: sp}
 }
 
+// MapMetaSegment returns the meta segment of the map, an empty one if it can't be read (see Err)
 func (a *Map) MapMetaSegment() *MapMetaSegment {
-	return a.sp.GetSegment(a.metaSegmentID).(*MapMetaSegment)
+	mseg, err := a.metaSegment()
+	if err != nil {
+		a.setErr(err)
+		return &MapMetaSegment{id: a.metaSegmentID}
+	}
+	return mseg
+}
+
+// metaSegment returns the meta segment of the map or the reason it can't be read
+func (a *Map) metaSegment() (*MapMetaSegment, error) {
+	seg, err := loadSegment(a.sp, a.metaSegmentID)
+	if err != nil {
+		return nil, err
+	}
+	mseg, ok := seg.(*MapMetaSegment)
+	if !ok {
+		return nil, fmt.Errorf("segment %d is not a map meta segment", a.metaSegmentID)
+	}
+	return mseg, nil
+}
+
+// segment returns the map segment with the given id or the reason it can't be read
+func (a *Map) segment(id SegmentID) (*MapSegment, error) {
+	seg, err := loadSegment(a.sp, id)
+	if err != nil {
+		return nil, err
+	}
+	aseg, ok := seg.(*MapSegment)
+	if !ok {
+		return nil, fmt.Errorf("segment %d is not a map segment", id)
+	}
+	return aseg, nil
+}
+
+func (a *Map) setErr(err error) {
+	if a.err == nil {
+		a.err = err
+	}
 }
 
+// FindSegmentIndex returns the position of the header of the segment holding key,
+// -1 if the meta segment can't be read
 func (a *Map) FindSegmentIndex(key string) int {
-	// TODO optimize this read and pass it as param
-	mseg := a.MapMetaSegment()
+	return a.MapMetaSegment().segmentIndex(key)
+}
+
+func (mseg *MapMetaSegment) segmentIndex(key string) int {
 	for i, segH := range mseg.sortedSegHeaders {
 		if key == segH.firstKey {
 			return i
@@ -295,86 +814,252 @@ func (a *Map) FindSegmentIndex(key string) int {
 	return len(mseg.sortedSegHeaders) - 1
 }
 
-func (a *Map) Insert(inp MapItem) {
+// Insert puts the item under its key, an item larger than maxItemSize is rejected with ErrItemTooLarge.
+// Nothing is changed if the provider rejects the write.
+func (a *Map) Insert(inp MapItem) error {
+	start := time.Now()
 	// TODO handle insert if size of storable is bigger than threshold
-	mseg := a.MapMetaSegment()
-	segIndex := a.FindSegmentIndex(inp.Key())
-	segH := mseg.sortedSegHeaders[segIndex]
-	seg := a.sp.GetSegment(segH.segID)
-	// todo rename aseg
-	aseg := seg.(*MapSegment)
-	oldSize := aseg.totalSize
-	aseg.AddItem(inp)
-
-	if aseg.totalSize > maxThreshold {
-		s2 := aseg.Split()
+	if inp.Size() > maxItemSize {
+		// the segment would drop it, so it must not replace (and drop) a child collection or touch indexes
+		return fmt.Errorf("key %q: %w", inp.Key(), ErrItemTooLarge)
+	}
+	if err := a.checkIndexes(inp); err != nil {
+		return err
+	}
+	var oldItem MapItem
+	var replaced bool
+	var segID SegmentID
+	var structural []ChangeEvent
+	err := a.apply(func() error {
+		mseg, err := a.metaSegment()
+		if err != nil {
+			return err
+		}
+		segIndex := mseg.segmentIndex(inp.Key())
+		// todo rename aseg
+		aseg, err := a.segment(mseg.sortedSegHeaders[segIndex].segID)
+		if err != nil {
+			return err
+		}
+		segID = aseg.id
+		oldItem, replaced = aseg.GetItem(inp.Key())
+		oldSize := aseg.totalSize
+		aseg.AddItem(inp)
+		mseg.size = mseg.size - oldSize + aseg.totalSize
+
 		mseg.sortedSegHeaders[segIndex] = aseg.Header()
-		// last one
-		if segIndex == len(mseg.sortedSegHeaders)-1 {
-			mseg.sortedSegHeaders = append(mseg.sortedSegHeaders, s2.Header())
-		} else {
-			newSortedHeaders := mseg.sortedSegHeaders[:segIndex]
-			newSortedHeaders = append(newSortedHeaders, s2.Header())
-			mseg.sortedSegHeaders = append(newSortedHeaders, mseg.sortedSegHeaders[segIndex:len(mseg.sortedSegHeaders)]...)
+		structural, err = a.splitAndSettle(mseg, segIndex, aseg)
+		if err != nil {
+			return err
 		}
-		a.sp.AddSegment(s2)
+		a.sp.AddSegment(mseg)
+		if replaced {
+			dropReplacedChild(a.sp, oldItem, inp)
+		}
+		return a.updateIndexes(oldItem, replaced, inp)
+	})
+	if err != nil {
+		return err
+	}
+	a.emitWrite(structural, ChangeEvent{Op: writeOp(replaced), Key: inp.Key(), Old: oldValue(oldItem, replaced), New: inp.Encoded(), Segments: []SegmentID{segID}})
+	a.observe("insert", inp.Size(), start)
+	return nil
+}
+
+// splitAndSettle splits the changed segment at segIndex if it went above maxThreshold, stores it and
+// rebalances it and its neighbors, the caller stores the meta segment
+func (a *Map) splitAndSettle(mseg *MapMetaSegment, segIndex int, aseg *MapSegment) ([]ChangeEvent, error) {
+	structural := make([]ChangeEvent, 0)
+	last := segIndex + 1
+	if split := a.splitIfFull(mseg, segIndex, aseg); split != nil {
+		structural = append(structural, *split)
+		last++
 	}
-	mseg.size = mseg.size - oldSize + aseg.totalSize
-	a.sp.AddSegment(mseg)
 	a.sp.AddSegment(aseg)
+	settled, err := a.settle(mseg, segIndex-1, last)
+	if err != nil {
+		return nil, err
+	}
+	return append(structural, settled...), nil
 }
 
-func (a *Map) Get(key string) (res MapItem, found bool) {
-	mseg := a.MapMetaSegment()
-	segIndex := a.FindSegmentIndex(key)
-	segH := mseg.sortedSegHeaders[segIndex]
-	seg := a.sp.GetSegment(segH.segID).(*MapSegment)
-	return seg.GetItem(key)
+// splitIfFull splits the segment at segIndex if it went above maxThreshold and stores the new
+// segment, the caller stores the meta segment and aseg
+func (a *Map) splitIfFull(mseg *MapMetaSegment, segIndex int, aseg *MapSegment) *ChangeEvent {
+	if aseg.totalSize <= maxThreshold {
+		return nil
+	}
+	before := aseg.totalSize
+	start := time.Now()
+	s2 := aseg.SplitWithConfig(a.splitConfig())
+	// with front coding the sizes of both halves don't add up to the size before the split
+	mseg.size = mseg.size - before + aseg.totalSize + s2.totalSize
+	mseg.sortedSegHeaders[segIndex] = aseg.Header()
+	newSortedHeaders := make([]MapSegmentHeader, 0, len(mseg.sortedSegHeaders)+1)
+	newSortedHeaders = append(newSortedHeaders, mseg.sortedSegHeaders[:segIndex+1]...)
+	newSortedHeaders = append(newSortedHeaders, s2.Header())
+	mseg.sortedSegHeaders = append(newSortedHeaders, mseg.sortedSegHeaders[segIndex+1:]...)
+	a.sp.AddSegment(s2)
+	a.structural(OpSplit, aseg.totalSize+s2.totalSize, start)
+	return &ChangeEvent{Op: OpSplit, Segments: []SegmentID{aseg.id, s2.id}}
 }
 
-func (a *Map) Remove(key string) {
-	mseg := a.MapMetaSegment()
-	segIndex := a.FindSegmentIndex(key)
-	segH := mseg.sortedSegHeaders[segIndex]
-	seg := a.sp.GetSegment(segH.segID)
-	aseg := seg.(*MapSegment)
-	oldSize := aseg.totalSize
-	aseg.RemoveItem(key)
-	mseg.size = mseg.size - oldSize + aseg.totalSize
-	if aseg.totalSize < minThreshold {
-		if len(mseg.sortedSegHeaders) > 1 { // if only one segment don't merge
-			if segIndex%2 == 0 { // even segment
-				nextSeg := a.sp.GetSegment(mseg.sortedSegHeaders[segIndex+1].segID).(*MapSegment)
-				if nextSeg.totalSize+aseg.totalSize <= maxThreshold {
-					aseg.Merge(nextSeg)
-					newSortedHeaders := mseg.sortedSegHeaders[:segIndex+1]
-					newSortedHeaders[segIndex] = aseg.Header()
-					if len(mseg.sortedSegHeaders) > segIndex+2 {
-						newSortedHeaders = append(newSortedHeaders, mseg.sortedSegHeaders[segIndex+2:]...)
-					}
-					mseg.sortedSegHeaders = newSortedHeaders
-					a.sp.RemoveSegment(nextSeg)
-					a.sp.AddSegment(aseg)
-					a.sp.AddSegment(mseg)
-				}
-			} else { // odd segment
-				prevSeg := a.sp.GetSegment(mseg.sortedSegHeaders[segIndex-1].segID).(*MapSegment)
-				if prevSeg.totalSize+aseg.totalSize <= maxThreshold {
-					prevSeg.Merge(aseg)
-					newSortedHeaders := mseg.sortedSegHeaders[:segIndex]
-					newSortedHeaders[segIndex-1] = prevSeg.Header()
-					if len(mseg.sortedSegHeaders) > segIndex+1 {
-						newSortedHeaders = append(newSortedHeaders, mseg.sortedSegHeaders[segIndex+1:]...)
-					}
-					mseg.sortedSegHeaders = newSortedHeaders
-					a.sp.RemoveSegment(aseg)
-					a.sp.AddSegment(prevSeg)
-					a.sp.AddSegment(mseg)
-				}
-			}
-			return
+// Get returns the item under key, a segment that can't be read is reported as not found (see Err)
+func (a *Map) Get(key string) (MapItem, bool) {
+	res, found, err := a.get(key)
+	if err != nil {
+		a.setErr(err)
+	}
+	return res, found
+}
+
+// get is Get that returns a failed read instead of recording it in the map
+func (a *Map) get(key string) (res MapItem, found bool, err error) {
+	defer func(start time.Time) {
+		size := uint32(0)
+		if found {
+			size = res.Size()
 		}
+		a.observe("get", size, start)
+	}(time.Now())
+	mseg, err := a.metaSegment()
+	if err != nil {
+		return nil, false, err
 	}
-	a.sp.AddSegment(mseg)
-	a.sp.AddSegment(aseg)
+	seg, err := a.segment(mseg.sortedSegHeaders[mseg.segmentIndex(key)].segID)
+	if err != nil {
+		return nil, false, err
+	}
+	res, found = seg.GetItem(key)
+	return res, found, nil
+}
+
+// Remove deletes the item under key, removing a missing key is not an error. Nothing is changed
+// if the provider rejects the write.
+func (a *Map) Remove(key string) error {
+	start := time.Now()
+	var oldItem MapItem
+	var found bool
+	var segID SegmentID
+	var structural []ChangeEvent
+	err := a.apply(func() error {
+		mseg, err := a.metaSegment()
+		if err != nil {
+			return err
+		}
+		segIndex := mseg.segmentIndex(key)
+		aseg, err := a.segment(mseg.sortedSegHeaders[segIndex].segID)
+		if err != nil {
+			return err
+		}
+		segID = aseg.id
+		oldItem, found = aseg.GetItem(key)
+		oldSize := aseg.totalSize
+		aseg.RemoveItem(key)
+		mseg.size = mseg.size - oldSize + aseg.totalSize
+		mseg.sortedSegHeaders[segIndex] = aseg.Header()
+		// removing a key moves the restart points of the keys after it, which can make the segment larger
+		structural, err = a.splitAndSettle(mseg, segIndex, aseg)
+		if err != nil {
+			return err
+		}
+		a.sp.AddSegment(mseg)
+		if found {
+			// removing a child collection removes all of its segments
+			dropReplacedChild(a.sp, oldItem, nil)
+			return a.updateIndexes(oldItem, true, nil)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range structural {
+		a.feed.emit(e)
+	}
+	if found {
+		a.feed.emit(ChangeEvent{Op: OpRemove, Key: key, Old: oldItem.Encoded(), Segments: []SegmentID{segID}})
+		a.observe("remove", oldItem.Size(), start)
+		return nil
+	}
+	a.observe("remove", 0, start)
+	return nil
+}
+
+// settle rebalances the segments between first and last (header indexes) that are below minThreshold,
+// a segment is merged with or redistributed with a neighbor as long as that brings it within the
+// thresholds. Changed segments have to be stored already, it returns the structural changes.
+func (a *Map) settle(mseg *MapMetaSegment, first, last int) ([]ChangeEvent, error) {
+	events := make([]ChangeEvent, 0)
+	if first < 0 {
+		first = 0
+	}
+	for i := first; i <= last && i < len(mseg.sortedSegHeaders); i++ {
+		if len(mseg.sortedSegHeaders) < 2 || mseg.sortedSegHeaders[i].size >= minThreshold {
+			continue
+		}
+		leftIndex, e, err := a.rebalance(mseg, i)
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			continue
+		}
+		events = append(events, *e)
+		// the rebalanced segments changed, so did the options of their neighbors
+		i = leftIndex - 2
+		if i < -1 {
+			i = -1
+		}
+		if last < leftIndex+2 {
+			last = leftIndex + 2
+		}
+	}
+	return events, nil
+}
+
+// rebalance fixes the segment at segIndex that went below minThreshold using its smaller neighbor
+// or else the other one, the two segments are merged if they fit into one, otherwise the items
+// are redistributed between them. It returns the index of the left segment and the structural change
+// for the change feed, the change is nil if neither neighbor can bring the segment within the thresholds.
+func (a *Map) rebalance(mseg *MapMetaSegment, segIndex int) (leftIndex int, e *ChangeEvent, err error) {
+	start := time.Now()
+	headers := mseg.sortedSegHeaders
+	for _, n := range rebalanceNeighbors(len(headers), segIndex, func(i int) uint32 { return headers[i].size }) {
+		leftIndex = segIndex
+		if n < segIndex {
+			leftIndex = n
+		}
+		left, err := a.segment(headers[leftIndex].segID)
+		if err != nil {
+			return 0, nil, err
+		}
+		right, err := a.segment(headers[leftIndex+1].segID)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !left.canRebalance(right) {
+			continue
+		}
+		before := left.totalSize + right.totalSize
+		if left.MergedSize(right) <= maxThreshold {
+			left.Merge(right)
+			mseg.size = mseg.size - before + left.totalSize
+			headers[leftIndex] = left.Header()
+			mseg.sortedSegHeaders = append(headers[:leftIndex+1], headers[leftIndex+2:]...)
+			a.sp.RemoveSegment(right)
+			a.sp.AddSegment(left)
+			a.structural(OpMerge, left.totalSize, start)
+			return leftIndex, &ChangeEvent{Op: OpMerge, Segments: []SegmentID{left.id, right.id}}, nil
+		}
+		left.Redistribute(right)
+		mseg.size = mseg.size - before + left.totalSize + right.totalSize
+		headers[leftIndex] = left.Header()
+		headers[leftIndex+1] = right.Header()
+		a.sp.AddSegment(left)
+		a.sp.AddSegment(right)
+		a.structural(OpRedistribute, left.totalSize+right.totalSize, start)
+		return leftIndex, &ChangeEvent{Op: OpRedistribute, Segments: []SegmentID{left.id, right.id}}, nil
+	}
+	return segIndex, nil, nil
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Conflict is a key changed differently in both versions of a three-way merge,
+// a removed side has its Removed flag set and a nil value, Base is nil if both sides added the key
+type Conflict struct {
+	Key           string
+	Base          []byte
+	Ours          []byte
+	Theirs        []byte
+	OursRemoved   bool
+	TheirsRemoved bool
+	Resolved      bool // set when a resolver picked the merged value
+}
+
+// Resolution is the merged value picked for a conflict, Remove drops the key from the merged map
+type Resolution struct {
+	Value  []byte
+	Remove bool
+}
+
+// ConflictResolver picks the merged value of a conflict, returning false leaves it unresolved
+type ConflictResolver func(c Conflict) (Resolution, bool)
+
+// OursResolver resolves every conflict by keeping our version
+func OursResolver(c Conflict) (Resolution, bool) {
+	return Resolution{Value: c.Ours, Remove: c.OursRemoved}, true
+}
+
+// TheirsResolver resolves every conflict by taking their version
+func TheirsResolver(c Conflict) (Resolution, bool) {
+	return Resolution{Value: c.Theirs, Remove: c.TheirsRemoved}, true
+}
+
+// MergeMaps does a three-way merge of the map versions ours and theirs that both derive from base,
+// all meta segments have to be in sp. The merged map is a new map in sp that starts as a copy of ours,
+// changes from theirs are applied when ours didn't touch the key. Keys changed differently on both sides
+// are passed to resolve (can be nil), unresolved conflicts keep our value. All conflicts are returned.
+//
+// Child collections are deep copied, so the merged map shares no segments with ours and theirs. A resolved
+// value equal to a side's value keeps that side's item, including its child collection.
+func MergeMaps(sp SegmentProvider, base, ours, theirs SegmentID, resolve ConflictResolver) (*Map, []Conflict, error) {
+	ourChanges := make(map[string]MapDiff)
+	err := DiffMaps(sp, base, ours, func(d MapDiff) bool {
+		ourChanges[d.Key] = d
+		return true
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("diffing ours: %w", err)
+	}
+	theirChanges := make([]MapDiff, 0)
+	err = DiffMaps(sp, base, theirs, func(d MapDiff) bool {
+		theirChanges = append(theirChanges, d)
+		return true
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("diffing theirs: %w", err)
+	}
+
+	merged := NewMap(sp)
+	fail := func(err error) (*Map, []Conflict, error) {
+		dropCollection(sp, merged.metaSegmentID)
+		return nil, nil, fmt.Errorf("writing merged map: %w", err)
+	}
+	insertCopy := func(item MapItem) error {
+		cp, err := copyMapItem(sp, item)
+		if err != nil {
+			return err
+		}
+		if err := merged.Insert(cp); err != nil {
+			dropChild(sp, cp)
+			return err
+		}
+		return nil
+	}
+	it := FetchMap(ours, sp).Iterator()
+	for it.Next() {
+		if err := insertCopy(it.Item()); err != nil {
+			return fail(err)
+		}
+	}
+
+	// their items are read again to copy them with their child collections, the read can still fail
+	// or miss the key if theirs was changed since the diff
+	theirMap := FetchMap(theirs, sp)
+	insertTheirs := func(key string) error {
+		item, found, err := theirMap.get(key)
+		if err != nil {
+			return fmt.Errorf("reading key %q of theirs: %w", key, err)
+		}
+		if !found {
+			return fmt.Errorf("key %q is missing in theirs", key)
+		}
+		return insertCopy(item)
+	}
+	conflicts := make([]Conflict, 0)
+	for _, their := range theirChanges {
+		our, changed := ourChanges[their.Key]
+		if !changed {
+			if their.Kind == DiffRemoved {
+				err = merged.Remove(their.Key)
+			} else {
+				err = insertTheirs(their.Key)
+			}
+			if err != nil {
+				return fail(err)
+			}
+			continue
+		}
+		if sameChange(our, their) {
+			continue
+		}
+		c := Conflict{
+			Key:           their.Key,
+			Base:          their.Old,
+			Ours:          our.New,
+			Theirs:        their.New,
+			OursRemoved:   our.Kind == DiffRemoved,
+			TheirsRemoved: their.Kind == DiffRemoved,
+		}
+		if resolve != nil {
+			if r, ok := resolve(c); ok {
+				c.Resolved = true
+				switch {
+				case r.Remove:
+					err = merged.Remove(c.Key)
+				case !c.OursRemoved && bytes.Equal(r.Value, c.Ours):
+					// the merged map already holds our item
+				case !c.TheirsRemoved && bytes.Equal(r.Value, c.Theirs):
+					err = insertTheirs(c.Key)
+				default:
+					err = merged.Insert(BytesMapItem{c.Key, r.Value})
+				}
+				if err != nil {
+					return fail(err)
+				}
+			}
+		}
+		conflicts = append(conflicts, c)
+	}
+	return merged, conflicts, nil
+}
+
+// sameChange reports whether both sides changed a key to the same result
+func sameChange(a, b MapDiff) bool {
+	if a.Kind == DiffRemoved || b.Kind == DiffRemoved {
+		return a.Kind == b.Kind
+	}
+	return bytes.Equal(a.New, b.New)
+}
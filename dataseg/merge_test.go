@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// mergeVersions creates base, ours and theirs with the same items, ours and theirs hold a child map under "T"
+func mergeVersions(t *testing.T, sp SegmentProvider) (base, ours, theirs *Map) {
+	t.Helper()
+	versions := []*Map{NewMap(sp), NewMap(sp), NewMap(sp)}
+	for _, mm := range versions {
+		for _, k := range []string{"A", "B", "C", "D"} {
+			if err := mm.Insert(StringMapItem{k, k + k}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, mm := range versions[1:] {
+		child, err := mm.NewChildMap("T")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"X", "Y", "Z"} {
+			child.Insert(StringMapItem{k, k})
+		}
+	}
+	return versions[0], versions[1], versions[2]
+}
+
+func mapContent(mm *Map) map[string]string {
+	res := make(map[string]string)
+	it := mm.Iterator()
+	for it.Next() {
+		res[it.Item().Key()] = string(it.Item().Encoded())
+	}
+	return res
+}
+
+func TestMergeCopiesChildCollections(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	base, ours, theirs := mergeVersions(t, sp)
+	ours.Insert(StringMapItem{"A", "A1"})
+	theirs.Insert(StringMapItem{"B", "B2"})
+	theirs.Remove("D")
+	merged, conflicts, err := MergeMaps(sp, base.metaSegmentID, ours.metaSegmentID, theirs.metaSegmentID, TheirsResolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// both sides added a different child under T, their child is copied in
+	if len(conflicts) != 1 || conflicts[0].Key != "T" || !conflicts[0].Resolved {
+		t.Fatalf("unexpected conflicts %+v", conflicts)
+	}
+	child, ok := merged.GetMap("T")
+	if !ok {
+		t.Fatal("resolved child collection lost its type")
+	}
+	theirChild, _ := theirs.GetMap("T")
+	if child.metaSegmentID == theirChild.metaSegmentID {
+		t.Fatal("merged map shares the child collection of theirs")
+	}
+	if got := mapContent(child); len(got) != 3 || got["Y"] != "Y" {
+		t.Fatalf("unexpected child content %v", got)
+	}
+	got := mapContent(merged)
+	if len(got) != 4 || got["A"] != "A1" || got["B"] != "B2" || got["C"] != "CC" {
+		t.Fatalf("unexpected merge result %v", got)
+	}
+
+	if err := merged.Remove("T"); err != nil {
+		t.Fatal(err)
+	}
+	for _, side := range []*Map{ours, theirs} {
+		c, ok := side.GetMap("T")
+		if !ok || len(mapContent(c)) != 3 {
+			t.Fatal("removing the merged child changed a merged version")
+		}
+		if v := side.Check(); len(v) != 0 {
+			t.Fatalf("violations after removing the merged child %v", v)
+		}
+	}
+	roots := []SegmentID{base.metaSegmentID, ours.metaSegmentID, theirs.metaSegmentID, merged.metaSegmentID}
+	report, err := CollectGarbage(sp, roots, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Removed) > 0 || len(report.Missing) > 0 {
+		t.Fatalf("unreachable segments %v, missing segments %v", report.Removed, report.Missing)
+	}
+}
+
+func TestMergeKeepsOurChildOnConflict(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	base, ours, theirs := mergeVersions(t, sp)
+	merged, conflicts, err := MergeMaps(sp, base.metaSegmentID, ours.metaSegmentID, theirs.metaSegmentID, OursResolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 {
+		t.Fatalf("unexpected conflicts %+v", conflicts)
+	}
+	child, ok := merged.GetMap("T")
+	ourChild, _ := ours.GetMap("T")
+	if !ok || child.metaSegmentID == ourChild.metaSegmentID || len(mapContent(child)) != 3 {
+		t.Fatal("our child collection was not copied into the merged map")
+	}
+}
+
+func TestCopyNestedCollection(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	mm := NewMap(sp)
+	arr, err := mm.NewChildArray("L")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 12; i++ {
+		arr.AppendByteArrayItem(uint8(i))
+	}
+	inner, err := mm.NewChildMap("M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner.Insert(StringMapItem{"K", "V"})
+
+	id, err := copyCollection(sp, mm.metaSegmentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := FetchMap(id, sp)
+	if cp.DeepSize() != mm.DeepSize() {
+		t.Fatalf("copy has size %d, the original %d", cp.DeepSize(), mm.DeepSize())
+	}
+	cpArr, _ := cp.GetArray("L")
+	if cpArr.metaSegmentID == arr.metaSegmentID || cpArr.LastIndex() != arr.LastIndex() {
+		t.Fatal("array was not copied")
+	}
+	dropCollection(sp, id)
+	checkReachable(t, sp, mm.metaSegmentID)
+}
+
+// failingReadProvider returns nil for the segment id once the given number of reads of it succeeded
+type failingReadProvider struct {
+	*BasicSegmentProvider
+	id    SegmentID
+	reads int
+}
+
+func (p *failingReadProvider) GetSegment(id SegmentID) Segment {
+	if id == p.id {
+		if p.reads == 0 {
+			return nil
+		}
+		p.reads--
+	}
+	return p.BasicSegmentProvider.GetSegment(id)
+}
+
+func TestMergeReportsFailedReadOfTheirs(t *testing.T) {
+	// every run lets one more read of their changed segment succeed, until the whole merge does
+	for reads := 0; reads < 100; reads++ {
+		sp := &failingReadProvider{BasicSegmentProvider: NewBasicSegmentProvider()}
+		base, ours, theirs := mergeVersions(t, sp)
+		if err := theirs.Insert(StringMapItem{"B", "B2"}); err != nil {
+			t.Fatal(err)
+		}
+		sp.id, sp.reads = theirs.MapMetaSegment().sortedSegHeaders[0].segID, reads
+		merged, _, err := MergeMaps(sp, base.metaSegmentID, ours.metaSegmentID, theirs.metaSegmentID, nil)
+		if err != nil {
+			continue
+		}
+		if got := mapContent(merged)["B"]; got != "B2" {
+			t.Fatalf("expected their change to be merged got %q", got)
+		}
+		return
+	}
+	t.Fatal("merge never succeeded")
+}
+
+func ExampleMergeMaps() {
+	sp := NewBasicSegmentProvider()
+	versions := []*Map{NewMap(sp), NewMap(sp), NewMap(sp)}
+	for _, mm := range versions {
+		for _, k := range []string{"A", "B", "C", "D"} {
+			mm.Insert(StringMapItem{k, k + k})
+		}
+	}
+	base, ours, theirs := versions[0], versions[1], versions[2]
+	ours.Insert(StringMapItem{"A", "A1"})
+	ours.Insert(StringMapItem{"C", "C1"})
+	theirs.Insert(StringMapItem{"B", "B2"})
+	theirs.Insert(StringMapItem{"C", "C2"})
+	theirs.Remove("D")
+	merged, conflicts, err := MergeMaps(sp, base.metaSegmentID, ours.metaSegmentID, theirs.metaSegmentID, nil)
+	for _, c := range conflicts {
+		fmt.Printf("conflict %s base %q ours %q theirs %q\n", c.Key, c.Base, c.Ours, c.Theirs)
+	}
+	fmt.Println(err)
+	items := make([]string, 0)
+	it := merged.Iterator()
+	for it.Next() {
+		items = append(items, fmt.Sprintf("%s=%s", it.Item().Key(), it.Item().Encoded()))
+	}
+	fmt.Println(strings.Join(items, " "))
+	// Output:
+	// conflict C base "CC" ours "C1" theirs "C2"
+	// <nil>
+	// A=A1 B=B2 C=C1
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Observer receives measurements of provider and collection operations, it is called synchronously
+// so implementations have to be cheap. Collections report insert, get and remove with the size of the
+// item, and split, merge and redistribute with the size of the resulting segments.
+type Observer interface {
+	// ObserveSegment is called after a provider operation ("get", "add" or "remove") with the encoded size of the segment
+	ObserveSegment(op string, bytes int, elapsed time.Duration)
+	// ObserveCollection is called after an operation on a "map" or an "array"
+	ObserveCollection(collection string, op string, bytes int, elapsed time.Duration)
+}
+
+// SetObserver reports the operations made through this handle to o, nil disables reporting
+func (a *Map) SetObserver(o Observer) {
+	a.observer = o
+}
+
+func (a *Map) observe(op string, size uint32, start time.Time) {
+	if a.observer != nil {
+		a.observer.ObserveCollection("map", op, int(size), time.Since(start))
+	}
+}
+
+// structural records a split, merge or redistribute, it is counted and reported to the observer
+// once the operation it belongs to is applied
+func (a *Map) structural(op ChangeOp, size uint32, start time.Time) {
+	a.pending = append(a.pending, structuralChange{op, size, time.Since(start)})
+}
+
+// apply runs the segment changes of one operation. If the provider can reject writes the changes are
+// staged and handed over as one batch, so a rejected operation leaves the collection as it was.
+func (a *Map) apply(fn func() error) error {
+	a.pending = a.pending[:0]
+	if err := runBatch(&a.sp, fn); err != nil {
+		a.pending = a.pending[:0]
+		return err
+	}
+	for _, c := range a.pending {
+		a.counts.record(c.op)
+		if a.observer != nil {
+			a.observer.ObserveCollection("map", c.op.String(), int(c.size), c.elapsed)
+		}
+	}
+	a.pending = a.pending[:0]
+	return nil
+}
+
+// SetObserver reports the operations made through this handle to o, nil disables reporting
+func (a *Array) SetObserver(o Observer) {
+	a.observer = o
+}
+
+func (a *Array) observe(op string, size uint32, start time.Time) {
+	if a.observer != nil {
+		a.observer.ObserveCollection("array", op, int(size), time.Since(start))
+	}
+}
+
+// structural records a split, merge or redistribute, it is counted and reported to the observer
+// once the operation it belongs to is applied
+func (a *Array) structural(op ChangeOp, size uint32, start time.Time) {
+	a.pending = append(a.pending, structuralChange{op, size, time.Since(start)})
+}
+
+// apply runs the segment changes of one operation. If the provider can reject writes the changes are
+// staged and handed over as one batch, so a rejected operation leaves the collection as it was.
+func (a *Array) apply(fn func() error) error {
+	a.pending = a.pending[:0]
+	if err := runBatch(&a.sp, fn); err != nil {
+		a.pending = a.pending[:0]
+		return err
+	}
+	for _, c := range a.pending {
+		a.counts.record(c.op)
+		if a.observer != nil {
+			a.observer.ObserveCollection("array", c.op.String(), int(c.size), c.elapsed)
+		}
+	}
+	a.pending = a.pending[:0]
+	return nil
+}
+
+// ObservedSegmentProvider reports every operation of the wrapped provider to an observer,
+// the sizes are taken from Encoded, so they cost an extra encoding per operation
+type ObservedSegmentProvider struct {
+	sp       SegmentProvider
+	observer Observer
+}
+
+func NewObservedSegmentProvider(sp SegmentProvider, o Observer) *ObservedSegmentProvider {
+	return &ObservedSegmentProvider{sp: sp, observer: o}
+}
+
+func (p *ObservedSegmentProvider) GetSegment(id SegmentID) Segment {
+	start := time.Now()
+	seg := p.sp.GetSegment(id)
+	elapsed := time.Since(start)
+	p.observer.ObserveSegment("get", encodedSize(seg), elapsed)
+	return seg
+}
+
+func (p *ObservedSegmentProvider) AddSegment(seg Segment) {
+	start := time.Now()
+	p.sp.AddSegment(seg)
+	elapsed := time.Since(start)
+	p.observer.ObserveSegment("add", encodedSize(seg), elapsed)
+}
+
+func (p *ObservedSegmentProvider) RemoveSegment(seg Segment) {
+	start := time.Now()
+	p.sp.RemoveSegment(seg)
+	elapsed := time.Since(start)
+	p.observer.ObserveSegment("remove", encodedSize(seg), elapsed)
+}
+
+// WriteBatch hands the batch over to the wrapped provider, the segments are reported once the batch is
+// written and the time it took is shared evenly between them
+func (p *ObservedSegmentProvider) WriteBatch(adds []Segment, removes []Segment) error {
+	start := time.Now()
+	if err := writeBatch(p.sp, adds, removes); err != nil {
+		return err
+	}
+	if n := len(adds) + len(removes); n > 0 {
+		elapsed := time.Since(start) / time.Duration(n)
+		for _, seg := range adds {
+			p.observer.ObserveSegment("add", encodedSize(seg), elapsed)
+		}
+		for _, seg := range removes {
+			p.observer.ObserveSegment("remove", encodedSize(seg), elapsed)
+		}
+	}
+	return nil
+}
+
+// Err returns the error of the wrapped provider
+func (p *ObservedSegmentProvider) Err() error {
+	if r, ok := p.sp.(errorReporter); ok {
+		return r.Err()
+	}
+	return nil
+}
+
+// SegmentIDs lists the segments of the wrapped provider, it returns nil if the provider can't list
+func (p *ObservedSegmentProvider) SegmentIDs() []SegmentID {
+	if lister, ok := p.sp.(SegmentLister); ok {
+		return lister.SegmentIDs()
+	}
+	return nil
+}
+
+func encodedSize(seg Segment) int {
+	if seg == nil {
+		return 0
+	}
+	return len(seg.Encoded())
+}
+
+// DefaultLatencyBuckets are the upper bounds in seconds of the latency histograms of a PrometheusObserver
+var DefaultLatencyBuckets = []float64{0.00001, 0.0001, 0.001, 0.01, 0.1, 1}
+
+// PrometheusObserver collects the observed operations as counters and latency histograms and serves
+// them in the Prometheus text exposition format, it can be used from several goroutines
+type PrometheusObserver struct {
+	mu      sync.Mutex
+	buckets []float64
+	series  map[string]*promSeries // by metric prefix and labels
+}
+
+// promSeries holds the operation count, the byte count and the latency histogram of one label set
+type promSeries struct {
+	prefix  string // dataseg_segment or dataseg_collection
+	labels  string // rendered label pairs without braces
+	bytes   uint64
+	counts  []uint64 // per bucket, not cumulative
+	count   uint64
+	seconds float64
+}
+
+// NewPrometheusObserver uses DefaultLatencyBuckets if no buckets are given
+func NewPrometheusObserver(buckets ...float64) *PrometheusObserver {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	return &PrometheusObserver{buckets: buckets, series: make(map[string]*promSeries)}
+}
+
+func (o *PrometheusObserver) ObserveSegment(op string, bytes int, elapsed time.Duration) {
+	o.observe("dataseg_segment", fmt.Sprintf("op=%q", op), bytes, elapsed)
+}
+
+func (o *PrometheusObserver) ObserveCollection(collection string, op string, bytes int, elapsed time.Duration) {
+	o.observe("dataseg_collection", fmt.Sprintf("collection=%q,op=%q", collection, op), bytes, elapsed)
+}
+
+func (o *PrometheusObserver) observe(prefix, labels string, bytes int, elapsed time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	key := prefix + "{" + labels + "}"
+	s, ok := o.series[key]
+	if !ok {
+		s = &promSeries{prefix: prefix, labels: labels, counts: make([]uint64, len(o.buckets))}
+		o.series[key] = s
+	}
+	seconds := elapsed.Seconds()
+	s.count++
+	s.bytes += uint64(bytes)
+	s.seconds += seconds
+	if i := sort.SearchFloat64s(o.buckets, seconds); i < len(o.buckets) {
+		s.counts[i]++
+	}
+}
+
+// WriteTo writes all metrics in the text exposition format
+func (o *PrometheusObserver) WriteTo(w io.Writer) (int64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	byPrefix := make(map[string][]*promSeries)
+	for _, s := range o.series {
+		byPrefix[s.prefix] = append(byPrefix[s.prefix], s)
+	}
+	var b strings.Builder
+	for _, prefix := range []string{"dataseg_segment", "dataseg_collection"} {
+		series := byPrefix[prefix]
+		sort.Slice(series, func(i, j int) bool { return series[i].labels < series[j].labels })
+		what := "segment provider"
+		if prefix == "dataseg_collection" {
+			what = "collection"
+		}
+		fmt.Fprintf(&b, "# HELP %s_operations_total Number of %s operations.\n# TYPE %s_operations_total counter\n", prefix, what, prefix)
+		for _, s := range series {
+			fmt.Fprintf(&b, "%s_operations_total{%s} %d\n", prefix, s.labels, s.count)
+		}
+		fmt.Fprintf(&b, "# HELP %s_bytes_total Bytes handled by %s operations.\n# TYPE %s_bytes_total counter\n", prefix, what, prefix)
+		for _, s := range series {
+			fmt.Fprintf(&b, "%s_bytes_total{%s} %d\n", prefix, s.labels, s.bytes)
+		}
+		fmt.Fprintf(&b, "# HELP %s_duration_seconds Latency of %s operations.\n# TYPE %s_duration_seconds histogram\n", prefix, what, prefix)
+		for _, s := range series {
+			cumulative := uint64(0)
+			for i, le := range o.buckets {
+				cumulative += s.counts[i]
+				fmt.Fprintf(&b, "%s_duration_seconds_bucket{%s,le=\"%g\"} %d\n", prefix, s.labels, le, cumulative)
+			}
+			fmt.Fprintf(&b, "%s_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", prefix, s.labels, s.count)
+			fmt.Fprintf(&b, "%s_duration_seconds_sum{%s} %g\n", prefix, s.labels, s.seconds)
+			fmt.Fprintf(&b, "%s_duration_seconds_count{%s} %d\n", prefix, s.labels, s.count)
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP serves the metrics, mount it on a local listener e.g. http.Handle("/metrics", observer)
+func (o *PrometheusObserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	o.WriteTo(w)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingObserver counts the observed collection operations
+type recordingObserver struct {
+	segments    map[string]int
+	collections map[string]int
+}
+
+func newRecordingObserver() *recordingObserver {
+	return &recordingObserver{segments: make(map[string]int), collections: make(map[string]int)}
+}
+
+func (o *recordingObserver) ObserveSegment(op string, bytes int, elapsed time.Duration) {
+	o.segments[op]++
+}
+
+func (o *recordingObserver) ObserveCollection(collection string, op string, bytes int, elapsed time.Duration) {
+	o.collections[collection+" "+op]++
+}
+
+func TestObserverOnlySeesAppliedOperations(t *testing.T) {
+	ledger := NewStorageLedger(NewBasicSegmentProvider())
+	ledger.SetQuota("o", 120)
+	mm := NewMap(ledger.Owner("o"))
+	o := newRecordingObserver()
+	mm.SetObserver(o)
+	if err := mm.Insert(StringMapItem{"A", "too long"}); err == nil {
+		t.Fatal("oversized item was inserted")
+	}
+	inserted, _ := fillUntilRejected(t, mm)
+	if got := o.collections["map insert"]; got != len(inserted) {
+		t.Fatalf("observed %d inserts, %d were applied", got, len(inserted))
+	}
+	if got, want := o.collections["map split"], mm.Stats().Splits; got != want {
+		t.Fatalf("observed %d splits, %d were applied", got, want)
+	}
+}
+
+func TestObserverSeesEveryArrayWrite(t *testing.T) {
+	dq := NewDeque(NewBasicSegmentProvider())
+	o := newRecordingObserver()
+	dq.array.SetObserver(o)
+	for i := 0; i < 10; i++ {
+		dq.PushBack([]byte{byte(i)})
+	}
+	dq.array.AppendByteArrayItem(10)
+	for dq.Len() > 0 {
+		dq.PopFront()
+	}
+	st := dq.array.Stats()
+	if o.collections["array insert"] != 11 || o.collections["array remove"] != 11 {
+		t.Fatalf("unexpected observations %v", o.collections)
+	}
+	if o.collections["array split"] != st.Splits || o.collections["array merge"] != st.Merges ||
+		o.collections["array redistribute"] != st.Redistributions {
+		t.Fatalf("observations %v don't match the stats %+v", o.collections, st)
+	}
+	if st.Splits == 0 || st.Merges+st.Redistributions == 0 {
+		t.Fatalf("expected structural changes got %+v", st)
+	}
+}
+
+func TestObservedSegmentProvider(t *testing.T) {
+	o := newRecordingObserver()
+	sp := NewObservedSegmentProvider(NewBasicSegmentProvider(), o)
+	mm := NewMap(sp)
+	mm.Insert(StringMapItem{"A", "A"})
+	mm.Remove("A")
+	if o.segments["add"] == 0 || o.segments["get"] == 0 {
+		t.Fatalf("segment operations were not observed %v", o.segments)
+	}
+}
+
+func TestObservedSegmentProviderPassesBatchesThrough(t *testing.T) {
+	ledger := NewStorageLedger(NewBasicSegmentProvider())
+	ledger.SetQuota("o", 120)
+	o := newRecordingObserver()
+	mm := NewMap(NewObservedSegmentProvider(ledger.Owner("o"), o))
+	adds := 0
+	var err error
+	for _, k := range []string{"A", "B", "C", "D", "E", "F", "G", "H"} {
+		adds = o.segments["add"]
+		if err = mm.Insert(StringMapItem{k, "XXXX"}); err != nil {
+			break
+		}
+	}
+	var qe *QuotaExceededError
+	if !errors.As(err, &qe) {
+		t.Fatalf("expected a quota error got %v", err)
+	}
+	if got := o.segments["add"]; got != adds {
+		t.Fatalf("rejected write was observed, %d adds before and %d after", adds, got)
+	}
+	if v := mm.Check(); len(v) > 0 {
+		t.Fatalf("map is not consistent after a rejected write: %v", v)
+	}
+}
+
+func TestObservedSegmentProviderReportsInnerErrors(t *testing.T) {
+	inner := NewByteSegmentProvider(false)
+	sp := NewObservedSegmentProvider(inner, newRecordingObserver())
+	mm := NewMap(sp)
+	inner.segments[mm.metaSegmentID][1] ^= 1
+	if _, err := loadSegment(sp, mm.metaSegmentID); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected the checksum mismatch of the wrapped provider got %v", err)
+	}
+}
+
+func TestPrometheusExposition(t *testing.T) {
+	p := NewPrometheusObserver()
+	aa := NewArray(NewBasicSegmentProvider())
+	aa.SetObserver(p)
+	for i := 0; i < 5; i++ {
+		aa.AppendByteArrayItem(uint8(i))
+	}
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		`dataseg_collection_operations_total{collection="array",op="insert"} 5`,
+		`dataseg_collection_operations_total{collection="array",op="split"} 1`,
+		`dataseg_collection_duration_seconds_bucket{collection="array",op="insert",le="+Inf"} 5`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %q in\n%s", line, body)
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := p.WriteTo(&buf); err != nil || buf.String() != body {
+		t.Fatalf("WriteTo doesn't match the served metrics: %v", err)
+	}
+}
+
+func ExamplePrometheusObserver() {
+	observer := NewPrometheusObserver()
+	sp := NewObservedSegmentProvider(NewByteSegmentProvider(false), observer)
+	mm := NewMap(sp)
+	mm.SetObserver(observer)
+	for _, k := range []string{"A", "B", "C", "D", "E"} {
+		mm.Insert(StringMapItem{k, "XXXX"})
+	}
+	mm.Get("C")
+	mm.Remove("C")
+	mm.Remove("D")
+	// served with http.Handle("/metrics", observer) in a real program, the latencies vary between runs
+	// so only the collection operation counts are printed here
+	var buf bytes.Buffer
+	observer.WriteTo(&buf)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, "dataseg_collection_operations_total") {
+			fmt.Println(line)
+		}
+	}
+	// Output:
+	// dataseg_collection_operations_total{collection="map",op="get"} 1
+	// dataseg_collection_operations_total{collection="map",op="insert"} 5
+	// dataseg_collection_operations_total{collection="map",op="merge"} 1
+	// dataseg_collection_operations_total{collection="map",op="remove"} 2
+	// dataseg_collection_operations_total{collection="map",op="split"} 1
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MultiMap maps a key to a sorted set of values, every (key, value) pair is stored as a single
+// SetItem keyed by EncodeTuple(key, value) so all values of a key are next to each other
+type MultiMap struct {
+	m *Map
+}
+
+func NewMultiMap(sp SegmentProvider) *MultiMap {
+	return &MultiMap{m: NewMap(sp)}
+}
+
+func FetchMultiMap(metaSegmentID SegmentID, sp SegmentProvider) *MultiMap {
+	return &MultiMap{m: FetchMap(metaSegmentID, sp)}
+}
+
+// MetaSegmentID returns the id of the meta segment, used to fetch the multimap again
+func (mm *MultiMap) MetaSegmentID() SegmentID {
+	return mm.m.metaSegmentID
+}
+
+// Err returns the first segment read that failed since the last call, reads stop at such a segment
+func (mm *MultiMap) Err() error {
+	return mm.m.Err()
+}
+
+// Add adds value to the values of key, adding an existing pair is a no-op
+func (mm *MultiMap) Add(key, value string) error {
+	item := SetItem{EncodeTuple(key, value)}
+	if item.Size() > maxItemSize {
+		return fmt.Errorf("key %q value %q: %w", key, value, ErrItemTooLarge)
+	}
+	return mm.m.Insert(item)
+}
+
+// RemoveValue removes a single value of key
+func (mm *MultiMap) RemoveValue(key, value string) error {
+	return mm.m.Remove(EncodeTuple(key, value))
+}
+
+// Contains reports whether value is one of the values of key
+func (mm *MultiMap) Contains(key, value string) bool {
+	_, found := mm.m.Get(EncodeTuple(key, value))
+	return found
+}
+
+// GetAll returns an iterator over the values of key in sorted order
+func (mm *MultiMap) GetAll(key string) *MultiMapIterator {
+	prefix := EncodeTuple(key)
+	return &MultiMapIterator{it: mm.m.Seek(prefix), prefix: prefix}
+}
+
+// Count returns the number of values of key, only the segments whose key range overlaps
+// with the key are read and those are binary searched instead of scanned
+func (mm *MultiMap) Count(key string) int {
+	prefix := EncodeTuple(key)
+	upper := tuplePrefixEnd(prefix)
+	mseg := mm.m.MapMetaSegment()
+	count := 0
+	for i := mseg.segmentIndex(prefix); i >= 0 && i < len(mseg.sortedSegHeaders); i++ {
+		segH := mseg.sortedSegHeaders[i]
+		if segH.firstKey >= upper {
+			break
+		}
+		seg, err := mm.m.segment(segH.segID)
+		if err != nil {
+			mm.m.setErr(err)
+			break
+		}
+		count += sort.SearchStrings(seg.keys, upper) - sort.SearchStrings(seg.keys, prefix)
+	}
+	return count
+}
+
+// tuplePrefixEnd returns the smallest key larger than all keys starting with the encoded tuple prefix,
+// encoded tuples end with the terminator which is replaced by the next byte value
+func tuplePrefixEnd(prefix string) string {
+	return prefix[:len(prefix)-1] + string([]byte{tupleTerminator + 1})
+}
+
+// MultiMapIterator walks the values of a single key
+type MultiMapIterator struct {
+	it     *MapIterator
+	prefix string
+	value  string
+}
+
+// Next moves to the next value and reports whether there is one
+func (v *MultiMapIterator) Next() bool {
+	if !v.it.Next() {
+		return false
+	}
+	encoded := v.it.Item().Key()
+	if !strings.HasPrefix(encoded, v.prefix) {
+		return false
+	}
+	parts, err := DecodeTuple(encoded)
+	if err != nil || len(parts) != 2 {
+		return false
+	}
+	v.value = parts[1]
+	return true
+}
+
+// Value returns the current value, only valid after Next returned true
+func (v *MultiMapIterator) Value() string {
+	return v.value
+}
+
+// Err returns the segment read that stopped the iteration, nil if all values were visited
+func (v *MultiMapIterator) Err() error {
+	return v.it.Err()
+}
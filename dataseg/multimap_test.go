@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func multiMapValues(mm *MultiMap, key string) string {
+	values := make([]string, 0)
+	it := mm.GetAll(key)
+	for it.Next() {
+		values = append(values, it.Value())
+	}
+	return strings.Join(values, ",")
+}
+
+func TestMultiMap(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	mm := NewMultiMap(sp)
+	// every pair takes a whole item, so the values of b span several segments
+	pairs := [][2]string{{"b", "9"}, {"a", "1"}, {"b", "3"}, {"c", "1"}, {"b", "1"}, {"b", "7"}, {"b", "3"}, {"b", "5"}, {"", "x"}}
+	for _, p := range pairs {
+		if err := mm.Add(p[0], p[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mm.Add("b", "10"); !errors.Is(err, ErrItemTooLarge) {
+		t.Fatalf("expected ErrItemTooLarge got %v", err)
+	}
+	if len(mm.m.MapMetaSegment().sortedSegHeaders) < 2 {
+		t.Fatal("expected the multimap to span several segments")
+	}
+
+	mm = FetchMultiMap(mm.MetaSegmentID(), sp)
+	for _, tc := range []struct {
+		key    string
+		values string
+		count  int
+	}{{"", "x", 1}, {"a", "1", 1}, {"b", "1,3,5,7,9", 5}, {"c", "1", 1}, {"d", "", 0}} {
+		if got := multiMapValues(mm, tc.key); got != tc.values {
+			t.Errorf("key %q: expected values %q got %q", tc.key, tc.values, got)
+		}
+		if got := mm.Count(tc.key); got != tc.count {
+			t.Errorf("key %q: expected count %d got %d", tc.key, tc.count, got)
+		}
+	}
+	if err := mm.RemoveValue("b", "5"); err != nil {
+		t.Fatal(err)
+	}
+	if mm.Contains("b", "5") || !mm.Contains("b", "7") || mm.Contains("a", "7") {
+		t.Fatal("unexpected membership after removing a value")
+	}
+	if got := multiMapValues(mm, "b"); got != "1,3,7,9" {
+		t.Fatalf("unexpected values after remove %q", got)
+	}
+	if err := mm.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func ExampleMultiMap() {
+	sp := NewBasicSegmentProvider()
+	mm := NewMultiMap(sp)
+	for _, kv := range [][2]string{{"A", "3"}, {"B", "1"}, {"A", "1"}, {"A", "2"}, {"C", "9"}, {"A", "7"}, {"B", "4"}} {
+		mm.Add(kv[0], kv[1])
+	}
+	mm.RemoveValue("A", "2")
+	values := mm.GetAll("A")
+	for values.Next() {
+		fmt.Println(values.Value())
+	}
+	fmt.Println(mm.Count("A"), mm.Count("B"), mm.Count("D"))
+	// Output:
+	// 1
+	// 3
+	// 7
+	// 3 2 0
+}
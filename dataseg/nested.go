@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// kinds of child collections referenced from a map or array item
+const (
+	collectionKindArray byte = 1
+	collectionKindMap   byte = 2
+)
+
+// collectionRef is implemented by items that point to a child collection
+type collectionRef interface {
+	CollectionKind() byte
+	ChildMetaSegmentID() SegmentID
+}
+
+// encodeCollectionRef writes the kind followed by the child meta segment id as uvarint
+func encodeCollectionRef(kind byte, id SegmentID) []byte {
+	buf := make([]byte, 1+binary.MaxVarintLen64)
+	buf[0] = kind
+	n := binary.PutUvarint(buf[1:], uint64(id))
+	return buf[:1+n]
+}
+
+func decodeCollectionRef(b []byte) (kind byte, id SegmentID, err error) {
+	if len(b) < 2 {
+		return 0, 0, fmt.Errorf("collection reference too short")
+	}
+	v, n := binary.Uvarint(b[1:])
+	if n <= 0 || 1+n != len(b) {
+		return 0, 0, fmt.Errorf("invalid collection reference %x", b)
+	}
+	reserveSegmentID(SegmentID(v))
+	return b[0], SegmentID(v), nil
+}
+
+// CollectionMapItem is a map item whose value is a child Array or Map
+type CollectionMapItem struct {
+	key    string
+	kind   byte
+	metaID SegmentID
+}
+
+func (c CollectionMapItem) Key() string                   { return c.key }
+func (c CollectionMapItem) Encoded() []byte               { return encodeCollectionRef(c.kind, c.metaID) }
+func (c CollectionMapItem) Size() uint32                  { return uint32(len(c.key) + len(c.Encoded())) }
+func (c CollectionMapItem) CollectionKind() byte          { return c.kind }
+func (c CollectionMapItem) ChildMetaSegmentID() SegmentID { return c.metaID }
+
+// CollectionArrayItem is an array item whose value is a child Array or Map
+type CollectionArrayItem struct {
+	index  uint32
+	kind   byte
+	metaID SegmentID
+}
+
+func (c CollectionArrayItem) Index() uint32                 { return c.index }
+func (c CollectionArrayItem) Encoded() []byte               { return encodeCollectionRef(c.kind, c.metaID) }
+func (c CollectionArrayItem) Size() uint32                  { return 4 + uint32(len(c.Encoded())) }
+func (c CollectionArrayItem) CollectionKind() byte          { return c.kind }
+func (c CollectionArrayItem) ChildMetaSegmentID() SegmentID { return c.metaID }
+
+// dropCollection removes every segment of the collection with the given meta segment,
+// including the segments of nested collections
+func dropCollection(sp SegmentProvider, metaSegmentID SegmentID) {
+	marked, _, _ := markReachable(sp, []SegmentID{metaSegmentID})
+	for id := range marked {
+		sp.RemoveSegment(sp.GetSegment(id))
+	}
+}
+
+// dropReplacedChild drops the child collection of old, unless the replacing item points to the same child
+func dropReplacedChild(sp SegmentProvider, old interface{}, replacement interface{}) {
+	oldRef, ok := old.(collectionRef)
+	if !ok {
+		return
+	}
+	if newRef, ok := replacement.(collectionRef); ok && newRef.ChildMetaSegmentID() == oldRef.ChildMetaSegmentID() {
+		return
+	}
+	dropCollection(sp, oldRef.ChildMetaSegmentID())
+}
+
+// NewChildMap creates an empty map stored in the same provider and puts it under key,
+// any collection previously stored under key is dropped
+func (a *Map) NewChildMap(key string) (*Map, error) {
+	child := NewMap(a.sp)
+	if err := a.insertChild(CollectionMapItem{key, collectionKindMap, child.metaSegmentID}); err != nil {
+		dropCollection(a.sp, child.metaSegmentID)
+		return nil, err
+	}
+	return child, nil
+}
+
+// NewChildArray creates an empty array stored in the same provider and puts it under key,
+// any collection previously stored under key is dropped
+func (a *Map) NewChildArray(key string) (*Array, error) {
+	child := NewArray(a.sp)
+	if err := a.insertChild(CollectionMapItem{key, collectionKindArray, child.metaSegmentID}); err != nil {
+		dropCollection(a.sp, child.metaSegmentID)
+		return nil, err
+	}
+	return child, nil
+}
+
+func (a *Map) insertChild(item CollectionMapItem) error {
+	if item.Size() > maxItemSize {
+		return fmt.Errorf("key %q: %w", item.key, ErrItemTooLarge)
+	}
+	return a.Insert(item)
+}
+
+// GetMap returns the child map stored under key
+func (a *Map) GetMap(key string) (*Map, bool) {
+	item, found := a.Get(key)
+	if !found {
+		return nil, false
+	}
+	ref, ok := item.(collectionRef)
+	if !ok || ref.CollectionKind() != collectionKindMap {
+		return nil, false
+	}
+	return FetchMap(ref.ChildMetaSegmentID(), a.sp), true
+}
+
+// GetArray returns the child array stored under key
+func (a *Map) GetArray(key string) (*Array, bool) {
+	item, found := a.Get(key)
+	if !found {
+		return nil, false
+	}
+	ref, ok := item.(collectionRef)
+	if !ok || ref.CollectionKind() != collectionKindArray {
+		return nil, false
+	}
+	return FetchArray(ref.ChildMetaSegmentID(), a.sp), true
+}
+
+// GetMap returns the child map stored at index
+func (a *Array) GetMap(index uint32) (*Map, bool) {
+	item, found := a.Get(index)
+	if !found {
+		return nil, false
+	}
+	ref, ok := item.(collectionRef)
+	if !ok || ref.CollectionKind() != collectionKindMap {
+		return nil, false
+	}
+	return FetchMap(ref.ChildMetaSegmentID(), a.sp), true
+}
+
+// GetArray returns the child array stored at index
+func (a *Array) GetArray(index uint32) (*Array, bool) {
+	item, found := a.Get(index)
+	if !found {
+		return nil, false
+	}
+	ref, ok := item.(collectionRef)
+	if !ok || ref.CollectionKind() != collectionKindArray {
+		return nil, false
+	}
+	return FetchArray(ref.ChildMetaSegmentID(), a.sp), true
+}
+
+// DeepSize returns the size of the map including the sizes of all nested collections,
+// segments that can't be read are left out and reported through Err
+func (a *Map) DeepSize() uint32 {
+	mseg := a.MapMetaSegment()
+	total := mseg.size
+	for _, segH := range mseg.sortedSegHeaders {
+		seg, err := a.segment(segH.segID)
+		if err != nil {
+			a.setErr(err)
+			continue
+		}
+		for _, id := range seg.References() {
+			total += collectionDeepSize(a.sp, id)
+		}
+	}
+	return total
+}
+
+// DeepSize returns the size of the array including the sizes of all nested collections,
+// segments that can't be read are left out and reported through Err
+func (a *Array) DeepSize() uint32 {
+	mseg := a.ArrayMetaSegment()
+	total := mseg.size
+	for _, segH := range mseg.sortedSegHeaders {
+		seg, err := a.segment(segH.segID)
+		if err != nil {
+			a.setErr(err)
+			continue
+		}
+		for _, id := range seg.References() {
+			total += collectionDeepSize(a.sp, id)
+		}
+	}
+	return total
+}
+
+func collectionDeepSize(sp SegmentProvider, metaSegmentID SegmentID) uint32 {
+	switch sp.GetSegment(metaSegmentID).(type) {
+	case *MapMetaSegment:
+		return FetchMap(metaSegmentID, sp).DeepSize()
+	case *ArrayMetaSegment:
+		return FetchArray(metaSegmentID, sp).DeepSize()
+	}
+	return 0
+}
+
+// copyCollection creates a deep copy of the collection with the given meta segment in sp,
+// nested collections are copied as well so the copy shares no segments with the original
+func copyCollection(sp SegmentProvider, metaSegmentID SegmentID) (SegmentID, error) {
+	switch sp.GetSegment(metaSegmentID).(type) {
+	case *MapMetaSegment:
+		return copyMap(sp, metaSegmentID)
+	case *ArrayMetaSegment:
+		return copyArray(sp, metaSegmentID)
+	}
+	return 0, fmt.Errorf("collection %d not found", metaSegmentID)
+}
+
+func copyMap(sp SegmentProvider, metaSegmentID SegmentID) (SegmentID, error) {
+	res := NewMap(sp)
+	it := FetchMap(metaSegmentID, sp).Iterator()
+	for it.Next() {
+		item, err := copyMapItem(sp, it.Item())
+		if err == nil {
+			err = res.Insert(item)
+			if err != nil {
+				dropChild(sp, item)
+			}
+		}
+		if err != nil {
+			dropCollection(sp, res.metaSegmentID)
+			return 0, fmt.Errorf("key %q: %w", it.Item().Key(), err)
+		}
+	}
+	if err := it.Err(); err != nil {
+		dropCollection(sp, res.metaSegmentID)
+		return 0, err
+	}
+	return res.metaSegmentID, nil
+}
+
+func copyArray(sp SegmentProvider, metaSegmentID SegmentID) (SegmentID, error) {
+	src := FetchArray(metaSegmentID, sp)
+	mseg, err := src.metaSegment()
+	if err != nil {
+		return 0, err
+	}
+	res := NewArray(sp)
+	for _, segH := range mseg.sortedSegHeaders {
+		seg, err := src.segment(segH.segID)
+		if err != nil {
+			dropCollection(sp, res.metaSegmentID)
+			return 0, err
+		}
+		for _, item := range seg.elements {
+			cp, err := copyArrayItem(sp, item)
+			if err == nil {
+				err = res.Insert(cp)
+				if err != nil {
+					dropChild(sp, cp)
+				}
+			}
+			if err != nil {
+				dropCollection(sp, res.metaSegmentID)
+				return 0, fmt.Errorf("index %d: %w", item.Index(), err)
+			}
+		}
+	}
+	return res.metaSegmentID, nil
+}
+
+// copyMapItem returns the item itself, or for a child collection an item pointing to a deep copy of it
+func copyMapItem(sp SegmentProvider, item MapItem) (MapItem, error) {
+	ref, ok := item.(collectionRef)
+	if !ok {
+		return item, nil
+	}
+	id, err := copyCollection(sp, ref.ChildMetaSegmentID())
+	if err != nil {
+		return nil, err
+	}
+	return CollectionMapItem{item.Key(), ref.CollectionKind(), id}, nil
+}
+
+// copyArrayItem returns the item itself, or for a child collection an item pointing to a deep copy of it
+func copyArrayItem(sp SegmentProvider, item ArrayItem) (ArrayItem, error) {
+	ref, ok := item.(collectionRef)
+	if !ok {
+		return item, nil
+	}
+	id, err := copyCollection(sp, ref.ChildMetaSegmentID())
+	if err != nil {
+		return nil, err
+	}
+	return CollectionArrayItem{item.Index(), ref.CollectionKind(), id}, nil
+}
+
+// dropChild drops the child collection of an item that couldn't be stored
+func dropChild(sp SegmentProvider, item interface{}) {
+	if ref, ok := item.(collectionRef); ok {
+		dropCollection(sp, ref.ChildMetaSegmentID())
+	}
+}
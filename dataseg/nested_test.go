@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// checkReachable fails if a segment of sp is not reachable from root or a reference points to a missing segment
+func checkReachable(t *testing.T, sp SegmentProvider, root SegmentID) {
+	t.Helper()
+	report, err := CollectGarbage(sp, []SegmentID{root}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Removed) > 0 || len(report.Missing) > 0 {
+		t.Fatalf("unreachable segments %v, missing segments %v", report.Removed, report.Missing)
+	}
+}
+
+func TestOversizedPutKeepsChild(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	mm := NewMap(sp)
+	child, err := mm.NewChildMap("K")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Insert(StringMapItem{"A", "AAA"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mm.Insert(BytesMapItem{"K", []byte("too long")}); !errors.Is(err, ErrItemTooLarge) {
+		t.Fatalf("expected ErrItemTooLarge got %v", err)
+	}
+	got, ok := mm.GetMap("K")
+	if !ok {
+		t.Fatal("child map was dropped")
+	}
+	if item, found := got.Get("A"); !found || string(item.Encoded()) != "AAA" {
+		t.Fatalf("child map lost its content, got %v", item)
+	}
+	checkReachable(t, sp, mm.metaSegmentID)
+
+	// an array item only fits a child id below 128, so the child is referenced by a small id
+	// that doesn't have to exist, ids handed out by generateUUID grow with every test
+	aa := NewArray(sp)
+	if err := aa.Insert(CollectionArrayItem{0, collectionKindArray, 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := aa.Insert(BytesArrayItem{0, []byte("long")}); !errors.Is(err, ErrItemTooLarge) {
+		t.Fatalf("expected ErrItemTooLarge got %v", err)
+	}
+	if _, ok := aa.GetArray(0); !ok {
+		t.Fatal("child array was dropped")
+	}
+}
+
+func TestReplacingChildDropsItsSegments(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	mm := NewMap(sp)
+	child, err := mm.NewChildMap("K")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grandchild, err := child.NewChildArray("G")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mm.Insert(StringMapItem{"K", "V"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []SegmentID{child.metaSegmentID, grandchild.metaSegmentID} {
+		if sp.GetSegment(id) != nil {
+			t.Fatalf("segment %d of the replaced child is still stored", id)
+		}
+	}
+	checkReachable(t, sp, mm.metaSegmentID)
+
+	child, _ = mm.NewChildMap("C")
+	if err := mm.Remove("C"); err != nil {
+		t.Fatal(err)
+	}
+	if sp.GetSegment(child.metaSegmentID) != nil {
+		t.Fatal("removed child is still stored")
+	}
+	checkReachable(t, sp, mm.metaSegmentID)
+}
+
+func TestDeepSize(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	mm := NewMap(sp)
+	child, _ := mm.NewChildArray("K")
+	child.AppendByteArrayItem(1)
+	want := mm.MapMetaSegment().size + child.ArrayMetaSegment().size
+	if got := mm.DeepSize(); got != want {
+		t.Fatalf("deep size %d want %d", got, want)
+	}
+}
+
+func ExampleMap_NewChildArray() {
+	sp := NewBasicSegmentProvider()
+	users := NewMap(sp)
+	for _, user := range []string{"A", "B"} {
+		events, err := users.NewChildArray(user)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		for i := 0; i < 6; i++ {
+			events.AppendByteArrayItem(uint8(i))
+		}
+	}
+	events, _ := users.GetArray("A")
+	fmt.Println(events.Get(3))
+	fmt.Println(len(sp.SegmentIDs()))
+	// removing the item removes the child array with it
+	users.Remove("A")
+	fmt.Println(len(sp.SegmentIDs()))
+	// Output:
+	// {3 2} true
+	// 8
+	// 5
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// QuotaExceededError is returned when a write would take an owner over its quota
+type QuotaExceededError struct {
+	Owner     string
+	SegmentID SegmentID
+	Usage     uint64 // bytes stored by the owner before the write
+	Requested uint64 // bytes the owner would store after the write
+	Quota     uint64
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("quota exceeded for owner %q: writing segment %d needs %d bytes, quota is %d (currently using %d)",
+		e.Owner, e.SegmentID, e.Requested, e.Quota, e.Usage)
+}
+
+// OwnerUsage reports the storage used by a single owner
+type OwnerUsage struct {
+	Owner    string
+	Bytes    uint64
+	Segments int
+	Quota    uint64 // zero means no quota
+}
+
+// StorageLedger accounts the bytes stored in a segment provider per owner (collection)
+// and enforces per owner quotas, the size of a segment is the length of its encoded form
+type StorageLedger struct {
+	sp       SegmentProvider
+	owners   map[SegmentID]string
+	sizes    map[SegmentID]uint64
+	usage    map[string]uint64
+	segments map[string]int
+	quotas   map[string]uint64
+}
+
+func NewStorageLedger(sp SegmentProvider) *StorageLedger {
+	return &StorageLedger{
+		sp:       sp,
+		owners:   make(map[SegmentID]string),
+		sizes:    make(map[SegmentID]uint64),
+		usage:    make(map[string]uint64),
+		segments: make(map[string]int),
+		quotas:   make(map[string]uint64),
+	}
+}
+
+// SetQuota limits the number of bytes an owner can store, zero removes the quota
+func (l *StorageLedger) SetQuota(owner string, bytes uint64) {
+	if bytes == 0 {
+		delete(l.quotas, owner)
+		return
+	}
+	l.quotas[owner] = bytes
+}
+
+// Owner returns a segment provider that charges every segment written through it to the given owner
+func (l *StorageLedger) Owner(owner string) *OwnerSegmentProvider {
+	return &OwnerSegmentProvider{ledger: l, owner: owner}
+}
+
+// Usage returns the number of bytes currently stored by the owner
+func (l *StorageLedger) Usage(owner string) uint64 {
+	return l.usage[owner]
+}
+
+// TotalUsage returns the number of bytes stored by all owners
+func (l *StorageLedger) TotalUsage() uint64 {
+	total := uint64(0)
+	for _, u := range l.usage {
+		total += u
+	}
+	return total
+}
+
+// Report returns the usage of every owner that has stored something or has a quota, sorted by owner
+func (l *StorageLedger) Report() []OwnerUsage {
+	names := make(map[string]bool)
+	for o := range l.usage {
+		names[o] = true
+	}
+	for o := range l.quotas {
+		names[o] = true
+	}
+	res := make([]OwnerUsage, 0, len(names))
+	for o := range names {
+		res = append(res, OwnerUsage{
+			Owner:    o,
+			Bytes:    l.usage[o],
+			Segments: l.segments[o],
+			Quota:    l.quotas[o],
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Owner < res[j].Owner })
+	return res
+}
+
+func (l *StorageLedger) add(owner string, seg Segment) error {
+	return l.write(owner, []Segment{seg}, nil)
+}
+
+// write stores adds and removes removes if the usage of the owner after all of them stays within its
+// quota, otherwise nothing is written. A batch that doesn't grow the usage is always accepted.
+func (l *StorageLedger) write(owner string, adds []Segment, removes []Segment) error {
+	sizes := make([]uint64, len(adds))
+	requested := l.usage[owner]
+	var grown SegmentID
+	for _, seg := range removes {
+		if l.owners[seg.ID()] == owner {
+			requested -= l.sizes[seg.ID()]
+		}
+	}
+	for i, seg := range adds {
+		id := seg.ID()
+		sizes[i] = uint64(len(seg.Encoded()))
+		oldSize := uint64(0)
+		if l.owners[id] == owner {
+			// a segment changing hands is charged in full to the new owner
+			oldSize = l.sizes[id]
+		}
+		if sizes[i] > oldSize && grown == 0 {
+			grown = id
+		}
+		requested = requested - oldSize + sizes[i]
+	}
+	if quota, ok := l.quotas[owner]; ok && requested > quota && requested > l.usage[owner] {
+		return &QuotaExceededError{
+			Owner:     owner,
+			SegmentID: grown,
+			Usage:     l.usage[owner],
+			Requested: requested,
+			Quota:     quota,
+		}
+	}
+	for _, seg := range removes {
+		l.remove(seg)
+	}
+	for i, seg := range adds {
+		id := seg.ID()
+		if prevOwner, ok := l.owners[id]; ok && prevOwner != owner {
+			// segment changes hands, the previous owner is not charged anymore
+			l.release(id)
+		}
+		if _, ok := l.owners[id]; !ok {
+			l.owners[id] = owner
+			l.segments[owner]++
+		}
+		l.usage[owner] = l.usage[owner] - l.sizes[id] + sizes[i]
+		l.sizes[id] = sizes[i]
+		l.sp.AddSegment(seg)
+	}
+	return nil
+}
+
+func (l *StorageLedger) remove(seg Segment) {
+	l.release(seg.ID())
+	l.sp.RemoveSegment(seg)
+}
+
+func (l *StorageLedger) release(id SegmentID) {
+	owner, ok := l.owners[id]
+	if !ok {
+		return
+	}
+	l.usage[owner] -= l.sizes[id]
+	l.segments[owner]--
+	if l.segments[owner] == 0 {
+		delete(l.usage, owner)
+		delete(l.segments, owner)
+	}
+	delete(l.owners, id)
+	delete(l.sizes, id)
+}
+
+// OwnerSegmentProvider is a view of a ledger that charges writes to a single owner
+//
+// Collections hand the writes of an operation over with WriteBatch, so a rejected operation is
+// returned by Insert or Remove and leaves the collection as it was. AddSegment can't return an error
+// as part of the SegmentProvider interface, rejected writes made through it are not forwarded to the
+// underlying provider and the error is kept until Err is called.
+type OwnerSegmentProvider struct {
+	ledger *StorageLedger
+	owner  string
+	err    error
+}
+
+func (o *OwnerSegmentProvider) GetSegment(id SegmentID) Segment {
+	return o.ledger.sp.GetSegment(id)
+}
+
+func (o *OwnerSegmentProvider) AddSegment(seg Segment) {
+	if err := o.TryAddSegment(seg); err != nil && o.err == nil {
+		o.err = err
+	}
+}
+
+// TryAddSegment is AddSegment that reports a *QuotaExceededError when the write is rejected
+func (o *OwnerSegmentProvider) TryAddSegment(seg Segment) error {
+	return o.ledger.add(o.owner, seg)
+}
+
+// WriteBatch stores adds and removes removes if the quota of the owner allows all of them together,
+// otherwise nothing is written and a *QuotaExceededError is returned
+func (o *OwnerSegmentProvider) WriteBatch(adds []Segment, removes []Segment) error {
+	return o.ledger.write(o.owner, adds, removes)
+}
+
+func (o *OwnerSegmentProvider) RemoveSegment(seg Segment) {
+	o.ledger.remove(seg)
+}
+
+// SegmentIDs lists the segments of the underlying provider, it returns nil if the provider can't list
+func (o *OwnerSegmentProvider) SegmentIDs() []SegmentID {
+	if lister, ok := o.ledger.sp.(SegmentLister); ok {
+		return lister.SegmentIDs()
+	}
+	return nil
+}
+
+// Err returns the first rejected write since the last call and clears it
+func (o *OwnerSegmentProvider) Err() error {
+	err := o.err
+	o.err = nil
+	return err
+}
+
+// Usage returns the number of bytes stored by the owner of this view
+func (o *OwnerSegmentProvider) Usage() uint64 {
+	return o.ledger.Usage(o.owner)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// fillUntilRejected inserts keys A, B, C, ... with value XXXX until a write is rejected
+func fillUntilRejected(t *testing.T, mm *Map) (inserted []string, rejected string) {
+	t.Helper()
+	for _, k := range []string{"A", "B", "C", "D", "E", "F", "G", "H"} {
+		err := mm.Insert(StringMapItem{k, "XXXX"})
+		if err == nil {
+			inserted = append(inserted, k)
+			continue
+		}
+		var qe *QuotaExceededError
+		if !errors.As(err, &qe) {
+			t.Fatalf("inserting %s: expected a quota error got %v", k, err)
+		}
+		return inserted, k
+	}
+	t.Fatal("no write was rejected")
+	return nil, ""
+}
+
+func TestQuotaRejectsWholeOperation(t *testing.T) {
+	for name, newProvider := range providers() {
+		t.Run(name, func(t *testing.T) {
+			ledger := NewStorageLedger(newProvider())
+			ledger.SetQuota("bob", 120)
+			bob := ledger.Owner("bob")
+			mm := NewMap(bob)
+			inserted, rejected := fillUntilRejected(t, mm)
+
+			if v := mm.Check(); len(v) > 0 {
+				t.Fatalf("map is not consistent after a rejected write: %v", v)
+			}
+			if _, found := mm.Get(rejected); found {
+				t.Fatalf("rejected key %s is readable", rejected)
+			}
+			for _, k := range inserted {
+				if _, found := mm.Get(k); !found {
+					t.Fatalf("key %s is missing", k)
+				}
+			}
+			if err := bob.Err(); err != nil {
+				t.Fatalf("rejected batch left an error behind: %v", err)
+			}
+			// the ledger charges exactly what is stored
+			stored := uint64(0)
+			for _, id := range bob.SegmentIDs() {
+				stored += uint64(len(bob.GetSegment(id).Encoded()))
+			}
+			if ledger.Usage("bob") != stored {
+				t.Fatalf("ledger reports %d bytes but %d are stored", ledger.Usage("bob"), stored)
+			}
+			// removing frees space for the next write
+			if err := mm.Remove(inserted[0]); err != nil {
+				t.Fatal(err)
+			}
+			if err := mm.Insert(StringMapItem{inserted[0], "X"}); err != nil {
+				t.Fatal(err)
+			}
+			if v := mm.Check(); len(v) > 0 {
+				t.Fatalf("map is not consistent: %v", v)
+			}
+		})
+	}
+}
+
+func TestQuotaRejectsArrayAppend(t *testing.T) {
+	ledger := NewStorageLedger(NewBasicSegmentProvider())
+	ledger.SetQuota("alice", 100)
+	aa := NewArray(ledger.Owner("alice"))
+	var err error
+	appended := 0
+	for ; appended < 20; appended++ {
+		if err = aa.AppendByteArrayItem(uint8(appended)); err != nil {
+			break
+		}
+	}
+	var qe *QuotaExceededError
+	if !errors.As(err, &qe) || qe.Owner != "alice" {
+		t.Fatalf("expected a quota error for alice got %v", err)
+	}
+	if v := aa.Check(); len(v) > 0 {
+		t.Fatalf("array is not consistent after a rejected write: %v", v)
+	}
+	if got := aa.Stats().Elements; got != uint64(appended) {
+		t.Fatalf("expected %d elements got %d", appended, got)
+	}
+	if ledger.Usage("alice") > 100 {
+		t.Fatalf("usage %d is above the quota", ledger.Usage("alice"))
+	}
+}
+
+func TestLedgerWriteBatch(t *testing.T) {
+	ledger := NewStorageLedger(NewBasicSegmentProvider())
+	o := ledger.Owner("o")
+	small := NewArraySegment(generateUUID())
+	large := NewArraySegment(generateUUID())
+	large.AddItem(ByteArrayItem{1, 1})
+	if err := o.WriteBatch([]Segment{small}, nil); err != nil {
+		t.Fatal(err)
+	}
+	ledger.SetQuota("o", uint64(len(large.Encoded())))
+	// replacing small by large fits, adding large next to small doesn't
+	if err := o.WriteBatch([]Segment{large}, nil); err == nil {
+		t.Fatal("expected the batch to be rejected")
+	}
+	if o.GetSegment(large.ID()) != nil {
+		t.Fatal("rejected batch was written")
+	}
+	if err := o.WriteBatch([]Segment{large}, []Segment{small}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ledger.Usage("o"), uint64(len(large.Encoded())); got != want {
+		t.Fatalf("usage %d want %d", got, want)
+	}
+	if r := ledger.Report(); len(r) != 1 || r[0].Segments != 1 {
+		t.Fatalf("unexpected report %+v", r)
+	}
+}
+
+// recordingBatchProvider accepts every batch and records the removals in the order they were handed over
+type recordingBatchProvider struct {
+	*BasicSegmentProvider
+	removed []SegmentID
+}
+
+func (p *recordingBatchProvider) WriteBatch(adds []Segment, removes []Segment) error {
+	for _, seg := range adds {
+		p.AddSegment(seg)
+	}
+	for _, seg := range removes {
+		p.removed = append(p.removed, seg.ID())
+		p.RemoveSegment(seg)
+	}
+	return nil
+}
+
+func TestBatchRemovesInIDOrder(t *testing.T) {
+	bsp := &recordingBatchProvider{BasicSegmentProvider: NewBasicSegmentProvider()}
+	var sp SegmentProvider = bsp
+	segs := make([]Segment, 8)
+	for i := range segs {
+		segs[i] = NewArraySegment(generateUUID())
+		bsp.AddSegment(segs[i])
+	}
+	err := runBatch(&sp, func() error {
+		for _, i := range []int{5, 1, 7, 0, 3} {
+			sp.RemoveSegment(sp.GetSegment(segs[i].ID()))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SegmentID{segs[0].ID(), segs[1].ID(), segs[3].ID(), segs[5].ID(), segs[7].ID()}
+	if !equalIDs(bsp.removed, want) {
+		t.Fatalf("expected removals %v got %v", want, bsp.removed)
+	}
+}
+
+func TestBatchRestoresProviderOnPanic(t *testing.T) {
+	bsp := &recordingBatchProvider{BasicSegmentProvider: NewBasicSegmentProvider()}
+	var sp SegmentProvider = bsp
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected the panic to reach the caller")
+			}
+		}()
+		runBatch(&sp, func() error { panic("write failed") })
+	}()
+	if sp != SegmentProvider(bsp) {
+		t.Fatalf("expected the provider to be restored got %T", sp)
+	}
+}
+
+func ExampleStorageLedger() {
+	ledger := NewStorageLedger(NewBasicSegmentProvider())
+	ledger.SetQuota("bob", 80)
+	aa := NewArray(ledger.Owner("alice"))
+	for i := 0; i < 10; i++ {
+		aa.AppendByteArrayItem(uint8(i))
+	}
+	mm := NewMap(ledger.Owner("bob"))
+	for _, item := range []StringMapItem{{"A", "AAAA"}, {"B", "BBB"}, {"C", "CC"}, {"D", "DDDD"}} {
+		var qe *QuotaExceededError
+		if err := mm.Insert(item); errors.As(err, &qe) {
+			fmt.Println("rejected", item.Key(), "for", qe.Owner)
+		}
+	}
+	_, found := mm.Get("D")
+	fmt.Println(found)
+	for _, u := range ledger.Report() {
+		fmt.Printf("%s: %d bytes in %d segments (quota %d)\n", u.Owner, u.Bytes, u.Segments, u.Quota)
+	}
+	// Output:
+	// rejected C for bob
+	// rejected D for bob
+	// false
+	// alice: 201 bytes in 4 segments (quota 0)
+	// bob: 77 bytes in 2 segments (quota 80)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"testing/quick"
+)
+
+// randomOps is the number of operations per randomized run, the byte provider decodes a segment on every
+// access so runs are kept short
+const randomOps = 300
+
+// providers returns the providers the randomized checks run against, the byte provider makes sure
+// every change is written back to the provider
+func providers() map[string]func() SegmentProvider {
+	return map[string]func() SegmentProvider{
+		"basic": func() SegmentProvider { return NewBasicSegmentProvider() },
+		"bytes": func() SegmentProvider { return NewByteSegmentProvider(false) },
+	}
+}
+
+func TestRandomArray(t *testing.T) {
+	for name, newProvider := range providers() {
+		t.Run(name, func(t *testing.T) {
+			check := func(seed int64) bool {
+				if err := randomArrayCheck(newProvider(), seed, randomOps); err != nil {
+					t.Log(err)
+					return false
+				}
+				return true
+			}
+			if err := quick.Check(check, &quick.Config{MaxCount: 20}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestRandomMap(t *testing.T) {
+	for name, newProvider := range providers() {
+		t.Run(name, func(t *testing.T) {
+			check := func(seed int64) bool {
+				if err := randomMapCheck(newProvider(), seed, randomOps); err != nil {
+					t.Log(err)
+					return false
+				}
+				return true
+			}
+			if err := quick.Check(check, &quick.Config{MaxCount: 20}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// randomArrayCheck applies random inserts and removes of items with different sizes to an array and to
+// a reference map, after each operation the array content and its structure are compared against the
+// reference
+func randomArrayCheck(sp SegmentProvider, seed int64, ops int) error {
+	rnd := rand.New(rand.NewSource(seed))
+	aa := NewArray(sp)
+	ref := make(map[uint32][]byte)
+	for op := 0; op < ops; op++ {
+		index := uint32(rnd.Intn(64))
+		if rnd.Intn(3) == 0 {
+			aa.Remove(index)
+			delete(ref, index)
+		} else {
+			var item ArrayItem
+			if n := rnd.Intn(4); n == 3 {
+				item = ByteArrayItem{index, byte(rnd.Intn(256))}
+			} else {
+				// values of 0 to 2 bytes give item sizes from 4 to 6
+				item = BytesArrayItem{index, []byte(randomString(rnd, n))}
+			}
+			aa.Insert(item)
+			ref[index] = item.Encoded()
+		}
+		if err := compareArray(aa, ref); err != nil {
+			return fmt.Errorf("seed %d op %d: %w", seed, op, err)
+		}
+	}
+	return nil
+}
+
+func compareArray(aa *Array, ref map[uint32][]byte) error {
+	if v := aa.Check(); len(v) > 0 {
+		return fmt.Errorf("array is not consistent: %v", v)
+	}
+	indices := make([]uint32, 0, len(ref))
+	for i := range ref {
+		indices = append(indices, i)
+	}
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+	expected := make([]byte, 0)
+	for _, index := range indices {
+		expected = append(expected, ref[index]...)
+		item, found := aa.Get(index)
+		if !found || !bytes.Equal(item.Encoded(), ref[index]) {
+			return fmt.Errorf("index %d: expected %v got %v (found %v)", index, ref[index], item, found)
+		}
+	}
+	if !aa.ValidateCorrectness(expected) {
+		return fmt.Errorf("array values don't match %v", expected)
+	}
+	return nil
+}
+
+// randomMapCheck applies random inserts and removes to a map and to a reference go map,
+// after each operation the map content and its structure are compared against the reference
+func randomMapCheck(sp SegmentProvider, seed int64, ops int) error {
+	rnd := rand.New(rand.NewSource(seed))
+	mm := NewMap(sp)
+	ref := make(map[string]string)
+	for op := 0; op < ops; op++ {
+		key := randomString(rnd, 1+rnd.Intn(2))
+		if rnd.Intn(3) == 0 {
+			mm.Remove(key)
+			delete(ref, key)
+		} else {
+			value := randomString(rnd, rnd.Intn(maxItemSize-len(key)+1))
+			mm.Insert(StringMapItem{key, value})
+			ref[key] = value
+		}
+		if err := compareMap(mm, ref); err != nil {
+			return fmt.Errorf("seed %d op %d: %w", seed, op, err)
+		}
+	}
+	return nil
+}
+
+func compareMap(mm *Map, ref map[string]string) error {
+	if v := mm.Check(); len(v) > 0 {
+		return fmt.Errorf("map is not consistent: %v", v)
+	}
+	count := 0
+	mseg := mm.MapMetaSegment()
+	for _, segH := range mseg.sortedSegHeaders {
+		count += len(mm.sp.GetSegment(segH.segID).(*MapSegment).keys)
+	}
+	if count != len(ref) {
+		return fmt.Errorf("expected %d keys got %d", len(ref), count)
+	}
+	for k, v := range ref {
+		item, found := mm.Get(k)
+		if !found || string(item.Encoded()) != v {
+			return fmt.Errorf("key %q: expected %q got %q (found %v)", k, v, item.Encoded(), found)
+		}
+	}
+	return nil
+}
+
+func randomString(rnd *rand.Rand, n int) string {
+	const letters = "ABCDEFGH"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letters[rnd.Intn(len(letters))]
+	}
+	return string(b)
+}
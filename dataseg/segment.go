@@ -1,7 +1,16 @@
 package main
 
+import (
+	"errors"
+	"fmt"
+)
+
 type SegmentID int
 
+// ErrSegmentNotFound is matched (errors.Is) by the errors returned when a collection references a segment
+// the provider doesn't return
+var ErrSegmentNotFound = errors.New("segment not found")
+
 type Segment interface {
 	ID() SegmentID     // returns a unique id for this segment used for storage
 	Encoded() []byte   // produces encoded value of this segment for storage
@@ -14,6 +23,30 @@ type SegmentProvider interface {
 	RemoveSegment(seg Segment)
 }
 
+// SegmentLister is implemented by providers that can enumerate the segments they hold
+type SegmentLister interface {
+	SegmentIDs() []SegmentID
+}
+
+// errorReporter is implemented by providers that keep the first failed read, e.g. a corrupt segment
+type errorReporter interface {
+	Err() error
+}
+
+// loadSegment returns the segment with the given id. If the provider returns nil the failed read it
+// reports through Err is returned, so a corrupt segment keeps its reason, and otherwise ErrSegmentNotFound.
+func loadSegment(sp SegmentProvider, id SegmentID) (Segment, error) {
+	if seg := sp.GetSegment(id); seg != nil {
+		return seg, nil
+	}
+	if r, ok := sp.(errorReporter); ok {
+		if err := r.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("segment %d: %w", id, ErrSegmentNotFound)
+}
+
 // think of it as ledger
 type BasicSegmentProvider struct {
 	segments map[SegmentID]Segment
@@ -34,3 +67,38 @@ func (s *BasicSegmentProvider) AddSegment(seg Segment) {
 func (s *BasicSegmentProvider) RemoveSegment(seg Segment) {
 	delete(s.segments, seg.ID())
 }
+
+// SegmentIDs returns the ids of all stored segments in no particular order
+func (s *BasicSegmentProvider) SegmentIDs() []SegmentID {
+	ids := make([]SegmentID, 0, len(s.segments))
+	for id := range s.segments {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// EnvelopeSegment holds the transformed (e.g. compressed) encoding of another segment with the same id,
+// it is what provider wrappers store in the provider they wrap
+type EnvelopeSegment struct {
+	id      SegmentID
+	payload []byte
+}
+
+func (e EnvelopeSegment) ID() SegmentID {
+	return e.id
+}
+
+func (e EnvelopeSegment) Encoded() []byte {
+	res := []byte{segKindEnvelope}
+	res = append(res, e.payload...)
+	return sealSegment(res)
+}
+
+func (e *EnvelopeSegment) Load(data []byte) error {
+	d, err := openSegment(e.id, data, segKindEnvelope)
+	if err != nil {
+		return err
+	}
+	e.payload = append([]byte{}, d.b...)
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import "fmt"
+
+// SetItem is a map item without a value, only the key counts towards the segment size
+type SetItem struct {
+	key string
+}
+
+func (s SetItem) Key() string     { return s.key }
+func (s SetItem) Encoded() []byte { return nil }
+func (s SetItem) Size() uint32    { return uint32(len(s.key)) }
+
+// Set is a sorted set of keys, it reuses the map segments (sorted keys, split and merge, meta segment)
+// and stores SetItems so no bytes are spent on values
+type Set struct {
+	m *Map
+}
+
+func NewSet(sp SegmentProvider) *Set {
+	return &Set{m: NewMap(sp)}
+}
+
+func FetchSet(metaSegmentID SegmentID, sp SegmentProvider) *Set {
+	return &Set{m: FetchMap(metaSegmentID, sp)}
+}
+
+// MetaSegmentID returns the id of the meta segment, used to fetch the set again
+func (s *Set) MetaSegmentID() SegmentID {
+	return s.m.metaSegmentID
+}
+
+func (s *Set) Add(key string) error {
+	item := SetItem{key}
+	if item.Size() > maxItemSize {
+		return fmt.Errorf("key %q: %w", key, ErrItemTooLarge)
+	}
+	return s.m.Insert(item)
+}
+
+func (s *Set) Contains(key string) bool {
+	_, found := s.m.Get(key)
+	return found
+}
+
+func (s *Set) Delete(key string) error {
+	return s.m.Remove(key)
+}
+
+// ForEach calls fn for every key in order, iteration stops when fn returns false
+func (s *Set) ForEach(fn func(key string) bool) {
+	it := s.m.Iterator()
+	for it.Next() {
+		if !fn(it.Item().Key()) {
+			return
+		}
+	}
+}
+
+// Union returns a new set (stored in the same provider as s) with the keys that are in s or in other
+func (s *Set) Union(other *Set) (*Set, error) {
+	return s.combine(other, true, true, true)
+}
+
+// Intersection returns a new set (stored in the same provider as s) with the keys that are in both s and other
+func (s *Set) Intersection(other *Set) (*Set, error) {
+	return s.combine(other, false, true, false)
+}
+
+// Difference returns a new set (stored in the same provider as s) with the keys of s that are not in other
+func (s *Set) Difference(other *Set) (*Set, error) {
+	return s.combine(other, true, false, false)
+}
+
+// combine walks both sets in order and keeps keys that are only in s, in both or only in other,
+// it stops at the first rejected write
+func (s *Set) combine(other *Set, onlyLeft, both, onlyRight bool) (*Set, error) {
+	res := NewSet(s.m.sp)
+	left := s.m.Iterator()
+	right := other.m.Iterator()
+	hasLeft, hasRight := left.Next(), right.Next()
+	for hasLeft || hasRight {
+		var key string
+		keep := false
+		switch {
+		case !hasRight || (hasLeft && left.Item().Key() < right.Item().Key()):
+			key, keep = left.Item().Key(), onlyLeft
+			hasLeft = left.Next()
+		case !hasLeft || right.Item().Key() < left.Item().Key():
+			key, keep = right.Item().Key(), onlyRight
+			hasRight = right.Next()
+		default:
+			key, keep = left.Item().Key(), both
+			hasLeft, hasRight = left.Next(), right.Next()
+		}
+		if !keep {
+			continue
+		}
+		if err := res.m.Insert(SetItem{key}); err != nil {
+			dropCollection(s.m.sp, res.m.metaSegmentID)
+			return nil, err
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func newSet(t *testing.T, sp SegmentProvider, keys ...string) *Set {
+	t.Helper()
+	s := NewSet(sp)
+	for _, k := range keys {
+		if err := s.Add(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func setKeys(s *Set) string {
+	keys := make([]string, 0)
+	s.ForEach(func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return strings.Join(keys, ",")
+}
+
+func TestSet(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	s := newSet(t, sp, "m", "c", "x", "a", "c", "q", "b", "z", "k", "e", "f", "g", "h", "i", "j")
+	if got := setKeys(s); got != "a,b,c,e,f,g,h,i,j,k,m,q,x,z" {
+		t.Fatalf("unexpected keys %s", got)
+	}
+	if err := s.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Contains("c") || !s.Contains("q") {
+		t.Fatal("unexpected membership after delete")
+	}
+	if err := s.Add("toolong"); !errors.Is(err, ErrItemTooLarge) {
+		t.Fatalf("expected ErrItemTooLarge got %v", err)
+	}
+	if v := s.m.Check(); len(v) > 0 {
+		t.Fatalf("set is not consistent: %v", v)
+	}
+	if got := setKeys(FetchSet(s.MetaSegmentID(), sp)); got != "a,b,e,f,g,h,i,j,k,m,q,x,z" {
+		t.Fatalf("unexpected keys after fetch %s", got)
+	}
+}
+
+func TestSetAlgebra(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	s := newSet(t, sp, "a", "b", "c", "d")
+	other := newSet(t, sp, "c", "d", "e")
+	for _, tc := range []struct {
+		name    string
+		combine func(*Set) (*Set, error)
+		want    string
+	}{
+		{"union", s.Union, "a,b,c,d,e"},
+		{"intersection", s.Intersection, "c,d"},
+		{"difference", s.Difference, "a,b"},
+	} {
+		res, err := tc.combine(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := setKeys(res); got != tc.want {
+			t.Errorf("%s: expected %s got %s", tc.name, tc.want, got)
+		}
+	}
+	if got := setKeys(s); got != "a,b,c,d" {
+		t.Fatalf("the operands should not change, got %s", got)
+	}
+}
+
+func ExampleSet() {
+	sp := NewBasicSegmentProvider()
+	s1 := NewSet(sp)
+	s2 := NewSet(sp)
+	for _, k := range []string{"A", "C", "E", "G", "I", "K"} {
+		s1.Add(k)
+	}
+	for _, k := range []string{"B", "C", "D", "G", "K", "M"} {
+		s2.Add(k)
+	}
+	s1.Delete("I")
+	fmt.Println(s1.Contains("A"), s1.Contains("I"))
+	for _, combine := range []func(*Set) (*Set, error){s1.Union, s1.Intersection, s1.Difference} {
+		res, err := combine(s2)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		keys := make([]string, 0)
+		res.ForEach(func(key string) bool {
+			keys = append(keys, key)
+			return true
+		})
+		fmt.Println(strings.Join(keys, " "))
+	}
+	// Output:
+	// true false
+	// A B C D E G K M
+	// C G K
+	// A E
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// A snapshot archive holds the magic, the JSON manifest with its length, the encoded segments in
+// manifest order each with its id and length, and a sha256 trailer over everything before it.
+// Segments are archived as the provider returns them, so taking a snapshot through a compressing
+// or encrypting provider writes plain segments.
+
+const snapshotMagic = "DSEGSNP1"
+
+// SnapshotManifest lists the content of a snapshot archive
+type SnapshotManifest struct {
+	Roots    []SegmentID     `json:"roots"`
+	Count    int             `json:"count"`
+	Segments []SnapshotEntry `json:"segments"` // sorted by id
+}
+
+// SnapshotEntry describes a single archived segment
+type SnapshotEntry struct {
+	ID   SegmentID `json:"id"`
+	Size int       `json:"size"`
+	Hash string    `json:"hash"` // hex encoded sha256 of the encoded segment
+}
+
+// WriteSnapshot writes every segment reachable from the roots into an archive, it fails without
+// writing anything if a referenced segment is missing
+func WriteSnapshot(w io.Writer, sp SegmentProvider, roots []SegmentID) (*SnapshotManifest, error) {
+	marked, missing, err := markReachable(sp, roots)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("segments %v are referenced but missing", missing)
+	}
+	ids := make([]SegmentID, 0, len(marked))
+	for id := range marked {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	manifest := &SnapshotManifest{Roots: append([]SegmentID{}, roots...), Count: len(ids), Segments: make([]SnapshotEntry, 0, len(ids))}
+	encoded := make([][]byte, len(ids))
+	for i, id := range ids {
+		encoded[i] = sp.GetSegment(id).Encoded()
+		hash := sha256.Sum256(encoded[i])
+		manifest.Segments = append(manifest.Segments, SnapshotEntry{ID: id, Size: len(encoded[i]), Hash: hex.EncodeToString(hash[:])})
+	}
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	bw := bufio.NewWriter(io.MultiWriter(w, h))
+	bw.WriteString(snapshotMagic)
+	bw.Write(appendBytes(nil, manifestJSON))
+	for i, id := range ids {
+		bw.Write(appendUint64(nil, uint64(id)))
+		bw.Write(appendBytes(nil, encoded[i]))
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(h.Sum(nil)); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// RestoreSnapshot verifies an archive and adds its segments to sp, nothing is added if the archive
+// fails verification or if sp holds a different segment under one of the archived ids. Segments sp
+// already holds with the same content are kept, so restoring an archive twice is harmless.
+// After adding, every segment is read back from sp and compared to its hash.
+func RestoreSnapshot(r io.Reader, sp SegmentProvider) (*SnapshotManifest, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < len(snapshotMagic)+sha256.Size || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, fmt.Errorf("not a snapshot archive")
+	}
+	body, trailer := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if sum := sha256.Sum256(body); !bytes.Equal(sum[:], trailer) {
+		return nil, fmt.Errorf("snapshot checksum mismatch")
+	}
+
+	d := &decoder{b: body[len(snapshotMagic):]}
+	manifest := &SnapshotManifest{}
+	manifestJSON := d.bytes()
+	if d.err != nil {
+		return nil, fmt.Errorf("manifest: %w", d.err)
+	}
+	if err := json.Unmarshal(manifestJSON, manifest); err != nil {
+		return nil, fmt.Errorf("manifest: %w", err)
+	}
+	if manifest.Count != len(manifest.Segments) {
+		return nil, fmt.Errorf("manifest lists %d segments but counts %d", len(manifest.Segments), manifest.Count)
+	}
+	segments := make([]Segment, 0, manifest.Count)
+	for _, entry := range manifest.Segments {
+		id := SegmentID(d.uint64())
+		raw := d.bytes()
+		if d.err != nil {
+			return nil, fmt.Errorf("segment %d: %w", entry.ID, d.err)
+		}
+		if id != entry.ID {
+			return nil, fmt.Errorf("expected segment %d got %d", entry.ID, id)
+		}
+		if err := verifySnapshotEntry(entry, raw); err != nil {
+			return nil, err
+		}
+		seg, err := DecodeSegment(id, raw)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, seg)
+	}
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	conflicts := make([]SegmentID, 0)
+	missing := make([]Segment, 0, len(segments))
+	for i, seg := range segments {
+		existing := sp.GetSegment(seg.ID())
+		if existing == nil {
+			missing = append(missing, seg)
+		} else if verifySnapshotEntry(manifest.Segments[i], existing.Encoded()) != nil {
+			conflicts = append(conflicts, seg.ID())
+		}
+	}
+	if len(conflicts) > 0 {
+		return nil, fmt.Errorf("segments %v already exist with a different content", conflicts)
+	}
+	for _, seg := range missing {
+		sp.AddSegment(seg)
+	}
+	for _, entry := range manifest.Segments {
+		seg := sp.GetSegment(entry.ID)
+		if seg == nil {
+			return manifest, fmt.Errorf("segment %d is missing after restore", entry.ID)
+		}
+		if err := verifySnapshotEntry(entry, seg.Encoded()); err != nil {
+			return manifest, fmt.Errorf("after restore: %w", err)
+		}
+	}
+	return manifest, nil
+}
+
+func verifySnapshotEntry(entry SnapshotEntry, raw []byte) error {
+	hash := sha256.Sum256(raw)
+	if len(raw) != entry.Size || hex.EncodeToString(hash[:]) != entry.Hash {
+		return fmt.Errorf("segment %d doesn't match its manifest entry", entry.ID)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func snapshotOf(t *testing.T, sp SegmentProvider, roots ...SegmentID) []byte {
+	t.Helper()
+	var archive bytes.Buffer
+	if _, err := WriteSnapshot(&archive, sp, roots); err != nil {
+		t.Fatal(err)
+	}
+	return archive.Bytes()
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	mm := NewMap(sp)
+	for _, k := range []string{"A", "B", "C", "D", "E", "F", "G"} {
+		mm.Insert(StringMapItem{k, "XXXX"})
+	}
+	sp.AddSegment(NewMapSegment(generateUUID()))
+	archive := snapshotOf(t, sp, mm.metaSegmentID)
+
+	restored := NewByteSegmentProvider(false)
+	for i := 0; i < 2; i++ {
+		manifest, err := RestoreSnapshot(bytes.NewReader(archive), restored)
+		if err != nil {
+			t.Fatalf("restore %d: %v", i, err)
+		}
+		if manifest.Count != len(restored.SegmentIDs()) || manifest.Count != len(sp.SegmentIDs())-1 {
+			t.Fatalf("restored %d of %d segments", len(restored.SegmentIDs()), manifest.Count)
+		}
+	}
+	got := FetchMap(mm.metaSegmentID, restored)
+	if v := got.Check(); len(v) != 0 {
+		t.Fatal(v)
+	}
+	if item, found := got.Get("D"); !found || string(item.Encoded()) != "XXXX" {
+		t.Fatalf("unexpected item %v", item)
+	}
+}
+
+func TestRestoreRefusesExistingIDs(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	mm := NewMap(sp)
+	mm.Insert(StringMapItem{"A", "AAAA"})
+	archive := snapshotOf(t, sp, mm.metaSegmentID)
+
+	// the target holds other data under the id of the archived meta segment
+	target := NewBasicSegmentProvider()
+	other := NewMapSegment(mm.metaSegmentID)
+	other.AddItem(StringMapItem{"Z", "Z"})
+	target.AddSegment(other)
+	if _, err := RestoreSnapshot(bytes.NewReader(archive), target); err == nil {
+		t.Fatal("restore overwrote an existing segment")
+	}
+	if len(target.SegmentIDs()) != 1 {
+		t.Fatalf("refused restore added segments %v", target.SegmentIDs())
+	}
+	if seg, ok := target.GetSegment(mm.metaSegmentID).(*MapSegment); !ok || seg.FirstKey() != "Z" {
+		t.Fatal("existing segment was changed")
+	}
+}
+
+func TestRestoreRejectsDamagedArchive(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	aa := NewArray(sp)
+	for i := 0; i < 30; i++ {
+		aa.AppendByteArrayItem(uint8(i))
+	}
+	archive := snapshotOf(t, sp, aa.metaSegmentID)
+	for _, at := range []int{0, len(archive) / 3, len(archive) / 2, len(archive) - 1} {
+		damaged := append([]byte{}, archive...)
+		damaged[at] ^= 1
+		target := NewBasicSegmentProvider()
+		if _, err := RestoreSnapshot(bytes.NewReader(damaged), target); err == nil {
+			t.Fatalf("damaged byte %d was not detected", at)
+		}
+		if len(target.SegmentIDs()) != 0 {
+			t.Fatal("damaged archive was partially restored")
+		}
+	}
+	if _, err := RestoreSnapshot(bytes.NewReader(archive[:len(archive)-1]), NewBasicSegmentProvider()); err == nil {
+		t.Fatal("truncated archive was accepted")
+	}
+}
+
+func ExampleWriteSnapshot() {
+	sp := NewBasicSegmentProvider()
+	mm := NewMap(sp)
+	for _, k := range []string{"A", "B", "C", "D", "E"} {
+		mm.Insert(StringMapItem{k, "XXXX"})
+	}
+	// an unreachable segment is left out of the archive
+	sp.AddSegment(NewMapSegment(generateUUID()))
+	var archive bytes.Buffer
+	manifest, err := WriteSnapshot(&archive, sp, []SegmentID{mm.metaSegmentID})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(len(manifest.Roots), manifest.Count, len(sp.SegmentIDs()))
+
+	restored := NewByteSegmentProvider(false)
+	if _, err := RestoreSnapshot(bytes.NewReader(archive.Bytes()), restored); err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(FetchMap(manifest.Roots[0], restored).Check())
+
+	// a flipped bit anywhere in the archive is detected before anything is restored
+	damaged := archive.Bytes()
+	damaged[len(damaged)/2] ^= 1
+	target := NewBasicSegmentProvider()
+	_, err = RestoreSnapshot(bytes.NewReader(damaged), target)
+	fmt.Println(err != nil, len(target.SegmentIDs()))
+	// Output:
+	// 1 3 4
+	// []
+	// true 0
+}
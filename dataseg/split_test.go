@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestArraySegmentSplitWithConfig(t *testing.T) {
+	seg := NewArraySegment(generateUUID())
+	for i, v := range []string{"a", "b", "c", "dd"} {
+		seg.AddItem(BytesArrayItem{uint32(i), []byte(v)})
+	}
+	right := seg.SplitWithConfig(DefaultSplitConfig())
+	if seg.totalSize != 10 || right.totalSize != 11 {
+		t.Fatalf("split sizes %d/%d, want 10/11", seg.totalSize, right.totalSize)
+	}
+}
+
+func TestSplitConfigIsPerCollection(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	leaner := NewArray(sp)
+	leaner.SetSplitConfig(SplitConfig{Bias: 0.1})
+	plain := NewArray(sp)
+	for i := 0; i < 5; i++ {
+		leaner.AppendByteArrayItem(byte(i))
+		plain.AppendByteArrayItem(byte(i))
+	}
+	first := func(a *Array) uint32 {
+		return a.ArrayMetaSegment().sortedSegHeaders[0].size
+	}
+	if got := first(leaner); got != 10 {
+		t.Errorf("array with bias 0.1 kept %d bytes on the left, want 10", got)
+	}
+	// 10 and 15 bytes are equally close to the middle, ties keep the left side fuller
+	if got := first(plain); got != 15 {
+		t.Errorf("array with the default config kept %d bytes on the left, want 15", got)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import "time"
+
+// statsHistogramBuckets is the number of equal width histogram buckets below maxThreshold,
+// segments at or above maxThreshold are counted in one extra bucket
+const statsHistogramBuckets = 10
+
+// structuralCounts counts the structural changes made through a collection handle since it was created or fetched
+type structuralCounts struct {
+	splits          int
+	merges          int
+	redistributions int
+}
+
+// structuralChange is a split, merge or redistribute of an operation that is not applied yet
+type structuralChange struct {
+	op      ChangeOp
+	size    uint32
+	elapsed time.Duration
+}
+
+func (c *structuralCounts) record(op ChangeOp) {
+	switch op {
+	case OpSplit:
+		c.splits++
+	case OpMerge:
+		c.merges++
+	case OpRedistribute:
+		c.redistributions++
+	}
+}
+
+// CollectionStats summarizes the segments of a collection, it is computed from the segment headers
+// without loading the segments themselves
+type CollectionStats struct {
+	Elements        uint64  `json:"elements"`
+	Segments        int     `json:"segments"`
+	MinFill         float64 `json:"minFill"` // segment size relative to maxThreshold
+	AvgFill         float64 `json:"avgFill"`
+	MaxFill         float64 `json:"maxFill"`
+	Bytes           uint64  `json:"bytes"`     // sum of the segment sizes
+	MetaBytes       int     `json:"metaBytes"` // encoded size of the meta segment
+	Splits          int     `json:"splits"`    // changes made through this handle since it was opened
+	Merges          int     `json:"merges"`
+	Redistributions int     `json:"redistributions"`
+	BucketWidth     uint32  `json:"bucketWidth"`
+	// Histogram[i] counts the segments with i*BucketWidth <= size < (i+1)*BucketWidth,
+	// the last bucket holds every segment at or above maxThreshold
+	Histogram []int `json:"histogram"`
+}
+
+func newCollectionStats(sizes []uint32, counts []uint32, metaBytes int, sc structuralCounts) CollectionStats {
+	width := uint32(maxThreshold / statsHistogramBuckets)
+	if width == 0 {
+		width = 1
+	}
+	buckets := (maxThreshold + width - 1) / width
+	res := CollectionStats{
+		Segments:        len(sizes),
+		MetaBytes:       metaBytes,
+		Splits:          sc.splits,
+		Merges:          sc.merges,
+		Redistributions: sc.redistributions,
+		BucketWidth:     width,
+		Histogram:       make([]int, buckets+1),
+	}
+	for i, size := range sizes {
+		fill := float64(size) / maxThreshold
+		if i == 0 || fill < res.MinFill {
+			res.MinFill = fill
+		}
+		if fill > res.MaxFill {
+			res.MaxFill = fill
+		}
+		res.Elements += uint64(counts[i])
+		res.Bytes += uint64(size)
+		bucket := size / width
+		if size >= maxThreshold {
+			bucket = buckets
+		}
+		res.Histogram[bucket]++
+	}
+	if len(sizes) > 0 {
+		res.AvgFill = float64(res.Bytes) / maxThreshold / float64(len(sizes))
+	}
+	return res
+}
+
+// Stats returns statistics about the segments of the map
+func (a *Map) Stats() CollectionStats {
+	mseg := a.MapMetaSegment()
+	sizes := make([]uint32, len(mseg.sortedSegHeaders))
+	counts := make([]uint32, len(mseg.sortedSegHeaders))
+	for i, h := range mseg.sortedSegHeaders {
+		sizes[i], counts[i] = h.size, h.count
+	}
+	return newCollectionStats(sizes, counts, len(mseg.Encoded()), a.counts)
+}
+
+// Stats returns statistics about the segments of the array
+func (a *Array) Stats() CollectionStats {
+	mseg := a.ArrayMetaSegment()
+	sizes := make([]uint32, len(mseg.sortedSegHeaders))
+	counts := make([]uint32, len(mseg.sortedSegHeaders))
+	for i, h := range mseg.sortedSegHeaders {
+		sizes[i], counts[i] = h.size, h.count
+	}
+	return newCollectionStats(sizes, counts, len(mseg.Encoded()), a.counts)
+}
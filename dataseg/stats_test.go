@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestAppendsAreCounted(t *testing.T) {
+	aa := NewArray(NewBasicSegmentProvider())
+	for i := 0; i < 20; i++ {
+		aa.AppendByteArrayItem(uint8(i))
+	}
+	st := aa.Stats()
+	if st.Elements != 20 {
+		t.Fatalf("expected 20 elements got %d", st.Elements)
+	}
+	if st.Segments < 2 || st.Splits != st.Segments-1 {
+		t.Fatalf("expected %d splits for %d segments got %d", st.Segments-1, st.Segments, st.Splits)
+	}
+}
+
+func TestMapStats(t *testing.T) {
+	mm := NewMap(NewBasicSegmentProvider())
+	for _, k := range []string{"A", "B", "C", "D", "E", "F"} {
+		mm.Insert(StringMapItem{k, "XXX"})
+	}
+	mm.Remove("A")
+	mm.Remove("B")
+	mm.Remove("C")
+	st := mm.Stats()
+	if st.Elements != 3 || st.Bytes != uint64(mm.MapMetaSegment().size) {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	if st.Splits == 0 || st.Merges+st.Redistributions == 0 {
+		t.Fatalf("structural changes were not counted %+v", st)
+	}
+	hist := 0
+	for _, n := range st.Histogram {
+		hist += n
+	}
+	if hist != st.Segments {
+		t.Fatalf("histogram holds %d segments, want %d", hist, st.Segments)
+	}
+}
+
+func TestMetaSegmentRejectsOldLayoutsAndNoHeaders(t *testing.T) {
+	aa := NewArray(NewBasicSegmentProvider())
+	mm := NewMap(NewBasicSegmentProvider())
+	for _, m := range []Segment{aa.ArrayMetaSegment(), mm.MapMetaSegment()} {
+		data := m.Encoded()
+		body := append([]byte{}, data[:len(data)-4]...)
+		// the kinds without format version are not read anymore
+		for _, kind := range []byte{2, 4} {
+			old := append([]byte{kind}, body[2:]...)
+			if _, err := DecodeSegment(m.ID(), sealSegment(old)); err == nil {
+				t.Fatalf("expected an error for kind %d", kind)
+			}
+		}
+		// kind, version and size are followed by the number of headers
+		noHeaders := appendUint32(append([]byte{}, body[:6]...), 0)
+		if mseg, ok := m.(*MapMetaSegment); ok {
+			noHeaders = appendUint32(noHeaders, uint32(len(mseg.indexes)))
+		}
+		_, err := DecodeSegment(m.ID(), sealSegment(noHeaders))
+		var ce *CorruptSegmentError
+		if !errors.As(err, &ce) || !strings.Contains(err.Error(), "no segment headers") {
+			t.Fatalf("expected a corrupt segment without headers got %v", err)
+		}
+	}
+}
+
+func TestUnknownMetaFormatVersion(t *testing.T) {
+	m := ArrayMetaSegment{id: generateUUID()}
+	data := m.Encoded()
+	body := append([]byte{}, data[:len(data)-4]...)
+	body[1] = metaFormatVersion + 1
+	_, err := DecodeSegment(m.id, sealSegment(body))
+	var ce *CorruptSegmentError
+	if !errors.As(err, &ce) {
+		t.Fatalf("expected a corrupt segment error got %v", err)
+	}
+}
+
+func ExampleMap_Stats() {
+	sp := NewBasicSegmentProvider()
+	mm := NewMap(sp)
+	for _, k := range []string{"A", "B", "C", "D", "E", "F", "G"} {
+		mm.Insert(StringMapItem{k, "XXXX"})
+	}
+	mm.Remove("C")
+	mm.Remove("D")
+	fmt.Printf("%+v\n", mm.Stats())
+	// a fetched handle starts counting from zero
+	fmt.Printf("%+v\n", FetchMap(mm.metaSegmentID, sp).Stats())
+	// Output:
+	// {Elements:5 Segments:2 MinFill:0.5 AvgFill:0.625 MaxFill:0.75 Bytes:25 MetaBytes:60 Splits:2 Merges:1 Redistributions:0 BucketWidth:2 Histogram:[0 0 0 0 0 1 0 1 0 0 0]}
+	// {Elements:5 Segments:2 MinFill:0.5 AvgFill:0.625 MaxFill:0.75 Bytes:25 MetaBytes:60 Splits:0 Merges:0 Redistributions:0 BucketWidth:2 Histogram:[0 0 0 0 0 1 0 1 0 0 0]}
+}
@@ -0,0 +1,79 @@
+package main
+
+import "sort"
+
+// ByteSegmentProvider keeps segments in their encoded form, like a disk would, every GetSegment
+// decodes and verifies the stored bytes. Segments that fail verification are reported through Err,
+// with quarantine enabled their bytes are also moved aside so they can be inspected later.
+type ByteSegmentProvider struct {
+	segments   map[SegmentID][]byte
+	quarantine map[SegmentID][]byte // nil when quarantine is disabled
+	err        error
+}
+
+func NewByteSegmentProvider(quarantineCorrupt bool) *ByteSegmentProvider {
+	p := &ByteSegmentProvider{segments: make(map[SegmentID][]byte)}
+	if quarantineCorrupt {
+		p.quarantine = make(map[SegmentID][]byte)
+	}
+	return p
+}
+
+// GetSegment returns nil if the segment doesn't exist or is corrupt
+func (p *ByteSegmentProvider) GetSegment(id SegmentID) Segment {
+	data, ok := p.segments[id]
+	if !ok {
+		return nil
+	}
+	seg, err := DecodeSegment(id, data)
+	if err != nil {
+		if p.err == nil {
+			p.err = err
+		}
+		if p.quarantine != nil {
+			p.quarantine[id] = data
+			delete(p.segments, id)
+		}
+		return nil
+	}
+	return seg
+}
+
+func (p *ByteSegmentProvider) AddSegment(seg Segment) {
+	p.segments[seg.ID()] = seg.Encoded()
+}
+
+func (p *ByteSegmentProvider) RemoveSegment(seg Segment) {
+	delete(p.segments, seg.ID())
+}
+
+func (p *ByteSegmentProvider) SegmentIDs() []SegmentID {
+	ids := make([]SegmentID, 0, len(p.segments))
+	for id := range p.segments {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Err returns the first corruption found since the last call and clears it
+func (p *ByteSegmentProvider) Err() error {
+	err := p.err
+	p.err = nil
+	return err
+}
+
+// Quarantined returns the ids of the segments moved to quarantine, in increasing order
+func (p *ByteSegmentProvider) Quarantined() []SegmentID {
+	ids := make([]SegmentID, 0, len(p.quarantine))
+	for id := range p.quarantine {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// QuarantinedBytes returns the stored bytes of a quarantined segment
+func (p *ByteSegmentProvider) QuarantinedBytes(id SegmentID) ([]byte, bool) {
+	data, ok := p.quarantine[id]
+	return data, ok
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestByteSegmentProviderRoundTrip(t *testing.T) {
+	sp := NewByteSegmentProvider(false)
+	mm := NewMap(sp)
+	for _, k := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		if err := mm.Insert(StringMapItem{k, k + k}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	child, err := mm.NewChildArray("L")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillArray(t, child, 10)
+
+	for _, id := range sp.SegmentIDs() {
+		seg := sp.GetSegment(id)
+		if seg == nil {
+			t.Fatalf("segment %d can't be decoded: %v", id, sp.Err())
+		}
+		if !bytes.Equal(seg.Encoded(), sp.segments[id]) {
+			t.Fatalf("segment %d doesn't encode to its stored bytes", id)
+		}
+	}
+	if v := mm.Check(); len(v) > 0 {
+		t.Fatalf("map is not consistent: %v", v)
+	}
+	if v := child.Check(); len(v) > 0 {
+		t.Fatalf("child array is not consistent: %v", v)
+	}
+}
+
+func TestByteSegmentProviderDetectsCorruption(t *testing.T) {
+	for _, quarantine := range []bool{false, true} {
+		sp := NewByteSegmentProvider(quarantine)
+		aa := NewArray(sp)
+		fillArray(t, aa, 5)
+		id := aa.ArrayMetaSegment().sortedSegHeaders[0].segID
+		sp.segments[id][1] ^= 0x01
+		corrupted := append([]byte{}, sp.segments[id]...)
+
+		if sp.GetSegment(id) != nil {
+			t.Fatal("expected a corrupt segment to be rejected")
+		}
+		err := sp.Err()
+		var corrupt *CorruptSegmentError
+		if !errors.Is(err, ErrCorruptSegment) || !errors.As(err, &corrupt) || corrupt.ID != id {
+			t.Fatalf("expected a corrupt segment error for %d got %v", id, err)
+		}
+		if _, found := aa.Get(2); found || aa.Err() == nil {
+			t.Fatal("expected reads of the corrupt segment to fail")
+		}
+
+		data, ok := sp.QuarantinedBytes(id)
+		if quarantine != ok {
+			t.Fatalf("quarantine %v but segment quarantined %v", quarantine, ok)
+		}
+		if quarantine {
+			if !bytes.Equal(data, corrupted) || len(sp.Quarantined()) != 1 {
+				t.Fatal("expected the corrupt bytes to be kept in quarantine")
+			}
+			if _, found := sp.segments[id]; found {
+				t.Fatal("expected the corrupt segment to be moved out of the store")
+			}
+		}
+	}
+}
+
+func ExampleByteSegmentProvider() {
+	sp := NewByteSegmentProvider(true)
+	mm := NewMap(sp)
+	mm.Insert(StringMapItem{"A", "AAAA"})
+	segID := mm.MapMetaSegment().sortedSegHeaders[0].segID
+	// flip a bit of the stored segment
+	sp.segments[segID][3] ^= 1
+	fmt.Println(sp.GetSegment(segID))
+	err := sp.Err()
+	fmt.Println(errors.Is(err, ErrCorruptSegment), len(sp.Quarantined()))
+	_, found := mm.Get("A")
+	fmt.Println(found, mm.Err() != nil)
+	// Output:
+	// <nil>
+	// true 1
+	// false true
+}
@@ -0,0 +1,134 @@
+package main
+
+import "fmt"
+
+// TypedArray is an Array of values of type T, values are converted using the codec
+// and stored as BytesArrayItem
+type TypedArray[T any] struct {
+	array *Array
+	codec Codec[T]
+}
+
+func NewTypedArray[T any](sp SegmentProvider, codec Codec[T]) *TypedArray[T] {
+	return &TypedArray[T]{array: NewArray(sp), codec: codec}
+}
+
+func FetchTypedArray[T any](metaSegmentID SegmentID, sp SegmentProvider, codec Codec[T]) *TypedArray[T] {
+	return &TypedArray[T]{array: FetchArray(metaSegmentID, sp), codec: codec}
+}
+
+// Array returns the underlying untyped array
+func (a *TypedArray[T]) Array() *Array {
+	return a.array
+}
+
+func (a *TypedArray[T]) Set(index uint32, v T) error {
+	b, err := a.codec.Encode(v)
+	if err != nil {
+		return fmt.Errorf("index %d: %w", index, err)
+	}
+	item := BytesArrayItem{index, b}
+	if item.Size() > maxItemSize {
+		return fmt.Errorf("index %d: %w", index, ErrItemTooLarge)
+	}
+	return a.array.Insert(item)
+}
+
+// Append stores the value after the last element and returns its index
+func (a *TypedArray[T]) Append(v T) (uint32, error) {
+	last, err := a.array.lastIndex()
+	if err != nil {
+		return 0, err
+	}
+	index := last + 1
+	return index, a.Set(index, v)
+}
+
+func (a *TypedArray[T]) Get(index uint32) (v T, found bool, err error) {
+	item, found, err := a.array.get(index)
+	if err != nil || !found {
+		return v, false, err
+	}
+	v, err = a.codec.Decode(item.Encoded())
+	if err != nil {
+		return v, true, fmt.Errorf("index %d: %w", index, err)
+	}
+	return v, true, nil
+}
+
+func (a *TypedArray[T]) Remove(index uint32) error {
+	return a.array.Remove(index)
+}
+
+// TypedMap is a Map from keys of type K to values of type V, keys are converted using the key codec
+// and values using the value codec, items are stored as BytesMapItem
+type TypedMap[K any, V any] struct {
+	m      *Map
+	keys   KeyCodec[K]
+	values Codec[V]
+}
+
+func NewTypedMap[K any, V any](sp SegmentProvider, keys KeyCodec[K], values Codec[V]) *TypedMap[K, V] {
+	return &TypedMap[K, V]{m: NewMap(sp), keys: keys, values: values}
+}
+
+func FetchTypedMap[K any, V any](metaSegmentID SegmentID, sp SegmentProvider, keys KeyCodec[K], values Codec[V]) *TypedMap[K, V] {
+	return &TypedMap[K, V]{m: FetchMap(metaSegmentID, sp), keys: keys, values: values}
+}
+
+// Map returns the underlying untyped map
+func (m *TypedMap[K, V]) Map() *Map {
+	return m.m
+}
+
+func (m *TypedMap[K, V]) Put(k K, v V) error {
+	b, err := m.values.Encode(v)
+	if err != nil {
+		return fmt.Errorf("key %v: %w", k, err)
+	}
+	item := BytesMapItem{m.keys.EncodeKey(k), b}
+	if item.Size() > maxItemSize {
+		return fmt.Errorf("key %v: %w", k, ErrItemTooLarge)
+	}
+	return m.m.Insert(item)
+}
+
+func (m *TypedMap[K, V]) Get(k K) (v V, found bool, err error) {
+	item, found, err := m.m.get(m.keys.EncodeKey(k))
+	if err != nil || !found {
+		return v, false, err
+	}
+	v, err = m.values.Decode(item.Encoded())
+	if err != nil {
+		return v, true, fmt.Errorf("key %v: %w", k, err)
+	}
+	return v, true, nil
+}
+
+func (m *TypedMap[K, V]) Remove(k K) error {
+	return m.m.Remove(m.keys.EncodeKey(k))
+}
+
+// Range calls fn for every entry with from <= key < to in key order, scanning stops when fn returns false
+func (m *TypedMap[K, V]) Range(from, to K, fn func(K, V) bool) error {
+	upper := m.keys.EncodeKey(to)
+	it := m.m.seek(m.keys.EncodeKey(from))
+	for it.Next() {
+		item := it.Item()
+		if upper != "" && item.Key() >= upper {
+			return nil
+		}
+		k, err := m.keys.DecodeKey(item.Key())
+		if err != nil {
+			return err
+		}
+		v, err := m.values.Decode(item.Encoded())
+		if err != nil {
+			return err
+		}
+		if !fn(k, v) {
+			return nil
+		}
+	}
+	return it.Err()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestTypedArray(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	a := NewTypedArray[int64](sp, VarintCodec{})
+	values := []int64{0, -1, 63, -64, 300}
+	indexes := make([]uint32, len(values))
+	for i, v := range values {
+		index, err := a.Append(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && index != indexes[i-1]+1 {
+			t.Fatalf("expected index %d got %d", indexes[i-1]+1, index)
+		}
+		indexes[i] = index
+	}
+	if err := a.Set(10, 1<<40); !errors.Is(err, ErrItemTooLarge) {
+		t.Fatalf("expected ErrItemTooLarge got %v", err)
+	}
+	if err := a.Remove(indexes[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	fetched := FetchTypedArray[int64](a.Array().metaSegmentID, sp, VarintCodec{})
+	for i, v := range values {
+		got, found, err := fetched.Get(indexes[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			if found {
+				t.Fatal("expected the removed index to be gone")
+			}
+			continue
+		}
+		if !found || got != v {
+			t.Fatalf("index %d: expected %d got %d (found %v)", indexes[i], v, got, found)
+		}
+	}
+}
+
+func TestTypedArrayDecodeError(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	a := NewTypedArray[int64](sp, VarintCodec{})
+	// 0x80 starts a varint that never ends
+	if err := a.Array().Insert(BytesArrayItem{0, []byte{0x80}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, err := a.Get(0); !found || err == nil {
+		t.Fatalf("expected a decode error got found %v err %v", found, err)
+	}
+}
+
+func TestTypedMap(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	m := NewTypedMap[string, int64](sp, StringKeyCodec{}, VarintCodec{})
+	want := map[string]int64{"a": 1, "bb": -2, "c": 100, "dd": 0}
+	for k, v := range want {
+		if err := m.Put(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Put("longer", 1); !errors.Is(err, ErrItemTooLarge) {
+		t.Fatalf("expected ErrItemTooLarge got %v", err)
+	}
+	if err := m.Remove("c"); err != nil {
+		t.Fatal(err)
+	}
+	delete(want, "c")
+
+	fetched := FetchTypedMap[string, int64](m.Map().metaSegmentID, sp, StringKeyCodec{}, VarintCodec{})
+	for k, v := range want {
+		got, found, err := fetched.Get(k)
+		if err != nil || !found || got != v {
+			t.Fatalf("key %q: expected %d got %d (found %v, %v)", k, v, got, found, err)
+		}
+	}
+	if _, found, err := fetched.Get("c"); found || err != nil {
+		t.Fatalf("expected the removed key to be gone got found %v err %v", found, err)
+	}
+
+	keys := make([]string, 0)
+	err := fetched.Range("b", "d", func(k string, v int64) bool {
+		keys = append(keys, k)
+		return true
+	})
+	if err != nil || len(keys) != 1 || keys[0] != "bb" {
+		t.Fatalf("expected [bb] got %v (%v)", keys, err)
+	}
+}
+
+func TestTypedMapKeepsReadErrorsToItself(t *testing.T) {
+	sp := NewBasicSegmentProvider()
+	m := NewTypedMap[string, string](sp, StringKeyCodec{}, StringCodec{})
+	if err := m.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	seg := sp.GetSegment(m.Map().MapMetaSegment().sortedSegHeaders[0].segID)
+
+	// an earlier failed read of the untyped map is not reported by an unrelated miss
+	sp.RemoveSegment(seg)
+	m.Map().Get("a")
+	sp.AddSegment(seg)
+	if _, found, err := m.Get("b"); found || err != nil {
+		t.Fatalf("expected a miss without error got found %v err %v", found, err)
+	}
+	if err := m.Map().Err(); err == nil {
+		t.Fatal("expected the earlier error to be left to the untyped map")
+	}
+
+	// the failed reads of Get and Range are returned and not left behind in the untyped map
+	sp.RemoveSegment(seg)
+	if _, _, err := m.Get("a"); err == nil {
+		t.Fatal("expected Get to fail")
+	}
+	if err := m.Range("", "z", func(string, string) bool { return true }); err == nil {
+		t.Fatal("expected Range to fail")
+	}
+	if err := m.Map().Err(); err != nil {
+		t.Fatalf("expected no error left in the untyped map got %v", err)
+	}
+}
+
+func ExampleTypedMap() {
+	sp := NewBasicSegmentProvider()
+	counts := NewTypedArray[int64](sp, VarintCodec{})
+	for _, v := range []int64{-1, 300, 7} {
+		fmt.Println(counts.Append(v))
+	}
+	fmt.Println(counts.Get(2))
+	names := NewTypedMap[string, string](sp, StringKeyCodec{}, StringCodec{})
+	fmt.Println(names.Put("a", "ann"))
+	fmt.Println(names.Put("b", "too long"))
+	fmt.Println(names.Get("a"))
+	// Output:
+	// 1 <nil>
+	// 2 <nil>
+	// 3 <nil>
+	// 300 true <nil>
+	// <nil>
+	// key b: item is larger than max item size
+	// ann true <nil>
+}
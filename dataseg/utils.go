@@ -1,5 +1,7 @@
 package main
 
+import "math"
+
 var counter int = 0
 
 func generateUUID() SegmentID {
@@ -7,6 +9,13 @@ func generateUUID() SegmentID {
 	return SegmentID(counter)
 }
 
+// reserveSegmentID makes sure generateUUID never returns an id that was loaded from storage
+func reserveSegmentID(id SegmentID) {
+	if int(id) > counter {
+		counter = int(id)
+	}
+}
+
 // Bit returns the bit at index `idx` in the byte array `b` (big endian)
 //
 // The function assumes b has at least idx bits. The caller must make sure this condition is met.
@@ -24,3 +33,98 @@ func SetBit(b []byte, i int) {
 	i &= 7
 	b[byteIndex] |= 1 << (7 - i)
 }
+
+// SplitConfig tunes where a collection splits its segments once they go above maxThreshold
+type SplitConfig struct {
+	// Bias is the share of bytes kept in the left segment, ties keep the left side fuller which
+	// suits append heavy arrays, raise it to favor appends even more
+	Bias float64
+	// Window is how far (as share of the segment bytes) a map split may move away from the
+	// balanced split point in order to get a shorter separator key, arrays ignore it
+	Window float64
+}
+
+// DefaultSplitConfig returns the config used by collections that were not given one
+func DefaultSplitConfig() SplitConfig {
+	return SplitConfig{Bias: 0.5, Window: 0.2}
+}
+
+// prefixSize returns the sum of the first n sizes
+func prefixSize(sizes []uint32, n int) uint32 {
+	total := uint32(0)
+	for _, s := range sizes[:n] {
+		total += s
+	}
+	return total
+}
+
+// balancedSplitPoint returns the number of items to keep on the left side of a split, so that the left
+// side is as close as possible to bias share of the total size, ties keep the left side fuller. Both
+// sides keep at least one item, split points keeping both sides within the thresholds come first and
+// then the ones keeping both sides under maxThreshold.
+func balancedSplitPoint(sizes []uint32, bias float64) int {
+	n := len(sizes)
+	if n < 2 {
+		return n
+	}
+	total := prefixSize(sizes, n)
+	target := bias * float64(total)
+	best, bestTier, bestDist := 0, 0, 0.0
+	left := uint32(0)
+	for bp := 1; bp < n; bp++ {
+		left += sizes[bp-1]
+		tier := splitTier(left, total-left)
+		dist := math.Abs(float64(left) - target)
+		if best == 0 || tier < bestTier || (tier == bestTier && dist <= bestDist) {
+			best, bestTier, bestDist = bp, tier, dist
+		}
+	}
+	return best
+}
+
+// splitTier ranks the sides of a split, 0 if both are within [minThreshold, maxThreshold],
+// 1 if both are under maxThreshold and 2 otherwise
+func splitTier(left, right uint32) int {
+	switch {
+	case left > maxThreshold || right > maxThreshold:
+		return 2
+	case left < minThreshold || right < minThreshold:
+		return 1
+	}
+	return 0
+}
+
+// shortestSeparator returns the shortest key s with lower < s <= upper, lower has to be smaller than upper
+func shortestSeparator(lower, upper string) string {
+	i := 0
+	for i < len(lower) && i < len(upper) && lower[i] == upper[i] {
+		i++
+	}
+	if i >= len(upper) {
+		return upper
+	}
+	return upper[:i+1]
+}
+
+// rebalanceNeighbors returns the neighbors of the item at index i among n items, the smaller one first
+func rebalanceNeighbors(n int, i int, size func(int) uint32) []int {
+	first := smallerNeighbor(n, i, size)
+	if other := 2*i - first; other >= 0 && other < n {
+		return []int{first, other}
+	}
+	return []int{first}
+}
+
+// smallerNeighbor returns the index of the smaller neighbor of the item at index i among n items
+func smallerNeighbor(n int, i int, size func(int) uint32) int {
+	if i == 0 {
+		return 1
+	}
+	if i == n-1 {
+		return i - 1
+	}
+	if size(i-1) <= size(i+1) {
+		return i - 1
+	}
+	return i + 1
+}
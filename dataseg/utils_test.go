@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestBalancedSplitPoint(t *testing.T) {
+	cases := []struct {
+		sizes []uint32
+		bias  float64
+		want  int
+	}{
+		{[]uint32{5, 5, 5, 6}, 0.5, 2},
+		{[]uint32{5, 5, 5, 5}, 0.5, 2},
+		{[]uint32{1, 9, 1, 10}, 0.5, 3},
+		{[]uint32{1, 9, 4, 9}, 0.5, 2},
+		// split points leaving a side below minThreshold are only used if there is no other
+		{[]uint32{5, 5, 5, 6}, 0.75, 2},
+		{[]uint32{5, 5, 5, 6}, 0.0, 2},
+		{[]uint32{2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2}, 0.0, 5},
+		{[]uint32{6, 6, 4, 5}, 0.5, 2},
+		{[]uint32{6, 6, 4, 5}, 1.0, 3},
+		// the closest split would leave 21 bytes on the right
+		{[]uint32{1, 1, 1, 19}, 0.0, 2},
+		{[]uint32{7}, 0.5, 1},
+	}
+	for _, c := range cases {
+		if got := balancedSplitPoint(c.sizes, c.bias); got != c.want {
+			t.Errorf("balancedSplitPoint(%v, %v) = %d, want %d", c.sizes, c.bias, got, c.want)
+		}
+	}
+}
+
+func TestShortestSeparator(t *testing.T) {
+	cases := []struct{ lower, upper, want string }{
+		{"abc", "abd", "abd"},
+		{"apple", "banana", "b"},
+		{"ab", "abzz", "abz"},
+	}
+	for _, c := range cases {
+		if got := shortestSeparator(c.lower, c.upper); got != c.want {
+			t.Errorf("shortestSeparator(%q, %q) = %q, want %q", c.lower, c.upper, got, c.want)
+		}
+	}
+}